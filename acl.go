@@ -0,0 +1,152 @@
+package socksauth
+
+import (
+	"fmt"
+	"net"
+)
+
+// AclAction decides whether a connection matching an ACL rule is allowed
+type AclAction string
+
+const (
+	AclAllow AclAction = "allow"
+	AclDeny  AclAction = "deny"
+)
+
+// AclRule allows or denies matching connections, criteria work like the ones of a RouteRule
+type AclRule struct {
+	Name   string    `json:"name,omitempty" yaml:"name,omitempty"`
+	Action AclAction `json:"action" yaml:"action"`
+
+	Sources []string `json:"sources,omitempty" yaml:"sources,omitempty"`
+	// Domains, CIDRs, Ports and Identities are only allowed in destination rules
+	Domains []string `json:"domains,omitempty" yaml:"domains,omitempty"`
+	CIDRs   []string `json:"cidrs,omitempty" yaml:"cidrs,omitempty"`
+	Ports   []string `json:"ports,omitempty" yaml:"ports,omitempty"`
+	// Identities are patterns matched against the subject of the client's TLS certificate, like "CN=*,O=Example"
+	Identities []string `json:"identities,omitempty" yaml:"identities,omitempty"`
+}
+
+// AclConfig are the access control lists of a server, rules are evaluated in order and the first match wins
+type AclConfig struct {
+	// Sources are checked right after a connection is accepted, so they can only match the client's address
+	Sources []AclRule `json:"sources,omitempty" yaml:"sources,omitempty"`
+	// SourceDefault is used if no source rule matches, default is allow
+	SourceDefault AclAction `json:"sourceDefault,omitempty" yaml:"sourceDefault,omitempty"`
+	// Destinations are checked after the client's request is read
+	Destinations []AclRule `json:"destinations,omitempty" yaml:"destinations,omitempty"`
+	// DestinationDefault is used if no destination rule matches, default is allow
+	DestinationDefault AclAction `json:"destinationDefault,omitempty" yaml:"destinationDefault,omitempty"`
+}
+
+// Acl decides which clients may connect and where they may connect to
+type Acl struct {
+	sources            []aclRule
+	sourceDefault      AclAction
+	destinations       []aclRule
+	destinationDefault AclAction
+}
+
+type aclRule struct {
+	name    string
+	action  AclAction
+	matcher requestMatcher
+}
+
+// NewAcl compiles the access control lists
+func NewAcl(config AclConfig) (*Acl, error) {
+	a := &Acl{}
+
+	var err error
+	if a.sourceDefault, err = aclDefault(config.SourceDefault); err != nil {
+		return nil, fmt.Errorf("source default: %w", err)
+	}
+	if a.destinationDefault, err = aclDefault(config.DestinationDefault); err != nil {
+		return nil, fmt.Errorf("destination default: %w", err)
+	}
+
+	for idx, rule := range config.Sources {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("source rule %d", idx+1)
+		}
+		if len(rule.Domains) > 0 || len(rule.CIDRs) > 0 || len(rule.Ports) > 0 || len(rule.Identities) > 0 {
+			return nil, fmt.Errorf("%s: source rules can only match sources", rule.Name)
+		}
+		compiled, err := compileAclRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		a.sources = append(a.sources, compiled)
+	}
+
+	for idx, rule := range config.Destinations {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("destination rule %d", idx+1)
+		}
+		compiled, err := compileAclRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		a.destinations = append(a.destinations, compiled)
+	}
+
+	return a, nil
+}
+
+// LoadAcl reads the access control lists from a JSON or YAML file
+func LoadAcl(path string) (*Acl, error) {
+	var config AclConfig
+	if err := decodeFile(path, &config); err != nil {
+		return nil, err
+	}
+
+	return NewAcl(config)
+}
+
+func aclDefault(action AclAction) (AclAction, error) {
+	switch action {
+	case "":
+		return AclAllow, nil
+	case AclAllow, AclDeny:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown action %q", action)
+}
+
+func compileAclRule(rule AclRule) (aclRule, error) {
+	if rule.Action != AclAllow && rule.Action != AclDeny {
+		return aclRule{}, fmt.Errorf("%s: unknown action %q", rule.Name, rule.Action)
+	}
+	matcher, err := newRequestMatcher(rule.Domains, rule.CIDRs, rule.Ports, rule.Sources, rule.Identities)
+	if err != nil {
+		return aclRule{}, fmt.Errorf("%s: %w", rule.Name, err)
+	}
+	return aclRule{name: rule.Name, action: rule.Action, matcher: matcher}, nil
+}
+
+// CheckSource returns whether a client may connect and the name of the rule which decided it, which is empty for the default
+func (a *Acl) CheckSource(clientAddr net.Addr) (bool, string) {
+	return checkAcl(a.sources, a.sourceDefault, Request{ClientAddr: clientAddr})
+}
+
+// CheckDestination returns whether a request is allowed and the name of the rule which decided it, which is empty for the default
+func (a *Acl) CheckDestination(req Request) (bool, string) {
+	return checkAcl(a.destinations, a.destinationDefault, req)
+}
+
+func checkAcl(rules []aclRule, defaultAction AclAction, req Request) (bool, string) {
+	for _, rule := range rules {
+		if rule.matcher.matches(req) {
+			return rule.action == AclAllow, rule.name
+		}
+	}
+	return defaultAction == AclAllow, ""
+}
+
+// deniedBy describes the rule which denied a connection for error messages
+func deniedBy(rule string) string {
+	if rule == "" {
+		return "the default ACL action"
+	}
+	return fmt.Sprintf("ACL rule %q", rule)
+}
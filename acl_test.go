@@ -0,0 +1,140 @@
+package socksauth
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAclChecks(t *testing.T) {
+	acl, err := LoadAcl(writeFile(t, "acl.yaml", `
+sources:
+  - name: office
+    action: allow
+    sources: [10.0.0.0/8]
+sourceDefault: deny
+destinations:
+  - name: internal
+    action: deny
+    cidrs: [10.0.0.0/8]
+    domains: [.internal]
+  - name: admins anywhere
+    action: allow
+    sources: [10.0.1.0/24]
+  - name: web
+    action: allow
+    ports: ["80", "443"]
+destinationDefault: deny
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := map[string]bool{"10.1.2.3": true, "192.168.1.1": false}
+	for ip, expected := range sources {
+		if allowed, _ := acl.CheckSource(&net.TCPAddr{IP: net.ParseIP(ip)}); allowed != expected {
+			t.Errorf("source %s: expected %v", ip, expected)
+		}
+	}
+
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.2.1")}
+	admin := &net.TCPAddr{IP: net.ParseIP("10.0.1.1")}
+	cases := []struct {
+		req     Request
+		allowed bool
+		rule    string
+	}{
+		{Request{ClientAddr: client, DestHost: "example.com", DestPort: 443}, true, "web"},
+		{Request{ClientAddr: client, DestHost: "example.com", DestPort: 22}, false, ""},
+		{Request{ClientAddr: client, DestHost: "10.0.0.5", DestPort: 443}, false, "internal"},
+		{Request{ClientAddr: admin, DestHost: "db.internal", DestPort: 5432}, false, "internal"},
+		{Request{ClientAddr: admin, DestHost: "example.com", DestPort: 22}, true, "admins anywhere"},
+	}
+	for _, c := range cases {
+		allowed, rule := acl.CheckDestination(c.req)
+		if allowed != c.allowed || rule != c.rule {
+			t.Errorf("%s from %s: expected %v by %q, got %v by %q", c.req.Destination(), c.req.ClientAddr, c.allowed, c.rule, allowed, rule)
+		}
+	}
+}
+
+func TestAclInvalid(t *testing.T) {
+	configs := map[string]AclConfig{
+		"unknown action":   {Destinations: []AclRule{{Action: "maybe"}}},
+		"unknown default":  {SourceDefault: "maybe"},
+		"source with port": {Sources: []AclRule{{Action: AclDeny, Ports: []string{"22"}}}},
+		"invalid cidr":     {Destinations: []AclRule{{Action: AclDeny, CIDRs: []string{"10.0.0.0/33"}}}},
+	}
+	for name, config := range configs {
+		if _, err := NewAcl(config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAclThroughServer(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	acl, err := NewAcl(AclConfig{
+		Destinations: []AclRule{{Name: "no ssh", Action: AclDeny, Ports: []string{"22"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan SocksError, 1)
+	_, proxyAddr := startTestServer(t, upstream.Addr, "user", "pass", WithAcl(acl),
+		WithOnError(func(id int64, conn net.Conn, err SocksError) { errs <- err }))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	if _, err := dialSocks(proxyAddr, "127.0.0.1:22", "", ""); err != socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+		t.Fatalf("expected a ruleset reply, got %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrAccessDenied) || !errors.Is(err, ErrConnectionNotAllowed) || !strings.Contains(err.Error(), `"no ssh"`) {
+			t.Errorf("expected an access denied error naming the rule, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an error")
+	}
+	if len(upstream.Destinations()) != 1 {
+		t.Errorf("expected the denied request not to reach the upstream, got %v", upstream.Destinations())
+	}
+}
+
+func TestAclDeniesSource(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	acl, err := NewAcl(AclConfig{Sources: []AclRule{{Name: "loopback", Action: AclDeny, Sources: []string{"127.0.0.0/8"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan SocksError, 1)
+	_, proxyAddr := startTestServer(t, upstream.Addr, "user", "pass", WithAcl(acl),
+		WithOnError(func(id int64, conn net.Conn, err SocksError) { errs <- err }))
+
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); err == nil {
+		t.Fatal("expected the client to be refused")
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrAccessDenied) || !strings.Contains(err.Error(), `"loopback"`) {
+			t.Errorf("expected an access denied error naming the rule, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an error")
+	}
+	if upstream.Auths.Load() != 0 {
+		t.Error("expected the denied client not to reach the upstream")
+	}
+}
@@ -0,0 +1,285 @@
+package socksauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// AdminHandler returns an HTTP handler to inspect the server at runtime. It has no authentication, so only serve it on a trusted address.
+//
+//	GET    /sessions           lists the sticky sessions of all finders
+//	DELETE /sessions?key=<key> unpins a sticky session
+//	POST   /rotate[?key=<key>] moves a sticky session or all of them to another upstream with their next connection
+//	GET    /credentials        lists the accounts of the credential pool without their passwords
+//	GET    /limits             returns the bandwidth limits
+//	PUT    /limits             replaces the bandwidth limits, open connections are shaped with them right away
+//	GET    /usage[?key=<key>]  lists the traffic usage of all users or a single one
+//	POST   /reload             reloads the settings with the config loader, see WithConfigLoader
+//	GET    /allocations[?id=<id>] lists the allocated local ports or returns a single one
+//	POST   /allocations        allocates a local port for the AllocationSpec in the body, its idleTTL is a duration like "5m"
+//	DELETE /allocations?id=<id> releases an allocated port
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", s.handleSessions)
+	mux.HandleFunc("/rotate", s.handleRotate)
+	mux.HandleFunc("/credentials", s.handleCredentials)
+	mux.HandleFunc("/limits", s.handleLimits)
+	mux.HandleFunc("/usage", s.handleUsage)
+	mux.HandleFunc("/reload", s.handleReload)
+	mux.HandleFunc("/allocations", s.handleAllocations)
+	return mux
+}
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sessions := make([]StickySession, 0)
+		for _, sticky := range s.stickyFinders() {
+			sessions = append(sessions, sticky.Sessions()...)
+		}
+		writeJson(w, http.StatusOK, sessions)
+
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		unpinned := false
+		for _, sticky := range s.stickyFinders() {
+			unpinned = sticky.Unpin(key) || unpinned
+		}
+		if !unpinned {
+			writeJson(w, http.StatusNotFound, map[string]string{"error": "no session with key " + key})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func (s *Server) handleRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	rotated := 0
+	if key := r.URL.Query().Get("key"); key != "" {
+		for _, sticky := range s.stickyFinders() {
+			if sticky.Rotate(key) {
+				rotated++
+			}
+		}
+	} else {
+		rotated = s.RotateAll()
+	}
+	writeJson(w, http.StatusOK, map[string]int{"rotated": rotated})
+}
+
+func (s *Server) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	status := make([]CredentialStatus, 0)
+	pools := make([]*CredentialPool, 0)
+	for _, settings := range s.currentSettings() {
+		if settings.credentials != nil && !contains(pools, settings.credentials) {
+			pools = append(pools, settings.credentials)
+			status = append(status, settings.credentials.Status()...)
+		}
+	}
+	writeJson(w, http.StatusOK, status)
+}
+
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, s.BandwidthLimits())
+
+	case http.MethodPut:
+		var limits BandwidthLimits
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&limits); err != nil {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := limits.validate(); err != nil {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		s.SetBandwidthLimits(limits)
+		writeJson(w, http.StatusOK, limits)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// RotateAll moves every sticky session of the server's finders to another upstream with its next connection
+// It returns the number of rotated sessions
+func (s *Server) RotateAll() int {
+	rotated := 0
+	for _, sticky := range s.stickyFinders() {
+		rotated += sticky.RotateAll()
+	}
+	return rotated
+}
+
+// stickyFinders returns the sticky finders among the finders and routing pools of all listeners
+func (s *Server) stickyFinders() []*StickyFinder {
+	finders := make([]ServerFinder, 0)
+	for _, settings := range s.currentSettings() {
+		finders = append(finders, settings.finder)
+		if settings.router != nil {
+			for _, finder := range settings.router.pools {
+				finders = append(finders, finder)
+			}
+		}
+	}
+
+	stickyFinders := make([]*StickyFinder, 0)
+	for _, finder := range finders {
+		if sticky, ok := finder.(*StickyFinder); ok && !contains(stickyFinders, sticky) {
+			stickyFinders = append(stickyFinders, sticky)
+		}
+	}
+	return stickyFinders
+}
+
+func writeJson(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	quotas := make([]*Quotas, 0)
+	for _, settings := range s.currentSettings() {
+		if settings.quotas != nil && !contains(quotas, settings.quotas) {
+			quotas = append(quotas, settings.quotas)
+		}
+	}
+	if len(quotas) == 0 {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": "no quotas configured"})
+		return
+	}
+
+	// listeners with their own quotas account separately, the usage of a user is the one of the first quotas knowing it
+	key := r.URL.Query().Get("key")
+	usage := make([]Usage, 0)
+	for _, q := range quotas {
+		for _, userUsage := range q.Usage() {
+			if key == "" || userUsage.Key == key {
+				usage = append(usage, userUsage)
+			}
+		}
+	}
+	if key == "" {
+		writeJson(w, http.StatusOK, usage)
+	} else if len(usage) > 0 {
+		writeJson(w, http.StatusOK, usage[0])
+	} else {
+		writeJson(w, http.StatusOK, quotas[0].UserUsage(key))
+	}
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if s.configLoader == nil {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": "no config loader set"})
+		return
+	}
+
+	if err := s.ReloadConfig(); err != nil {
+		writeJson(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+// currentSettings returns the settings of all listeners, the server's Addr first
+func (s *Server) currentSettings() []*serverSettings {
+	settings := make([]*serverSettings, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		settings = append(settings, l.settings.Load())
+	}
+	return settings
+}
+
+// allocationRequest is the body of POST /allocations
+type allocationRequest struct {
+	AllocationSpec
+	IdleTTL string `json:"idleTTL,omitempty"`
+}
+
+func (s *Server) handleAllocations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if id := r.URL.Query().Get("id"); id != "" {
+			allocation, ok := s.Allocation(id)
+			if !ok {
+				writeJson(w, http.StatusNotFound, map[string]string{"error": "no allocation with id " + id})
+				return
+			}
+			writeJson(w, http.StatusOK, allocation)
+			return
+		}
+		writeJson(w, http.StatusOK, s.Allocations())
+
+	case http.MethodPost:
+		var req allocationRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if req.IdleTTL != "" {
+			ttl, err := time.ParseDuration(req.IdleTTL)
+			if err != nil {
+				writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			req.AllocationSpec.IdleTTL = ttl
+		}
+
+		allocation, err := s.Allocate(req.AllocationSpec)
+		switch {
+		case errors.Is(err, errInvalidAllocation):
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJson(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		default:
+			writeJson(w, http.StatusCreated, allocation)
+		}
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !s.Release(id) {
+			writeJson(w, http.StatusNotFound, map[string]string{"error": "no allocation with id " + id})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
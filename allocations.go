@@ -0,0 +1,356 @@
+package socksauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAllocationTTL  = 10 * time.Minute
+	defaultMaxAllocations = 1000
+)
+
+var (
+	// errInvalidAllocation is wrapped by the errors of specs the server can not allocate a port for
+	errInvalidAllocation = errors.New("invalid allocation")
+	// errAllocationsUnavailable is wrapped by the errors of a server which can not allocate more ports right now
+	errAllocationsUnavailable = errors.New("no allocation possible")
+)
+
+// AllocationConfig configures the local ports of allocations, see Server.Allocate
+type AllocationConfig struct {
+	// Host is the address the ports are bound on, default is 127.0.0.1. The ports have no client auth, so do not bind them publicly
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+	// IdleTTL is the default of AllocationSpec.IdleTTL, default is 10 minutes
+	IdleTTL time.Duration `json:"idleTTL,omitempty" yaml:"idleTTL,omitempty"`
+	// Max is the number of allocations at the same time, default is 1000
+	Max int `json:"max,omitempty" yaml:"max,omitempty"`
+}
+
+// WithAllocations configures the local ports of allocations, it can not be changed with Reload
+func WithAllocations(config AllocationConfig) ServerOption {
+	return func(s *Server) { s.allocationConfig = config }
+}
+
+// AllocationSpec describes where the connections of an allocated port go, everything else are the settings of the server's Addr
+type AllocationSpec struct {
+	// Country, City and Session are the routing hints of the connections, Session is the allocation's id by default.
+	// The connections through the server's finder or the spec's pool are pinned to one upstream until it fails.
+	// Connections a routing rule sends to one of the router's pools are only pinned by the pool, e.g. a StickyFinder keyed by StickyBySessionId
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	Session string `json:"session,omitempty"`
+	// User is the user of the connections for bandwidth limits and quotas, default is the allocation's id
+	User string `json:"user,omitempty"`
+	// Pool is a pool of the server's router, all connections go through it instead of being routed
+	Pool string `json:"pool,omitempty"`
+	// Credentials authenticate with the upstream instead of the server's credentials
+	Credentials *Credentials `json:"credentials,omitempty"`
+	// IdleTTL releases the allocation once it had no open connection for this long, default is the one of the AllocationConfig
+	IdleTTL time.Duration `json:"-"`
+}
+
+// Allocation is a local port without client auth whose connections go to the upstream of its spec
+type Allocation struct {
+	Id string `json:"id"`
+	// Addr is the address of the port, like "socks5://127.0.0.1:41234"
+	Addr string `json:"addr"`
+	// Spec is the spec the port was allocated for, without the password of its credentials
+	Spec            AllocationSpec `json:"spec"`
+	OpenConnections int            `json:"openConnections"`
+	Created         time.Time      `json:"created"`
+	// Expires is when the allocation is released if it stays idle, it is zero while connections are open
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// allocation is an allocated port, the fields besides the listener are guarded by the server's allocationMu
+type allocation struct {
+	listener *listener
+	ln       net.Listener
+	spec     AllocationSpec
+	pin      *allocationPin
+	created  time.Time
+	timer    *time.Timer
+	// stop stops the release of the allocation with the server's context
+	stop func() bool
+}
+
+func (a *allocation) idleSince() time.Time {
+	if lastActive := a.listener.lastActive.Load(); lastActive > 0 {
+		return time.Unix(0, lastActive)
+	}
+	return a.created
+}
+
+func (a *allocation) info(id string) Allocation {
+	spec := a.spec
+	if spec.Credentials != nil {
+		spec.Credentials = &Credentials{Username: spec.Credentials.Username}
+	}
+	info := Allocation{Id: id, Addr: a.listener.bound, Spec: spec, OpenConnections: int(a.listener.open.Load()), Created: a.created}
+	if info.OpenConnections == 0 {
+		info.Expires = a.idleSince().Add(spec.IdleTTL)
+	}
+	return info
+}
+
+// Allocate binds a new local port without client auth, e.g. for a browser which can not authenticate with a proxy.
+// Its connections use the settings of the server's Addr with the routing hints, pool and credentials of the spec.
+// The port is released after it was idle for the spec's IdleTTL, with Release or when the server stops. The server has to be started.
+func (s *Server) Allocate(spec AllocationSpec) (Allocation, error) {
+	config := s.allocationConfig
+	if spec.IdleTTL <= 0 {
+		spec.IdleTTL = config.IdleTTL
+	}
+	if spec.IdleTTL <= 0 {
+		spec.IdleTTL = defaultAllocationTTL
+	}
+	if spec.Credentials != nil && spec.Credentials.Username == "" {
+		return Allocation{}, fmt.Errorf("%w: the credentials need a username", errInvalidAllocation)
+	}
+
+	id, err := allocationId()
+	if err != nil {
+		return Allocation{}, err
+	}
+	s.reloadMu.Lock()
+	runCtx, main := s.runCtx, s.listeners[0]
+	s.reloadMu.Unlock()
+	if runCtx == nil {
+		return Allocation{}, fmt.Errorf("%w: the server is not started", errAllocationsUnavailable)
+	}
+
+	// a reload after reading the settings updates the allocation once the lock is released
+	s.allocationMu.Lock()
+	defer s.allocationMu.Unlock()
+	pin := &allocationPin{}
+	settings, err := allocationSettings(main.settings.Load(), id, spec, pin)
+	if err != nil {
+		return Allocation{}, err
+	}
+	limit := config.Max
+	if limit <= 0 {
+		limit = defaultMaxAllocations
+	}
+	if len(s.allocations) >= limit {
+		return Allocation{}, fmt.Errorf("%w: all %d allocations are in use", errAllocationsUnavailable, limit)
+	}
+
+	host := config.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return Allocation{}, fmt.Errorf("%w: %w", errAllocationsUnavailable, err)
+	}
+
+	// the clients of all allocations are local, so each allocation has its own rate limit and bans
+	l := &listener{addr: ln.Addr().String(), openConnLimit: main.openConnLimit, guard: newConnGuard(), bound: "socks5://" + ln.Addr().String()}
+	l.guard.setLimits(settings.connLimits)
+	l.settings.Store(settings)
+	a := &allocation{listener: l, ln: ln, spec: spec, pin: pin, created: time.Now()}
+	a.timer = time.AfterFunc(spec.IdleTTL, func() { s.expireAllocation(id) })
+	a.stop = context.AfterFunc(runCtx, func() { s.Release(id) })
+	if s.allocations == nil {
+		s.allocations = make(map[string]*allocation)
+	}
+	s.allocations[id] = a
+
+	go s.serve(runCtx, l, ln)
+	return a.info(id), nil
+}
+
+// allocationSettings applies the spec to the settings of the server's Addr, the finder of the settings is pinned by pin
+func allocationSettings(base *serverSettings, id string, spec AllocationSpec, pin *allocationPin) (*serverSettings, error) {
+	settings := *base
+	settings.clientAuth = nil
+	settings.usernameGrammar = nil
+	settings.mapCredentials = nil
+
+	settings.hints = RoutingHints{User: spec.User, Country: spec.Country, City: spec.City, Session: spec.Session}
+	if settings.hints.User == "" {
+		settings.hints.User = id
+	}
+	if settings.hints.Session == "" {
+		settings.hints.Session = id
+	}
+
+	if spec.Pool != "" {
+		var pool ServerFinder
+		ok := false
+		if settings.router != nil {
+			pool, ok = settings.router.Pool(spec.Pool)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown pool %q", errInvalidAllocation, spec.Pool)
+		}
+		settings.finder = pool
+		settings.router = nil
+	}
+	if spec.Credentials != nil {
+		settings.credentials = nil
+		settings.provider = StaticCredentials(*spec.Credentials)
+	}
+	pin.setFinder(settings.finder)
+	settings.finder = pin
+	return &settings, nil
+}
+
+// allocationPin pins the connections of an allocation to the first upstream its finder returns, until the upstream fails
+type allocationPin struct {
+	mu       sync.Mutex
+	finder   ServerFinder
+	upstream *Upstream
+	// generation counts the finders, so a find started with a replaced finder does not pin its upstream
+	generation int
+}
+
+var _ ServerFinder = (*allocationPin)(nil)
+
+// setFinder replaces the finder after a reload, the pin is kept if the finder did not change
+func (p *allocationPin) setFinder(finder ServerFinder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// finders which can not be compared, like a FinderFunc, count as changed
+	if p.finder == nil || !reflect.TypeOf(finder).Comparable() || p.finder != finder {
+		p.finder, p.upstream = finder, nil
+		p.generation++
+	}
+}
+
+func (p *allocationPin) Find(ctx context.Context, req Request) (Upstream, error) {
+	p.mu.Lock()
+	finder, pinned, generation := p.finder, p.upstream, p.generation
+	p.mu.Unlock()
+	if pinned != nil {
+		return *pinned, nil
+	}
+
+	// the lock is not held while finding, the first upstream found wins
+	upstream, err := finder.Find(ctx, req)
+	if err != nil {
+		return Upstream{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.generation == generation {
+		if p.upstream == nil {
+			p.upstream = &upstream
+		}
+		return *p.upstream, nil
+	}
+	return upstream, nil
+}
+
+func (p *allocationPin) ReportSuccess(upstream Upstream) {
+	p.mu.Lock()
+	finder := p.finder
+	p.mu.Unlock()
+	finder.ReportSuccess(upstream)
+}
+
+// ReportFailure unpins the failed upstream, so the next connection finds another one
+func (p *allocationPin) ReportFailure(upstream Upstream, err SocksError) {
+	p.mu.Lock()
+	finder := p.finder
+	if p.upstream != nil && p.upstream.Addr == upstream.Addr {
+		p.upstream = nil
+	}
+	p.mu.Unlock()
+	finder.ReportFailure(upstream, err)
+}
+
+func allocationId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error creating the allocation id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// expireAllocation releases the allocation if it is idle for its TTL, otherwise it checks again when it would be
+func (s *Server) expireAllocation(id string) {
+	s.allocationMu.Lock()
+	a, ok := s.allocations[id]
+	if !ok {
+		s.allocationMu.Unlock()
+		return
+	}
+	// the idle time starts when the last connection is closed, so the TTL is checked again from then
+	if a.listener.open.Load() > 0 {
+		a.timer.Reset(a.spec.IdleTTL)
+		s.allocationMu.Unlock()
+		return
+	}
+	if idle := time.Since(a.idleSince()); idle < a.spec.IdleTTL {
+		a.timer.Reset(a.spec.IdleTTL - idle)
+		s.allocationMu.Unlock()
+		return
+	}
+	s.allocationMu.Unlock()
+	s.Release(id)
+}
+
+// Release closes the port of the allocation, its open connections are not interrupted. It returns false for an unknown id
+func (s *Server) Release(id string) bool {
+	s.allocationMu.Lock()
+	a, ok := s.allocations[id]
+	delete(s.allocations, id)
+	s.allocationMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	a.timer.Stop()
+	a.stop()
+	a.ln.Close()
+	return true
+}
+
+// Allocations returns the allocations of the server sorted by their creation
+func (s *Server) Allocations() []Allocation {
+	s.allocationMu.Lock()
+	defer s.allocationMu.Unlock()
+
+	allocations := make([]Allocation, 0, len(s.allocations))
+	for id, a := range s.allocations {
+		allocations = append(allocations, a.info(id))
+	}
+	sort.Slice(allocations, func(i, j int) bool { return allocations[i].Created.Before(allocations[j].Created) })
+	return allocations
+}
+
+// Allocation returns the allocation with the id
+func (s *Server) Allocation(id string) (Allocation, bool) {
+	s.allocationMu.Lock()
+	defer s.allocationMu.Unlock()
+
+	a, ok := s.allocations[id]
+	if !ok {
+		return Allocation{}, false
+	}
+	return a.info(id), true
+}
+
+// reloadAllocations applies the specs of the allocations to the reloaded settings of the server's Addr
+// An allocation whose pool does not exist anymore keeps its settings
+func (s *Server) reloadAllocations(base *serverSettings) {
+	s.allocationMu.Lock()
+	defer s.allocationMu.Unlock()
+
+	for id, a := range s.allocations {
+		if settings, err := allocationSettings(base, id, a.spec, a.pin); err == nil {
+			a.listener.settings.Store(settings)
+			a.listener.guard.setLimits(settings.connLimits)
+		}
+	}
+}
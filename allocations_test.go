@@ -0,0 +1,221 @@
+package socksauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllocate(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+	account := startMockUpstream(t, "browser-1", "secret")
+
+	finder := &hintsFinder{reportingFinder: reportingFinder{upstreams: []Upstream{{Addr: upstream.Addr}}}}
+	server, _ := startTestServer(t, "", "user", "pass", WithFinder(finder),
+		WithClientAuth(func(username, password string) bool { return false }),
+		WithAllocations(AllocationConfig{Max: 2}),
+	)
+
+	allocation, err := server.Allocate(AllocationSpec{Country: "de"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialSocks(strings.TrimPrefix(allocation.Addr, "socks5://"), echoAddr, "", "")
+	if err != nil {
+		t.Fatalf("expected the allocated port to need no client auth, got %v", err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+	finder.hmu.Lock()
+	hints := finder.hints
+	finder.hmu.Unlock()
+	if want := (RoutingHints{User: allocation.Id, Country: "de", Session: allocation.Id}); len(hints) != 1 || hints[0] != want {
+		t.Errorf("expected the hints of the spec, got %+v", hints)
+	}
+
+	finder.mu.Lock()
+	finder.upstreams = []Upstream{{Addr: account.Addr}}
+	finder.mu.Unlock()
+	other, err := server.Allocate(AllocationSpec{Credentials: &Credentials{Username: "browser-1", Password: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Addr == allocation.Addr || other.Spec.Credentials.Password != "" {
+		t.Errorf("expected another port without the password, got %+v", other)
+	}
+	conn, err = dialSocks(strings.TrimPrefix(other.Addr, "socks5://"), echoAddr, "", "")
+	if err != nil {
+		t.Fatalf("expected the credentials of the spec to be used, got %v", err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	if _, err := server.Allocate(AllocationSpec{}); !errors.Is(err, errAllocationsUnavailable) {
+		t.Errorf("expected the limit to be reached, got %v", err)
+	}
+	if _, err := server.Allocate(AllocationSpec{Pool: "missing"}); !errors.Is(err, errInvalidAllocation) {
+		t.Errorf("expected an unknown pool to be invalid, got %v", err)
+	}
+
+	if !server.Release(allocation.Id) || server.Release(allocation.Id) {
+		t.Error("expected the allocation to be released once")
+	}
+	if _, err := net.DialTimeout("tcp", strings.TrimPrefix(allocation.Addr, "socks5://"), time.Second); err == nil {
+		t.Error("expected the released port to be closed")
+	}
+	if allocations := server.Allocations(); len(allocations) != 1 || allocations[0].Id != other.Id {
+		t.Errorf("expected one allocation left, got %+v", allocations)
+	}
+}
+
+func TestAllocationIdleTTL(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+	server, _ := startTestServer(t, upstream.Addr, "user", "pass")
+
+	allocation, err := server.Allocate(AllocationSpec{IdleTTL: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialSocks(strings.TrimPrefix(allocation.Addr, "socks5://"), echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// an open connection keeps the allocation
+	time.Sleep(300 * time.Millisecond)
+	current, ok := server.Allocation(allocation.Id)
+	if !ok || current.OpenConnections != 1 || !current.Expires.IsZero() {
+		t.Fatalf("expected the allocation with an open connection to stay, got %+v", current)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	for i := 0; i < 100; i++ {
+		if _, ok := server.Allocation(allocation.Id); !ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("expected the idle allocation to be released")
+}
+
+func TestAllocationsAdmin(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+	server, _ := startTestServer(t, upstream.Addr, "user", "pass")
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Post(admin.URL+"/allocations", "application/json", bytes.NewBufferString(`{"country": "us", "idleTTL": "2m"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var allocation Allocation
+	err = json.NewDecoder(resp.Body).Decode(&allocation)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the allocation to be created, got %d %v", resp.StatusCode, err)
+	}
+	if allocation.Spec.Country != "us" || time.Until(allocation.Expires) < time.Minute {
+		t.Errorf("expected the spec of the request, got %+v", allocation)
+	}
+	conn, err := dialSocks(strings.TrimPrefix(allocation.Addr, "socks5://"), echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	resp, err = http.Post(admin.URL+"/allocations", "application/json", bytes.NewBufferString(`{"idleTTL": "soon"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid TTL to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(admin.URL + "/allocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var allocations []Allocation
+	json.NewDecoder(resp.Body).Decode(&allocations)
+	resp.Body.Close()
+	if len(allocations) != 1 || allocations[0].Id != allocation.Id {
+		t.Errorf("expected the allocation to be listed, got %+v", allocations)
+	}
+
+	for _, expected := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodDelete, admin.URL+"/allocations?id="+allocation.Id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("expected %d, got %d", expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestAllocationPin(t *testing.T) {
+	finder := &sequenceFinder{}
+	pin := &allocationPin{}
+	pin.setFinder(finder)
+
+	first := findAddr(t, pin, Request{})
+	if again := findAddr(t, pin, Request{}); again != first {
+		t.Errorf("expected the allocation to stay on %s, got %s", first, again)
+	}
+	pin.setFinder(finder)
+	if again := findAddr(t, pin, Request{}); again != first {
+		t.Errorf("expected an unchanged finder to keep the pin, got %s", again)
+	}
+
+	pin.ReportFailure(Upstream{Addr: first}, nil)
+	second := findAddr(t, pin, Request{})
+	if second == first {
+		t.Errorf("expected a failed upstream to be unpinned")
+	}
+
+	pin.setFinder(&sequenceFinder{})
+	if addr := findAddr(t, pin, Request{}); addr == second {
+		t.Errorf("expected a new finder to drop the pin")
+	}
+}
+
+func TestAllocationListener(t *testing.T) {
+	upstream := startMockUpstream(t, "user", "pass")
+	server, _ := startTestServer(t, upstream.Addr, "user", "pass", WithOpenConnLimit(5), WithConnRateLimit(1, 1))
+
+	allocation, err := server.Allocate(AllocationSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.allocationMu.Lock()
+	l := server.allocations[allocation.Id].listener
+	server.allocationMu.Unlock()
+
+	if l.openConnLimit != 5 {
+		t.Errorf("expected the open connection limit of the server, got %d", l.openConnLimit)
+	}
+	if l.guard == server.listeners[0].guard {
+		t.Error("expected the allocation to have its own guard")
+	}
+	l.guard.mu.Lock()
+	rate := l.guard.rate
+	l.guard.mu.Unlock()
+	if rate != 1 {
+		t.Errorf("expected the allocation's guard to have the limits of the server, got a rate of %v", rate)
+	}
+}
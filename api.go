@@ -2,13 +2,17 @@ package socksauth
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const (
@@ -48,6 +52,20 @@ var (
 	ErrTTLExpired              = newError("ERR_TTL_EXPIRED", "TTL expired")
 	ErrCommandNotSupported     = newError("ERR_COMMAND_NOT_SUPPORTED", "command not supported")
 	ErrAddressTypeNotSupported = newError("ERR_ADDRESS_TYPE_NOT_SUPPORTED", "address type not supported")
+
+	// ErrDestinationBlocked is a request to a private or special purpose network blocked by the destination policy, it is an ErrConnectionNotAllowed as well
+	ErrDestinationBlocked = newSubError(ErrConnectionNotAllowed, "ERR_DESTINATION_BLOCKED", "destination blocked by policy")
+	// ErrAccessDenied is a connection refused by the server's ACL, it is an ErrConnectionNotAllowed as well
+	ErrAccessDenied = newSubError(ErrConnectionNotAllowed, "ERR_ACCESS_DENIED", "connection denied by access control list")
+	// ErrRateLimited is a connection closed because its source opened connections too fast, it is an ErrConnectionNotAllowed as well
+	ErrRateLimited = newSubError(ErrConnectionNotAllowed, "ERR_RATE_LIMITED", "too many new connections from the client")
+	// ErrClientBanned reports a source which is banned after repeated protocol errors, it is an ErrConnectionNotAllowed as well
+	ErrClientBanned = newSubError(ErrConnectionNotAllowed, "ERR_CLIENT_BANNED", "client banned after repeated protocol errors")
+	// ErrQuotaExceeded is a connection rejected because its user is over the traffic quota, it is an ErrConnectionNotAllowed as well
+	ErrQuotaExceeded = newSubError(ErrConnectionNotAllowed, "ERR_QUOTA_EXCEEDED", "traffic quota exceeded")
+
+	// errCredentialsRejected is joined into ErrAuthentication if the upstream rejected the username and password
+	errCredentialsRejected = errors.New("authentication failed")
 )
 
 type Server struct {
@@ -59,12 +77,59 @@ type Server struct {
 	ConnCount     atomic.Int64
 	OpenConnCount atomic.Int32
 	openConnLimit uint32
+	unixSocket    UnixSocketConfig
+	tls           *TlsCertificates
 
 	onConnect    func(id int64, conn net.Conn)
 	onDisconnect func(id int64, conn net.Conn)
 	onError      func(id int64, conn net.Conn, err SocksError)
 
-	serverFinder func(context.Context) (string, error)
+	shaper *Shaper
+
+	// configured are the settings the options write to, connections use the ones of their listener which Reload swaps
+	configured    serverSettings
+	listeners     []*listener
+	defaultFinder ServerFinder
+	configLoader  func() ([]ServerOption, error)
+	loaderMu      sync.Mutex
+
+	reloadMu sync.Mutex
+	runCtx   context.Context
+	// background are the goroutines saving the quota usage, Start waits for them to finish
+	background sync.WaitGroup
+	ready      chan struct{}
+	readyOnce  sync.Once
+
+	allocationConfig AllocationConfig
+	allocationMu     sync.Mutex
+	allocations      map[string]*allocation
+}
+
+// serverSettings are the settings which can be changed with Reload while the server runs
+type serverSettings struct {
+	clientAuth      func(username, password string) bool
+	usernameGrammar *UsernameGrammar
+	hints           RoutingHints
+
+	finder         ServerFinder
+	router         *Router
+	acl            *Acl
+	policy         *DestinationPolicy
+	quotas         *Quotas
+	credentials    *CredentialPool
+	provider       CredentialProvider
+	mapCredentials func(username, password string) (Credentials, bool)
+
+	connLimits       connLimits
+	handshakeTimeout time.Duration
+	bandwidth        BandwidthLimits
+}
+
+func defaultSettings() serverSettings {
+	return serverSettings{
+		policy:           defaultDestinationPolicy,
+		handshakeTimeout: defaultHandshakeTimeout,
+	}
 }
 
 type ServerOption func(*Server)
@@ -75,6 +140,37 @@ func WithOpenConnLimit(limit uint32) ServerOption {
 	return func(s *Server) { s.openConnLimit = limit }
 }
 
+// WithConnRateLimit limits the new connections a single source IP may open per second, connections over the limit are closed right away
+// burst is the number of connections a source may open at once, if it is 0 it is perSecond (at least 1)
+// Default is no limit
+func WithConnRateLimit(perSecond float64, burst int) ServerOption {
+	return func(s *Server) {
+		s.configured.connLimits.rate = max(perSecond, 0)
+		s.configured.connLimits.burst = float64(burst)
+		if burst <= 0 {
+			s.configured.connLimits.burst = max(perSecond, 1)
+		}
+	}
+}
+
+// WithHandshakeTimeout sets the time a client has to complete the SOCKS greeting, authentication and request
+// Default is 10 seconds, 0 disables the timeout
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) { s.configured.handshakeTimeout = timeout }
+}
+
+// WithProtocolErrorBan bans a source IP for banFor after it caused errors protocol errors within window,
+// like malformed or incomplete handshakes or failed client authentications. Connections of a banned source are closed right away.
+// Every ban is reported with an ErrClientBanned to the onError callback
+// Default is no bans
+func WithProtocolErrorBan(errors int, window, banFor time.Duration) ServerOption {
+	return func(s *Server) {
+		s.configured.connLimits.banAfter = max(errors, 0)
+		s.configured.connLimits.banWindow = window
+		s.configured.connLimits.banFor = banFor
+	}
+}
+
 // WithOnConnect sets the onConnect callback which is called when a new connection is accepted
 // To not block the server the callback is called in a new goroutine
 func WithOnConnect(fn func(id int64, conn net.Conn)) ServerOption {
@@ -97,7 +193,80 @@ func WithOnError(fn func(id int64, conn net.Conn, err SocksError)) ServerOption
 // WithServerFinder sets the function to find a SOCKS5 server if no remoteHost is provided
 // Default will find a NordVPN server and try to authenticate with it
 func WithServerFinder(fn func(context.Context) (string, error)) ServerOption {
-	return func(s *Server) { s.serverFinder = fn }
+	return func(s *Server) { s.configured.finder = FinderFunc(fn) }
+}
+
+// WithFinder sets the ServerFinder used to find a SOCKS5 server if no remoteHost is provided
+// Unlike WithServerFinder the finder gets told whether the upstream it returned worked
+func WithFinder(finder ServerFinder) ServerOption {
+	return func(s *Server) { s.configured.finder = finder }
+}
+
+// WithClientAuth requires clients to authenticate with a username and password which are checked by fn
+// Without it clients may connect without authentication, if they send credentials anyway these are accepted and the username is used for routing
+func WithClientAuth(fn func(username, password string) bool) ServerOption {
+	return func(s *Server) { s.configured.clientAuth = fn }
+}
+
+// WithUsernameGrammar parses routing hints (country, city, session, rotation) from the username clients authenticate with
+// The hints are handed to the finder with the request, the client auth function only gets the user without the hints
+func WithUsernameGrammar(grammar UsernameGrammar) ServerOption {
+	return func(s *Server) { s.configured.usernameGrammar = &grammar }
+}
+
+// WithRoutingHints sets the routing hints of every connection, e.g. a country for a listener of clients which can not encode it in their username
+// Hints parsed from the username with WithUsernameGrammar replace them
+func WithRoutingHints(hints RoutingHints) ServerOption {
+	return func(s *Server) { s.configured.hints = hints }
+}
+
+// WithRouter sets the routing table which decides per request whether to use an upstream, connect directly or reject the request
+// Default is to route every request through the finder
+func WithRouter(router *Router) ServerOption {
+	return func(s *Server) { s.configured.router = router }
+}
+
+// WithCredentialPool authenticates with upstreams using the accounts of the pool instead of remoteUser and remotePass
+// If an upstream rejects an account the same upstream is tried with the next account before the client's request fails
+func WithCredentialPool(pool *CredentialPool) ServerOption {
+	return func(s *Server) { s.configured.credentials = pool }
+}
+
+// WithCredentialProvider gets the credentials for upstreams from the provider instead of remoteUser and remotePass
+// They are requested for every upstream connection, so a changed password is used without a restart
+func WithCredentialProvider(provider CredentialProvider) ServerOption {
+	return func(s *Server) { s.configured.provider = provider }
+}
+
+// WithClientCredentials authenticates with upstreams using credentials mapped from the ones the client authenticated with,
+// e.g. PassThroughCredentials or the Map method of a CredentialTable. Clients have to authenticate with a username and password.
+// The upstream is connected before the client's authentication is answered, so a rejection by the upstream is an authentication failure for the client.
+// As the client's request is not read yet, the finder is called without DestHost and DestPort and routing by destination does not apply.
+func WithClientCredentials(fn func(username, password string) (Credentials, bool)) ServerOption {
+	return func(s *Server) { s.configured.mapCredentials = fn }
+}
+
+// WithAcl sets the access control lists, the client's address is checked right after accepting the connection and the destination after reading the request
+// Denied connections fail with ErrAccessDenied naming the rule which denied them
+func WithAcl(acl *Acl) ServerOption {
+	return func(s *Server) { s.configured.acl = acl }
+}
+
+// WithDestinationPolicy sets the policy protecting internal networks from clients, nil disables it
+// Default blocks the BlockedNetworks, e.g. to connect to local services use NewDestinationPolicy("127.0.0.1")
+func WithDestinationPolicy(policy *DestinationPolicy) ServerOption {
+	return func(s *Server) { s.configured.policy = policy }
+}
+
+// WithBandwidthLimits shapes the relayed traffic globally, per user and per connection
+// The limits can be changed while the server is running with SetBandwidthLimits
+func WithBandwidthLimits(limits BandwidthLimits) ServerOption {
+	return func(s *Server) { s.configured.bandwidth = limits }
+}
+
+// WithQuotas enforces traffic quotas and accounts the usage of the users
+func WithQuotas(quotas *Quotas) ServerOption {
+	return func(s *Server) { s.configured.quotas = quotas }
 }
 
 // WithAddr sets the address the server will listen on
@@ -107,7 +276,7 @@ func WithAddr(addr string) ServerOption {
 }
 
 // NewServer creates a new SOCKS5 server
-// if the remoteHost is empty the server will try to find a server using the serverFinder function specified in the WithServerFinder option (default is FindNordVpnServer)
+// if the remoteHost is empty the server will try to find a server using the finder specified in the WithFinder or WithServerFinder option (default is FindNordVpnServer)
 // if the remoteUser and remotePass are empty the server will not authenticate with the remote server, so it is just a simple SOCKS5 proxy, no auth.
 func NewServer(remoteHost, remoteUser, remotePass string, opts ...ServerOption) *Server {
 	s := &Server{
@@ -117,71 +286,201 @@ func NewServer(remoteHost, remoteUser, remotePass string, opts ...ServerOption)
 
 		ConnCount:     atomic.Int64{},
 		OpenConnCount: atomic.Int32{},
+
+		configured: defaultSettings(),
+		ready:      make(chan struct{}),
 	}
 
 	for _, opt := range opts {
 		opt(s)
 	}
 
-	if remoteHost == "" && s.serverFinder == nil {
-		s.serverFinder = FindNordVpnServer
+	s.defaultFinder = defaultNordVpnFinder
+	if remoteHost != "" {
+		s.defaultFinder = FinderFunc(func(ctx context.Context) (string, error) { return remoteHost, nil })
 	}
-	if s.serverFinder == nil {
-		s.serverFinder = func(ctx context.Context) (string, error) { return remoteHost, nil }
-	} else {
-		// we call the serverFinder here to give the injection the chance to cache (the default FindNordVpnServer does)
-		s.serverFinder(context.Background())
+	s.listeners = append([]*listener{{addr: s.Addr}}, s.listeners...)
+	for _, l := range s.listeners {
+		scratch := s.profile(l.opts)
+		settings := scratch.configured
+		s.prepareSettings(&settings)
+		l.openConnLimit = scratch.openConnLimit
+		l.unixSocket = scratch.unixSocket
+		l.tls = scratch.tls
+		l.guard = newConnGuard()
+		l.guard.setLimits(settings.connLimits)
+		l.settings.Store(&settings)
 	}
+	s.shaper = NewShaper(s.configured.bandwidth)
 
 	return s
 }
 
-func (s *Server) Start(ctx context.Context) error {
-	l, err := net.Listen("tcp", s.Addr)
-	if err != nil {
-		return err
+// prepareSettings sets the default finder and warms up the finder.
+// The default finder is not warmed up for a router, which may not send any connection to it
+func (s *Server) prepareSettings(settings *serverSettings) {
+	if settings.finder == nil {
+		settings.finder = s.defaultFinder
+		if settings.router != nil {
+			return
+		}
+	}
+	if warmer, ok := settings.finder.(Warmer); ok {
+		// we warm up the finder here to give the injection the chance to cache (the default NordVpnFinder does)
+		warmer.Warmup(context.Background())
 	}
-	s.Addr = "socks5://" + l.Addr().String()
+}
+
+// Reload replaces the settings of the running server with the ones of opts, settings which are not given are reset to their defaults.
+// Open connections keep their upstream and settings, new connections use the new ones.
+// Listeners are matched by their address and get the options of their WithListener in opts, listeners can not be added or removed.
+// The listen addresses, the callbacks and the open connection limits can not be changed, their options are ignored.
+func (s *Server) Reload(opts ...ServerOption) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
 
-	var semaphore chan struct{}
-	if s.openConnLimit > 0 {
-		semaphore = make(chan struct{}, s.openConnLimit)
+	next := &Server{configured: defaultSettings()}
+	for _, opt := range opts {
+		opt(next)
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return l.Close()
-		default:
+	started := make([]*Quotas, 0)
+	for idx, l := range s.listeners {
+		var listenerOpts []ServerOption
+		for _, candidate := range next.listeners {
+			if idx > 0 && candidate.addr == l.addr {
+				listenerOpts = candidate.opts
+			}
+		}
+		settings := next.profile(listenerOpts).configured
+		s.prepareSettings(&settings)
+		previous := l.settings.Load()
+
+		// the usage of the open connections is counted by the previous quotas, so they are kept with the new config
+		if previous.quotas != nil && settings.quotas != nil && previous.quotas != settings.quotas {
+			previous.quotas.setConfig(settings.quotas.config)
+			settings.quotas = previous.quotas
+		} else if settings.quotas != nil && settings.quotas != previous.quotas && s.runCtx != nil && !contains(started, settings.quotas) {
+			started = append(started, settings.quotas)
+			s.runQuotas(s.runCtx, settings.quotas)
 		}
 
-		conn, err := l.Accept()
+		l.settings.Store(&settings)
+		l.guard.setLimits(settings.connLimits)
+	}
+	s.shaper.SetLimits(next.configured.bandwidth)
+	s.reloadAllocations(s.listeners[0].settings.Load())
+}
+
+// WithConfigLoader sets the function ReloadConfig gets the new settings from, e.g. to read a configuration file again
+func WithConfigLoader(fn func() ([]ServerOption, error)) ServerOption {
+	return func(s *Server) { s.configLoader = fn }
+}
+
+// ReloadConfig reloads the server with the options of the config loader, the settings are kept if it fails
+// The loader is not called concurrently, so it can keep the previous configuration
+func (s *Server) ReloadConfig() error {
+	if s.configLoader == nil {
+		return errors.New("no config loader set")
+	}
+	s.loaderMu.Lock()
+	defer s.loaderMu.Unlock()
+	opts, err := s.configLoader()
+	if err != nil {
+		return err
+	}
+	s.Reload(opts...)
+	return nil
+}
+
+// BandwidthLimits returns the current bandwidth limits
+func (s *Server) BandwidthLimits() BandwidthLimits {
+	return s.shaper.Limits()
+}
+
+// SetBandwidthLimits changes the bandwidth limits, open connections are shaped with the new limits right away
+func (s *Server) SetBandwidthLimits(limits BandwidthLimits) {
+	s.shaper.SetLimits(limits)
+}
+
+// Ready is closed once the server listens, Addr and ListenerAddrs are the bound addresses then.
+// It is never closed if Start fails to listen, so wait for the error of Start as well
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Start listens on the server's Addr and the addresses of its listeners and serves them until the context is done
+// It returns after the listeners are closed and the quota usage is saved
+func (s *Server) Start(ctx context.Context) error {
+	bound := make([]net.Listener, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		ln, err := listen(l.addr, l.unixSocket)
 		if err != nil {
-			if s.onError != nil {
-				err = fmt.Errorf("error accepting connection: %w", err)
-				go s.onError(0, conn, ErrEstablishClientConn.withError(err))
+			for _, ln := range bound {
+				ln.Close()
 			}
-			continue
+			return err
+		}
+		if l.tls != nil {
+			ln = tls.NewListener(ln, l.tls.Config())
 		}
+		bound = append(bound, ln)
+	}
 
-		// aquire semaphore
-		if semaphore != nil {
-			semaphore <- struct{}{}
+	s.reloadMu.Lock()
+	s.runCtx = ctx
+	started := make([]*Quotas, 0)
+	for idx, l := range s.listeners {
+		l.bound = boundAddr(bound[idx], l.tls != nil)
+		if quotas := l.settings.Load().quotas; quotas != nil && !contains(started, quotas) {
+			started = append(started, quotas)
+			s.runQuotas(ctx, quotas)
 		}
-		go func() {
-			s.handleConnection(ctx, conn)
-			// release semaphore
-			if semaphore != nil {
-				semaphore <- struct{}{}
-			}
-		}()
 	}
+	s.reloadMu.Unlock()
+	s.Addr = s.listeners[0].bound
+	s.readyOnce.Do(func() { close(s.ready) })
+
+	var wg sync.WaitGroup
+	for idx, l := range s.listeners {
+		wg.Add(1)
+		go func(l *listener, ln net.Listener) {
+			defer wg.Done()
+			s.serve(ctx, l, ln)
+		}(l, bound[idx])
+	}
+
+	<-ctx.Done()
+	errs := make([]error, 0, len(bound))
+	for _, ln := range bound {
+		errs = append(errs, ln.Close())
+	}
+	wg.Wait()
+
+	// a reload must not start quotas anymore, so their final save is waited for
+	s.reloadMu.Lock()
+	s.runCtx = nil
+	s.reloadMu.Unlock()
+	s.background.Wait()
+	return errors.Join(errs...)
+}
+
+// runQuotas saves the usage of the quotas until ctx is done, the caller has to hold reloadMu
+func (s *Server) runQuotas(ctx context.Context, quotas *Quotas) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		quotas.run(ctx)
+	}()
 }
 
-func (s *Server) handleConnection(ctx context.Context, clientConn net.Conn) {
-	conn := &socksConnection{connId: s.ConnCount.Add(1), clientConn: clientConn}
+func (s *Server) handleConnection(ctx context.Context, l *listener, clientConn net.Conn) {
+	// the connection keeps the settings it started with, even if the server is reloaded
+	settings := l.settings.Load()
+	conn := &socksConnection{connId: s.ConnCount.Add(1), clientConn: clientConn, settings: settings, hints: settings.hints}
 
 	s.OpenConnCount.Add(1)
+	l.open.Add(1)
 	if s.onConnect != nil {
 		go s.onConnect(conn.connId, conn.clientConn)
 	}
@@ -192,49 +491,156 @@ func (s *Server) handleConnection(ctx context.Context, clientConn net.Conn) {
 			go s.onDisconnect(conn.connId, conn.clientConn)
 		}
 		conn.clientConn.Close()
+		if conn.credentials != nil {
+			settings.credentials.release(*conn.credentials)
+		}
 		cancel()
 		s.OpenConnCount.Add(-1)
+		l.lastActive.Store(time.Now().UnixNano())
+		l.open.Add(-1)
 	}()
 
-	// Greet the client
-	if err := conn.greetClient(); err != nil {
-		if s.onError != nil {
-			go s.onError(conn.connId, clientConn, err)
+	// Check the client's address before talking to it
+	if settings.acl != nil {
+		if allowed, rule := settings.acl.CheckSource(clientConn.RemoteAddr()); !allowed {
+			err := ErrAccessDenied.fromConnection(*conn).withMessage(fmt.Sprintf("client %s denied by %s", clientConn.RemoteAddr(), deniedBy(rule)))
+			if s.onError != nil {
+				go s.onError(conn.connId, clientConn, err)
+			}
+			return
 		}
-		return
 	}
 
-	// Connect to the remote SOCKS5 server
-	err := conn.getProxyConn(ctx, s.serverFinder)
-	if err != nil {
+	// Greet the client, with client credentials the upstream has to accept them before the client is authenticated
+	var upstreamAuth func(user, password string) SocksError
+	if settings.mapCredentials != nil {
+		upstreamAuth = func(user, password string) SocksError { return s.preconnectUpstream(ctx, conn, user, password) }
+	}
+	if settings.handshakeTimeout > 0 {
+		clientConn.SetDeadline(time.Now().Add(settings.handshakeTimeout))
+	}
+	// the TLS handshake is done before the greeting, so the identity of the client is known for the upstream auth
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			err := ErrEstablishClientConn.fromConnection(*conn).withError(fmt.Errorf("error in the TLS handshake: %w", err))
+			if s.onError != nil {
+				go s.onError(conn.connId, clientConn, err)
+			}
+			s.reportProtocolError(l.guard, conn, err)
+			return
+		}
+		conn.identity = tlsIdentity(tlsConn)
+	}
+	if err := conn.greetClient(settings.clientAuth, settings.usernameGrammar, upstreamAuth); err != nil {
 		if s.onError != nil {
 			go s.onError(conn.connId, clientConn, err)
 		}
+		s.reportProtocolError(l.guard, conn, err)
 		return
 	}
-	defer conn.proxyConn.Close()
 
-	// Authenticate with the remote SOCKS5 server
-	// TODO: implement unauthenticated connection
-	err = conn.authenticateRemoteSocks(s.RemoteUser, s.RemotePass)
-	if err != nil {
+	// Read the client's request, so the finder knows where the client wants to go
+	if err := conn.readClientRequest(); err != nil {
+		if conn.preconnected {
+			conn.proxyConn.Close()
+		}
 		if s.onError != nil {
 			go s.onError(conn.connId, clientConn, err)
 		}
+		s.reportProtocolError(l.guard, conn, err)
 		return
 	}
+	clientConn.SetDeadline(time.Time{})
+
+	// Check the destination
+	if settings.acl != nil {
+		if allowed, rule := settings.acl.CheckDestination(conn.req); !allowed {
+			if conn.preconnected {
+				conn.proxyConn.Close()
+			}
+			writeReply(clientConn, _CONN_NOT_ALLOWED_BY_RULESET)
+			err := ErrAccessDenied.fromConnection(*conn).withMessage(fmt.Sprintf("destination denied by %s", deniedBy(rule)))
+			if s.onError != nil {
+				go s.onError(conn.connId, clientConn, err)
+			}
+			return
+		}
+	}
+
+	// Check the user's traffic quota
+	up, down, release := s.shaper.connection(conn.userKey())
+	defer release()
+	var count func(n int)
+	if settings.quotas != nil {
+		allowed, throttleUp, throttleDown, countQuota, releaseQuota := settings.quotas.connection(conn.userKey())
+		if !allowed {
+			if conn.preconnected {
+				conn.proxyConn.Close()
+			}
+			writeReply(clientConn, _CONN_NOT_ALLOWED_BY_RULESET)
+			err := ErrQuotaExceeded.fromConnection(*conn).withMessage(fmt.Sprintf("traffic quota of %q exceeded", conn.userKey()))
+			if s.onError != nil {
+				go s.onError(conn.connId, clientConn, err)
+			}
+			return
+		}
+		defer releaseQuota()
+		up, down, count = append(up, throttleUp), append(down, throttleDown), countQuota
+	}
 
-	// Forward the client's request to the remote SOCKS5 server
-	err = conn.sendRemoteRequest()
+	// Decide where the request goes
+	route := Route{Action: RouteUpstream}
+	if settings.router != nil {
+		route = settings.router.Route(conn.req)
+	}
+
+	// an upstream connected during the authentication is only used if the request goes through the server's finder
+	if conn.preconnected && (route.Action != RouteUpstream || route.Pool != "") {
+		conn.proxyConn.Close()
+		conn.preconnected = false
+	}
+
+	// Check the destination against the destination policy
+	if route.Action != RouteReject && settings.policy != nil {
+		if err := s.checkDestination(ctx, conn, route.Action); err != nil {
+			if conn.preconnected {
+				conn.proxyConn.Close()
+			}
+			if s.onError != nil {
+				go s.onError(conn.connId, clientConn, err)
+			}
+			return
+		}
+	}
+
+	var err SocksError
+	switch route.Action {
+	case RouteReject:
+		writeReply(clientConn, _CONN_NOT_ALLOWED_BY_RULESET)
+		err = ErrConnectionNotAllowed.fromConnection(*conn).withMessage(fmt.Sprintf("connection rejected by routing rule %q", route.Rule))
+	case RouteDirect:
+		err = conn.connectDirect(ctx)
+	default:
+		if conn.preconnected {
+			err = s.forwardUpstream(conn, settings.finder)
+			break
+		}
+		finder := settings.finder
+		if route.Pool != "" {
+			finder, _ = settings.router.Pool(route.Pool)
+		}
+		err = s.connectUpstream(ctx, conn, finder)
+	}
 	if err != nil {
 		if s.onError != nil {
 			go s.onError(conn.connId, clientConn, err)
 		}
 		return
 	}
+	defer conn.proxyConn.Close()
 
 	// Relay data between the client and the remote SOCKS5 server
-	err = conn.syncConns()
+	err = conn.syncConns(up, down, count)
 	if err != nil {
 		if s.onError != nil {
 			go s.onError(conn.connId, clientConn, err)
@@ -243,15 +649,198 @@ func (s *Server) handleConnection(ctx context.Context, clientConn net.Conn) {
 	}
 }
 
+// reportProtocolError counts errors the client is responsible for and reports the ban if the client got banned by it
+func (s *Server) reportProtocolError(guard *connGuard, conn *socksConnection, err SocksError) {
+	if !errors.Is(err, ErrEstablishClientConn) {
+		return
+	}
+	if banned, reason := guard.protocolError(conn.clientConn.RemoteAddr()); banned && s.onError != nil {
+		go s.onError(conn.connId, conn.clientConn, ErrClientBanned.fromConnection(*conn).withMessage(reason))
+	}
+}
+
+// checkDestination applies the destination policy and replies to the client if the destination is blocked
+// A direct connection dials the checked addresses, so resolving the destination again can not return another address
+func (s *Server) checkDestination(ctx context.Context, conn *socksConnection, action RouteAction) SocksError {
+	policy := conn.settings.policy
+	if _, ok := parseIPLiteral(conn.req.DestHost); !ok && action != RouteDirect && policy.UpstreamResolves {
+		return nil
+	}
+
+	addrs, err := policy.Check(ctx, conn.req.DestHost)
+	if errors.Is(err, errDestinationBlocked) {
+		writeReply(conn.clientConn, _CONN_NOT_ALLOWED_BY_RULESET)
+		return ErrDestinationBlocked.fromConnection(*conn).withError(err)
+	}
+	if err != nil {
+		// an upstream may resolve names we can not
+		if action != RouteDirect {
+			return nil
+		}
+		reply, socksErr := dialErrorReply(err)
+		writeReply(conn.clientConn, reply)
+		return socksErr.fromConnection(*conn).withError(err)
+	}
+
+	if action == RouteDirect {
+		conn.directAddrs = addrs
+	}
+	return nil
+}
+
+// connectUpstream connects to an upstream found by the finder and forwards the client's request to it
+// On success the proxyConn of the connection is set, the finder gets a report either way
+func (s *Server) connectUpstream(ctx context.Context, conn *socksConnection, finder ServerFinder) SocksError {
+	if err := s.dialUpstream(ctx, conn, finder); err != nil {
+		writeReply(conn.clientConn, _GENERAL_SOCKS_FAILURE)
+		return err
+	}
+	return s.forwardUpstream(conn, finder)
+}
+
+// preconnectUpstream connects to an upstream with the upstream credentials of the client before the client's authentication is answered,
+// so a rejection by the upstream becomes an authentication failure for the client. The finder does not know the destination yet.
+func (s *Server) preconnectUpstream(ctx context.Context, conn *socksConnection, user, password string) SocksError {
+	credentials, ok := conn.settings.mapCredentials(user, password)
+	if !ok {
+		err := fmt.Errorf("no upstream credentials for user %q", user)
+		return ErrAuthentication.fromConnection(*conn).withError(err)
+	}
+	conn.clientCredentials = &credentials
+	conn.req = Request{ClientAddr: conn.clientConn.RemoteAddr(), Username: conn.username, Identity: conn.identity, Hints: conn.hints}
+
+	if err := s.dialUpstream(ctx, conn, conn.settings.finder); err != nil {
+		return err
+	}
+	conn.preconnected = true
+	return nil
+}
+
+// dialUpstream connects and authenticates with an upstream found by the finder, failures are reported to the finder
+func (s *Server) dialUpstream(ctx context.Context, conn *socksConnection, finder ServerFinder) SocksError {
+	// Connect to the remote SOCKS5 server
+	err := conn.getProxyConn(ctx, finder)
+	if err != nil {
+		if conn.proxyName != "" {
+			finder.ReportFailure(conn.upstream, err)
+		}
+		return err
+	}
+
+	// Authenticate with the remote SOCKS5 server, a client's own credentials being rejected says nothing about the upstream
+	// TODO: implement unauthenticated connection
+	err = s.authenticateUpstream(ctx, conn)
+	if err != nil {
+		conn.proxyConn.Close()
+		if conn.clientCredentials == nil || !errors.Is(err, errCredentialsRejected) {
+			finder.ReportFailure(conn.upstream, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// forwardUpstream forwards the client's request to the authenticated upstream and reports the result to the finder
+func (s *Server) forwardUpstream(conn *socksConnection, finder ServerFinder) SocksError {
+	err := conn.forwardRequest()
+	if err != nil {
+		conn.proxyConn.Close()
+		if conn.upstreamFailed {
+			finder.ReportFailure(conn.upstream, err)
+		} else {
+			finder.ReportSuccess(conn.upstream)
+		}
+		return err
+	}
+
+	finder.ReportSuccess(conn.upstream)
+	return nil
+}
+
+// authenticateUpstream authenticates with the upstream using the client's upstream credentials, the upstream's own credentials,
+// an account of the credential pool, the credential provider or the server wide credentials.
+// If the upstream rejects an account of the pool, it is reconnected and tried with the next account.
+func (s *Server) authenticateUpstream(ctx context.Context, conn *socksConnection) SocksError {
+	if conn.clientCredentials != nil {
+		return conn.authenticateRemoteSocks(conn.clientCredentials.Username, conn.clientCredentials.Password)
+	}
+	if conn.upstream.Username != "" {
+		return conn.authenticateRemoteSocks(conn.upstream.Username, conn.upstream.Password)
+	}
+	pool, provider := conn.settings.credentials, conn.settings.provider
+	if pool == nil {
+		username, password := s.RemoteUser, s.RemotePass
+		if provider != nil {
+			credentials, err := provider.Credentials(ctx)
+			if err != nil {
+				err = fmt.Errorf("error getting the upstream credentials: %w", err)
+				return ErrAuthentication.fromConnection(*conn).withError(err)
+			}
+			username, password = credentials.Username, credentials.Password
+		}
+		return conn.authenticateRemoteSocks(username, password)
+	}
+
+	tried := make([]string, 0)
+	credentials, _ := pool.acquire(tried)
+	for {
+		err := conn.authenticateRemoteSocks(credentials.Username, credentials.Password)
+		if err == nil {
+			pool.reportSuccess(credentials)
+			conn.credentials = &credentials
+			return nil
+		}
+		pool.release(credentials)
+		if !errors.Is(err, errCredentialsRejected) {
+			return err
+		}
+		pool.reportRejected(credentials)
+
+		tried = append(tried, credentials.Username)
+		next, ok := pool.acquire(tried)
+		if !ok {
+			return err
+		}
+		// the upstream closes the connection after rejecting credentials
+		conn.proxyConn.Close()
+		if err := conn.dialProxy(ctx); err != nil {
+			pool.release(next)
+			return err
+		}
+		credentials = next
+	}
+}
+
 type socksConnection struct {
 	connId int64
+	// settings are the server's settings when the connection was accepted
+	settings *serverSettings
 
 	clientConn, proxyConn net.Conn
 	destination           string
 	proxyName, proxyHost  string
+
+	username string
+	// identity is the subject of the client's TLS certificate
+	identity string
+	hints    RoutingHints
+	request  []byte
+	req      Request
+
+	upstream Upstream
+	// upstreamFailed is set if the upstream broke the protocol, as opposed to replying with an error for the destination
+	upstreamFailed bool
+	// credentials is the account of the server's credential pool used for the upstream
+	credentials *Credentials
+	// clientCredentials are the upstream credentials mapped from the client's credentials
+	clientCredentials *Credentials
+	// preconnected is set if the upstream was connected while authenticating the client
+	preconnected bool
+	// directAddrs are the addresses of the destination checked by the destination policy
+	directAddrs []netip.Addr
 }
 
-func (c *socksConnection) greetClient() SocksError {
+func (c *socksConnection) greetClient(clientAuth func(username, password string) bool, grammar *UsernameGrammar, upstreamAuth func(user, password string) SocksError) SocksError {
 	// https://datatracker.ietf.org/doc/html/rfc1928#section-3
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(c.clientConn, header); err != nil {
@@ -272,7 +861,13 @@ func (c *socksConnection) greetClient() SocksError {
 		return ErrEstablishClientConn.fromConnection(*c).withError(err)
 	}
 
-	if !contains(methods, _NO_AUTHENTICATION) {
+	// a client offering username/password authentication has credentials it wants us to know, so we prefer it
+	if contains(methods, _USERNAME_PASSWORD_AUTH) {
+		c.clientConn.Write([]byte{_SOCKS_VERSION, _USERNAME_PASSWORD_AUTH})
+		return c.authenticateClient(clientAuth, grammar, upstreamAuth)
+	}
+
+	if clientAuth != nil || upstreamAuth != nil || !contains(methods, _NO_AUTHENTICATION) {
 		c.clientConn.Write([]byte{_SOCKS_VERSION, _NO_ACCEPTABLE_METHODS})
 		err := fmt.Errorf("no supported authentication methods")
 		return ErrEstablishClientConn.fromConnection(*c).withError(err)
@@ -282,27 +877,99 @@ func (c *socksConnection) greetClient() SocksError {
 	return nil
 }
 
-func (c *socksConnection) getProxyConn(ctx context.Context, hostFinder func(context.Context) (string, error)) SocksError {
+// authenticateClient reads the client's username and password and checks them with clientAuth, if clientAuth is nil every client is accepted
+// If a grammar is given the routing hints are parsed from the username and only the plain user is checked
+// If upstreamAuth is given it has to accept the plain user as well
+func (c *socksConnection) authenticateClient(clientAuth func(username, password string) bool, grammar *UsernameGrammar, upstreamAuth func(user, password string) SocksError) SocksError {
+	// https://datatracker.ietf.org/doc/html/rfc1929#section-2
+	username, password, err := readUsernamePassword(c.clientConn)
+	if err != nil {
+		err = fmt.Errorf("error reading username/password: %w", err)
+		return ErrEstablishClientConn.fromConnection(*c).withError(err)
+	}
+
+	user := username
+	if grammar != nil {
+		c.hints, err = grammar.Parse(username)
+		if err != nil {
+			c.clientConn.Write([]byte{0x01, 0x01})
+			return ErrEstablishClientConn.fromConnection(*c).withError(err)
+		}
+		user = c.hints.User
+	}
+
+	if clientAuth != nil && !clientAuth(user, password) {
+		c.clientConn.Write([]byte{0x01, 0x01})
+		err := fmt.Errorf("client authentication failed for user %q", username)
+		return ErrEstablishClientConn.fromConnection(*c).withError(err)
+	}
+
+	c.username = username
+	if upstreamAuth != nil {
+		if err := upstreamAuth(user, password); err != nil {
+			c.clientConn.Write([]byte{0x01, 0x01})
+			return err
+		}
+	}
+	c.clientConn.Write([]byte{0x01, _STATUS_OK})
+	return nil
+}
+
+func (c *socksConnection) getProxyConn(ctx context.Context, finder ServerFinder) SocksError {
 	var err error
-	c.proxyName, err = hostFinder(ctx)
+	c.upstream, err = finder.Find(ctx, c.req)
 	if err != nil {
 		err = fmt.Errorf("error finding proxy server: %w", err)
 		return ErrEstablishProxyConn.fromConnection(*c).withError(err)
 	}
-	c.proxyName = strings.TrimPrefix(c.proxyName, "socks5://")
+	c.proxyName = strings.TrimPrefix(c.upstream.Addr, "socks5://")
 	if !strings.Contains(c.proxyName, ":") {
 		c.proxyName += ":1080"
 	}
 
-	c.proxyConn, err = net.Dial("tcp", c.proxyName)
+	return c.dialProxy(ctx)
+}
+
+// dialProxy connects to the upstream, the previous proxyConn is kept if that fails
+func (c *socksConnection) dialProxy(ctx context.Context) SocksError {
+	var dialer net.Dialer
+	proxyConn, err := dialer.DialContext(ctx, "tcp", c.proxyName)
 	if err != nil {
 		return ErrEstablishProxyConn.fromConnection(*c).withError(err)
 	}
+	c.proxyConn = proxyConn
 	c.proxyHost = c.proxyConn.RemoteAddr().String()
 
 	return nil
 }
 
+// connectDirect connects to the destination without an upstream and replies to the client
+func (c *socksConnection) connectDirect(ctx context.Context) SocksError {
+	var dialer net.Dialer
+	var err error
+	if len(c.directAddrs) == 0 {
+		c.proxyConn, err = dialer.DialContext(ctx, "tcp", c.destination)
+	}
+	for _, addr := range c.directAddrs {
+		c.proxyConn, err = dialer.DialContext(ctx, "tcp", netip.AddrPortFrom(addr, uint16(c.req.DestPort)).String())
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		reply, socksErr := dialErrorReply(err)
+		writeReply(c.clientConn, reply)
+		return socksErr.fromConnection(*c).withError(err)
+	}
+
+	if err := writeReplyAddr(c.clientConn, _STATUS_OK, c.proxyConn.LocalAddr()); err != nil {
+		c.proxyConn.Close()
+		err = fmt.Errorf("error sending response to client: %w", err)
+		return ErrEstablishClientConn.fromConnection(*c).withError(err)
+	}
+	return nil
+}
+
 func (c *socksConnection) authenticateRemoteSocks(username, password string) SocksError {
 	// Send the authentication methods supported by the client https://datatracker.ietf.org/doc/html/rfc1928#section-3
 	_, err := c.proxyConn.Write([]byte{
@@ -353,19 +1020,20 @@ func (c *socksConnection) authenticateRemoteSocks(username, password string) Soc
 
 	// Check the server's response
 	if response[1] != _STATUS_OK {
-		err = fmt.Errorf("authentication failed")
-		return ErrAuthentication.fromConnection(*c).withError(err)
+		return ErrAuthentication.fromConnection(*c).withError(errCredentialsRejected)
 	}
 
 	return nil
 }
 
-func (c *socksConnection) syncConns() SocksError {
+// syncConns relays data in both directions until one side closes, each direction is shaped by its buckets
+// count is called with the relayed bytes if it is not nil
+func (c *socksConnection) syncConns(up, down []*tokenBucket, count func(n int)) SocksError {
 	done := make(chan error, 1)
 
 	// Relay data from client to remote
 	go func() {
-		_, err := io.Copy(c.proxyConn, c.clientConn)
+		_, err := io.Copy(c.proxyConn, &shapedReader{reader: c.clientConn, buckets: up, count: count})
 		if errors.Is(err, syscall.ECONNRESET) {
 			fmt.Printf("[connection %d] proxy -> client: disconnected\n", c.connId)
 			done <- nil // this happens when the client disconnects abruptly, rude but not an error
@@ -380,7 +1048,7 @@ func (c *socksConnection) syncConns() SocksError {
 
 	// Relay data from remote to client
 	go func() {
-		_, err := io.Copy(c.clientConn, c.proxyConn)
+		_, err := io.Copy(c.clientConn, &shapedReader{reader: c.proxyConn, buckets: down, count: count})
 		if errors.Is(err, syscall.ECONNRESET) {
 			fmt.Printf("[connection %d] client -> proxy: disconnected\n", c.connId)
 			done <- nil // this happens when the client disconnects abruptly, rude but not an error
@@ -401,22 +1069,58 @@ func (c *socksConnection) syncConns() SocksError {
 	return nil
 }
 
-func (c *socksConnection) sendRemoteRequest() SocksError {
-	request, destination, err := readSocks5Request(c.clientConn)
+// userKey identifies the user of the connection for per user limits,
+// clients without a username by their TLS identity, the uid of a unix socket client or their IP
+func (c *socksConnection) userKey() string {
+	if c.hints.User != "" {
+		return c.hints.User
+	}
+	if c.username != "" {
+		return c.username
+	}
+	if c.identity != "" {
+		return c.identity
+	}
+	if cred, err := PeerCredentials(c.clientConn); err == nil {
+		return fmt.Sprintf("uid:%d", cred.Uid)
+	}
+	ip, _ := addrIP(c.clientConn.RemoteAddr())
+	return ip.String()
+}
+
+func (c *socksConnection) readClientRequest() SocksError {
+	request, host, port, err := readSocks5Request(c.clientConn)
 	if err != nil {
 		err = fmt.Errorf("error reading request from client: %w", err)
 		return ErrEstablishClientConn.fromConnection(*c).withError(err)
 	}
-	c.destination = destination
 
-	_, err = c.proxyConn.Write(request)
+	c.request = request
+	c.req = Request{
+		ClientAddr: c.clientConn.RemoteAddr(),
+		Username:   c.username,
+		Identity:   c.identity,
+		Hints:      c.hints,
+		DestHost:   host,
+		DestPort:   port,
+	}
+	c.destination = c.req.Destination()
+	return nil
+}
+
+func (c *socksConnection) forwardRequest() SocksError {
+	_, err := c.proxyConn.Write(c.request)
 	if err != nil {
+		c.upstreamFailed = true
 		err = fmt.Errorf("error forwarding request to proxy server: %w", err)
 		return ErrEstablishProxyConn.fromConnection(*c).withError(err)
 	}
 
 	response, err := readSocks5Response(c.proxyConn)
 	if err != nil {
+		// a SOCKS reply code means the upstream works, it just could not reach the destination
+		var replyErr socksError
+		c.upstreamFailed = !errors.As(err, &replyErr)
 		err = fmt.Errorf("error reading response from proxy server: %w", err)
 		return ErrEstablishProxyConn.fromConnection(*c).withError(err)
 	}
@@ -430,24 +1134,24 @@ func (c *socksConnection) sendRemoteRequest() SocksError {
 	return nil
 }
 
-func readSocks5Request(conn net.Conn) (request []byte, destination string, err error) {
+func readSocks5Request(conn net.Conn) (request []byte, host string, port int, err error) {
 	// Read the SOCKS request from the client https://datatracker.ietf.org/doc/html/rfc1928#section-4
 	// Read the first 4 Bytes of the request, the fourth byte determines the length of the rest of the request
 	requestHeader := make([]byte, 4)
 	if _, err := io.ReadFull(conn, requestHeader); err != nil {
-		return nil, "", fmt.Errorf("error reading request header: %w", err)
+		return nil, "", 0, fmt.Errorf("error reading request header: %w", err)
 	}
 
 	version := requestHeader[0]
 	if version != _SOCKS_VERSION {
 		conn.Write([]byte{_SOCKS_VERSION, _GENERAL_SOCKS_FAILURE})
-		return nil, "", fmt.Errorf("unsupported SOCKS version: %d", version)
+		return nil, "", 0, fmt.Errorf("unsupported SOCKS version: %d", version)
 	}
 
 	cmd := requestHeader[1]
 	if cmd != _CONNECT {
 		conn.Write([]byte{_SOCKS_VERSION, _COMMAND_NOT_SUPPORTED})
-		return nil, "", ErrCommandNotSupported.withMessage(fmt.Sprintf("unsupported command: %d", cmd))
+		return nil, "", 0, ErrCommandNotSupported.withMessage(fmt.Sprintf("unsupported command: %d", cmd))
 	}
 
 	// Determine the length of the remaining part of the request based on the address type
@@ -458,7 +1162,7 @@ func readSocks5Request(conn net.Conn) (request []byte, destination string, err e
 	case _DOMAIN_NAME:
 		lengthByte := make([]byte, 1)
 		if _, err := io.ReadFull(conn, lengthByte); err != nil {
-			return nil, "", fmt.Errorf("error reading domain name length: %w", err)
+			return nil, "", 0, fmt.Errorf("error reading domain name length: %w", err)
 		}
 		requestHeader = append(requestHeader, lengthByte...)
 		addrLen = int(lengthByte[0])
@@ -466,20 +1170,20 @@ func readSocks5Request(conn net.Conn) (request []byte, destination string, err e
 		addrLen = net.IPv6len
 	default:
 		conn.Write([]byte{_SOCKS_VERSION, _ADDRESS_TYPE_NOT_SUPPORTED})
-		return nil, "", ErrAddressTypeNotSupported.withMessage(fmt.Sprintf("unknown address type: %d", requestHeader[3]))
+		return nil, "", 0, ErrAddressTypeNotSupported.withMessage(fmt.Sprintf("unknown address type: %d", requestHeader[3]))
 	}
 
 	// Read the rest of the request
 	requestRest := make([]byte, addrLen+2) // +2 for port number
 	if _, err := io.ReadFull(conn, requestRest); err != nil {
 		conn.Write([]byte{_SOCKS_VERSION, _GENERAL_SOCKS_FAILURE})
-		return nil, "", fmt.Errorf("error reading the rest of the request: %w", err)
+		return nil, "", 0, fmt.Errorf("error reading the rest of the request: %w", err)
 	}
 
 	// Combine the header and the rest of the request
 	fullRequest := append(requestHeader, requestRest...)
 
-	// we are done here, but for logging purpose we will extract the destination
+	// we are done here, but for routing and logging purpose we will extract the destination
 	var destinationAddr string
 	var destinationPort int
 	switch fullRequest[3] {
@@ -494,7 +1198,30 @@ func readSocks5Request(conn net.Conn) (request []byte, destination string, err e
 		destinationPort = int(fullRequest[len(fullRequest)-2])<<8 | int(fullRequest[len(fullRequest)-1])
 	}
 
-	return fullRequest, fmt.Sprintf("%s:%d", destinationAddr, destinationPort), nil
+	return fullRequest, destinationAddr, destinationPort, nil
+}
+
+// readUsernamePassword reads a username/password request https://datatracker.ietf.org/doc/html/rfc1929#section-2
+func readUsernamePassword(conn net.Conn) (username, password string, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", fmt.Errorf("error reading username length: %w", err)
+	}
+	if header[0] != 0x01 {
+		return "", "", fmt.Errorf("unsupported username/password subnegotiation version: %d", header[0])
+	}
+
+	usernameBytes := make([]byte, header[1]+1) // +1 for the password length
+	if _, err := io.ReadFull(conn, usernameBytes); err != nil {
+		return "", "", fmt.Errorf("error reading username: %w", err)
+	}
+
+	passwordBytes := make([]byte, usernameBytes[header[1]])
+	if _, err := io.ReadFull(conn, passwordBytes); err != nil {
+		return "", "", fmt.Errorf("error reading password: %w", err)
+	}
+
+	return string(usernameBytes[:header[1]]), string(passwordBytes), nil
 }
 
 func readSocks5Response(conn net.Conn) ([]byte, error) {
@@ -571,6 +1298,46 @@ func readSocks5Response(conn net.Conn) ([]byte, error) {
 	return fullResponse, nil
 }
 
+// writeReply sends a reply without a bound address to the client https://datatracker.ietf.org/doc/html/rfc1928#section-6
+func writeReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{_SOCKS_VERSION, reply, 0x00, _IP_V4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// writeReplyAddr sends a reply with the bound address to the client
+func writeReplyAddr(conn net.Conn, reply byte, bound net.Addr) error {
+	tcpAddr, ok := bound.(*net.TCPAddr)
+	if !ok {
+		return writeReply(conn, reply)
+	}
+
+	response := []byte{_SOCKS_VERSION, reply, 0x00}
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+		response = append(append(response, _IP_V4), ip4...)
+	} else {
+		response = append(append(response, _IP_V6), tcpAddr.IP.To16()...)
+	}
+	response = append(response, byte(tcpAddr.Port>>8), byte(tcpAddr.Port))
+
+	_, err := conn.Write(response)
+	return err
+}
+
+// dialErrorReply maps an error of dialing the destination to the SOCKS reply and error
+func dialErrorReply(err error) (byte, socksError) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return _CONN_REFUSED, ErrConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return _NETWORK_UNREACHABLE, ErrNetworkUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return _TTL_EXPIRED, ErrTTLExpired
+	default:
+		return _HOST_UNREACHABLE, ErrHostUnreachable
+	}
+}
+
 func contains[T comparable](slice []T, item T) bool {
 	for _, s := range slice {
 		if s == item {
@@ -54,7 +54,11 @@ func startProxy(t *testing.T, ctx context.Context, config Config, opts ...socksa
 		}
 	}(t)
 
-	time.Sleep(50 * time.Millisecond) // wait for server to start and set addr
+	select {
+	case <-server.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not start")
+	}
 	return server
 }
 
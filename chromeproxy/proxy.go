@@ -0,0 +1,97 @@
+// Package chromeproxy hands out local socksauth ports to chromedp browsers, which can not authenticate with a proxy themselves
+package chromeproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/FrauElster/socksauth"
+	"github.com/chromedp/chromedp"
+)
+
+// Proxy allocates a local port of a socksauth server for every browser, see socksauth.Server.Allocate
+type Proxy struct {
+	// OwnExit gives every browser without a session in its spec its own session, so a server with a StickyFinder keyed by
+	// socksauth.StickyBySessionId gives it its own exit IP. Otherwise these browsers share one session
+	OwnExit bool
+
+	server  *socksauth.Server
+	session string
+}
+
+// Start starts a socksauth server on a free local port, which authenticates with upstreams using credentials.
+// The server is stopped when ctx is done, opts are applied after the ones of Start and may e.g. set a finder
+func Start(ctx context.Context, remoteHost string, credentials socksauth.Credentials, opts ...socksauth.ServerOption) (*Proxy, error) {
+	opts = append([]socksauth.ServerOption{socksauth.WithAddr("127.0.0.1:0")}, opts...)
+	server := socksauth.NewServer(remoteHost, credentials.Username, credentials.Password, opts...)
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- server.Start(ctx) }()
+	select {
+	case <-server.Ready():
+	case err := <-errChan:
+		return nil, fmt.Errorf("error starting the server: %w", err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return Borrow(server)
+}
+
+// Borrow uses a server which was started already, it is not stopped by the proxy
+func Borrow(server *socksauth.Server) (*Proxy, error) {
+	session := make([]byte, 8)
+	if _, err := rand.Read(session); err != nil {
+		return nil, err
+	}
+	return &Proxy{server: server, session: hex.EncodeToString(session)}, nil
+}
+
+// Server returns the server the ports are allocated on
+func (p *Proxy) Server() *socksauth.Server {
+	return p.server
+}
+
+// AllocatorOptions allocates a port for spec and returns the options to add to the ones of a chromedp.ExecAllocator to use it.
+// release frees the port, it has to be called once the browser is closed
+func (p *Proxy) AllocatorOptions(spec socksauth.AllocationSpec) (opts []chromedp.ExecAllocatorOption, release func(), err error) {
+	if spec.Session == "" && !p.OwnExit {
+		spec.Session = p.session
+	}
+	allocation, err := p.server.Allocate(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts = []chromedp.ExecAllocatorOption{chromedp.ProxyServer(allocation.Addr)}
+	release = func() { p.server.Release(allocation.Id) }
+	return opts, release, nil
+}
+
+// NewContext starts a browser with the chromedp.DefaultExecAllocatorOptions, opts and a port allocated for spec.
+// Cancelling the context closes the browser and releases the port, so does the parent context being done
+func (p *Proxy) NewContext(parent context.Context, spec socksauth.AllocationSpec, opts ...chromedp.ExecAllocatorOption) (context.Context, context.CancelFunc, error) {
+	proxyOpts, release, err := p.AllocatorOptions(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allocatorOpts := append(chromedp.DefaultExecAllocatorOptions[:], opts...)
+	allocatorOpts = append(allocatorOpts, proxyOpts...)
+	allocatorCtx, cancelAllocator := chromedp.NewExecAllocator(parent, allocatorOpts...)
+	ctx, cancelBrowser := chromedp.NewContext(allocatorCtx)
+	stop := context.AfterFunc(ctx, release)
+
+	cancel := func() {
+		// stopped before the context is cancelled, so the release is done when cancel returns instead of in the background
+		stopped := stop()
+		cancelBrowser()
+		cancelAllocator()
+		// the browser is gone, so the port can be released right away instead of by the idle TTL
+		if stopped {
+			release()
+		}
+	}
+	return ctx, cancel, nil
+}
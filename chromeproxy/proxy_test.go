@@ -0,0 +1,95 @@
+package chromeproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/FrauElster/socksauth"
+)
+
+func startTestProxy(t *testing.T) *Proxy {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	router, err := socksauth.NewRouter(socksauth.RouterConfig{Default: socksauth.RouteRule{Action: socksauth.RouteDirect}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stub finder keeps the test from fetching the NordVPN server list
+	finder := socksauth.FinderFunc(func(ctx context.Context) (string, error) { return "127.0.0.1:1080", nil })
+	proxy, err := Start(ctx, "", socksauth.Credentials{Username: "user", Password: "pass"}, socksauth.WithRouter(router), socksauth.WithFinder(finder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+func TestAllocatorOptions(t *testing.T) {
+	proxy := startTestProxy(t)
+
+	opts, release, err := proxy.AllocatorOptions(socksauth.AllocationSpec{Country: "de"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) == 0 {
+		t.Fatal("expected the proxy option")
+	}
+	_, releaseOther, err := proxy.AllocatorOptions(socksauth.AllocationSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseOther()
+
+	allocations := proxy.Server().Allocations()
+	if len(allocations) != 2 || allocations[0].Spec.Session == "" || allocations[0].Spec.Session != allocations[1].Spec.Session {
+		t.Fatalf("expected two allocations sharing a session, got %+v", allocations)
+	}
+	release()
+	if allocations := proxy.Server().Allocations(); len(allocations) != 1 {
+		t.Errorf("expected the allocation to be released, got %+v", allocations)
+	}
+
+	proxy.OwnExit = true
+	_, releaseOwn, err := proxy.AllocatorOptions(socksauth.AllocationSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseOwn()
+	allocations = proxy.Server().Allocations()
+	if len(allocations) != 2 || allocations[1].Spec.Session != "" {
+		t.Errorf("expected the session to default to the allocation's id, got %+v", allocations)
+	}
+}
+
+func TestNewContextRelease(t *testing.T) {
+	proxy := startTestProxy(t)
+
+	// the browser is only started by the first action, so no browser is needed here
+	_, cancel, err := proxy.NewContext(context.Background(), socksauth.AllocationSpec{City: "berlin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocations := proxy.Server().Allocations(); len(allocations) != 1 || allocations[0].Spec.City != "berlin" {
+		t.Fatalf("expected an allocation for the browser, got %+v", allocations)
+	}
+	cancel()
+	if allocations := proxy.Server().Allocations(); len(allocations) != 0 {
+		t.Errorf("expected the allocation to be released with the browser, got %+v", allocations)
+	}
+
+	parent, cancelParent := context.WithCancel(context.Background())
+	_, cancel, err = proxy.NewContext(parent, socksauth.AllocationSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	cancelParent()
+	for i := 0; i < 100 && len(proxy.Server().Allocations()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if allocations := proxy.Server().Allocations(); len(allocations) != 0 {
+		t.Errorf("expected the allocation to be released with the parent context, got %+v", allocations)
+	}
+}
@@ -0,0 +1,25 @@
+package socksauth
+
+// PassThroughCredentials uses the client's username and password for the upstream unchanged, for setups where every user has an own upstream account
+// With a username grammar the routing hints are removed from the username first
+func PassThroughCredentials(username, password string) (Credentials, bool) {
+	return Credentials{Username: username, Password: password}, true
+}
+
+// CredentialTable maps local users to their upstream credentials, it does not check the local password, so use it together with WithClientAuth
+type CredentialTable map[string]Credentials
+
+// LoadCredentialTable reads a table from a JSON or YAML file mapping local users to objects with username and password
+func LoadCredentialTable(path string) (CredentialTable, error) {
+	var table CredentialTable
+	if err := decodeFile(path, &table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Map returns the upstream credentials of the local user, it can be passed to WithClientCredentials
+func (t CredentialTable) Map(username, password string) (Credentials, bool) {
+	credentials, ok := t[username]
+	return credentials, ok
+}
@@ -0,0 +1,75 @@
+package socksauth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPassThroughCredentials(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "alice", "secret")
+	finder := &reportingFinder{upstreams: []Upstream{{Addr: upstream.Addr}}}
+	_, proxyAddr := startTestServer(t, "", "server-user", "server-pass", WithFinder(finder),
+		WithClientCredentials(PassThroughCredentials), WithUsernameGrammar(DefaultUsernameGrammar))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "alice-country-de", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	// the upstream's rejection is an authentication failure for the client, which does not count against the upstream
+	if _, err := dialSocks(proxyAddr, echoAddr, "alice", "wrong"); !errors.Is(err, errAuthRejectedByProxy) {
+		t.Errorf("expected the client's authentication to fail, got %v", err)
+	}
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); err == nil {
+		t.Error("expected clients without credentials to be refused")
+	}
+
+	waitFor(t, func() bool {
+		successes, _ := finder.reports()
+		return len(successes) == 1
+	})
+	if _, failures := finder.reports(); len(failures) != 0 {
+		t.Errorf("expected no failures for rejected client credentials, got %v", failures)
+	}
+}
+
+func TestCredentialTable(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "alice", "secret")
+
+	table, err := LoadCredentialTable(writeFile(t, "users.yaml", `
+bob:
+  username: alice
+  password: secret
+carol:
+  username: carol
+  password: outdated
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientAuth := func(username, password string) bool { return password == "local" }
+	_, proxyAddr := startTestServer(t, upstream.Addr, "", "", WithClientAuth(clientAuth), WithClientCredentials(table.Map))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "bob", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	for _, user := range []string{"carol", "dave"} {
+		if _, err := dialSocks(proxyAddr, echoAddr, user, "local"); !errors.Is(err, errAuthRejectedByProxy) {
+			t.Errorf("%s: expected the authentication to fail, got %v", user, err)
+		}
+	}
+	if _, err := dialSocks(proxyAddr, echoAddr, "bob", "wrong"); !errors.Is(err, errAuthRejectedByProxy) {
+		t.Errorf("expected the local password to be checked, got %v", err)
+	}
+	if upstream.FailedAuths.Load() != 1 {
+		t.Errorf("expected only carol's outdated credentials to reach the upstream, got %d failures", upstream.FailedAuths.Load())
+	}
+}
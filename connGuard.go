@@ -0,0 +1,154 @@
+package socksauth
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// defaultHandshakeTimeout is the time a client has to send its greeting and request
+const defaultHandshakeTimeout = 10 * time.Second
+
+// connGuard limits the rate of new connections per source IP and bans sources after repeated protocol errors
+type connGuard struct {
+	mu sync.Mutex
+	connLimits
+
+	sources   map[netip.Addr]*sourceState
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// connLimits are the settings of the connGuard
+type connLimits struct {
+	// rate is the number of connections per second a source may open, 0 means unlimited
+	rate  float64
+	burst float64
+
+	// banAfter is the number of protocol errors within banWindow which ban a source for banFor, 0 disables bans
+	banAfter  int
+	banWindow time.Duration
+	banFor    time.Duration
+}
+
+type sourceState struct {
+	tokens      float64
+	last        time.Time
+	errors      []time.Time
+	bannedUntil time.Time
+}
+
+func newConnGuard() *connGuard {
+	return &connGuard{sources: make(map[netip.Addr]*sourceState), now: time.Now}
+}
+
+// setLimits replaces the limits, the state of known sources is kept
+func (g *connGuard) setLimits(limits connLimits) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.connLimits = limits
+}
+
+// enabled returns whether the guard has anything to do, the caller has to hold the lock
+func (g *connGuard) enabled() bool {
+	return g.rate > 0 || g.banAfter > 0
+}
+
+// allow checks whether a new connection from addr may be handled
+// A banned source is rejected silently, as its ban was already reported
+func (g *connGuard) allow(addr net.Addr) (allowed bool, reason string) {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return true, ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.enabled() {
+		return true, ""
+	}
+
+	now := g.now()
+	g.sweep(now)
+	source := g.source(ip, now)
+
+	if now.Before(source.bannedUntil) {
+		return false, ""
+	}
+	if g.rate == 0 {
+		return true, ""
+	}
+
+	source.tokens = min(source.tokens+now.Sub(source.last).Seconds()*g.rate, g.burst)
+	source.last = now
+	if source.tokens < 1 {
+		return false, fmt.Sprintf("client %s exceeded %g connections per second", ip, g.rate)
+	}
+	source.tokens--
+	return true, ""
+}
+
+// protocolError records a protocol error of the source and returns a description of the ban if the source got banned by it
+func (g *connGuard) protocolError(addr net.Addr) (banned bool, reason string) {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false, ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.banAfter == 0 {
+		return false, ""
+	}
+
+	now := g.now()
+	source := g.source(ip, now)
+	if now.Before(source.bannedUntil) {
+		return false, ""
+	}
+
+	source.errors = append(recentErrors(source.errors, now.Add(-g.banWindow)), now)
+	if len(source.errors) < g.banAfter {
+		return false, ""
+	}
+	source.errors = nil
+	source.bannedUntil = now.Add(g.banFor)
+	return true, fmt.Sprintf("client %s banned for %s after %d protocol errors within %s", ip, g.banFor, g.banAfter, g.banWindow)
+}
+
+// source returns the state of the ip, the caller has to hold the lock
+func (g *connGuard) source(ip netip.Addr, now time.Time) *sourceState {
+	source, ok := g.sources[ip]
+	if !ok {
+		source = &sourceState{tokens: g.burst, last: now}
+		g.sources[ip] = source
+	}
+	return source
+}
+
+// sweep forgets sources which are in the same state as unknown ones, the caller has to hold the lock
+func (g *connGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+
+	for ip, source := range g.sources {
+		refilled := g.rate == 0 || source.tokens+now.Sub(source.last).Seconds()*g.rate >= g.burst
+		if refilled && now.After(source.bannedUntil) && len(recentErrors(source.errors, now.Add(-g.banWindow))) == 0 {
+			delete(g.sources, ip)
+		}
+	}
+}
+
+// recentErrors drops the errors before since
+func recentErrors(times []time.Time, since time.Time) []time.Time {
+	for idx, t := range times {
+		if t.After(since) {
+			return times[idx:]
+		}
+	}
+	return times[:0]
+}
@@ -0,0 +1,164 @@
+package socksauth
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnGuardRateLimit(t *testing.T) {
+	now := time.Now()
+	guard := newConnGuard()
+	guard.now = func() time.Time { return now }
+	guard.rate, guard.burst = 2, 3
+
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := guard.allow(client); !allowed {
+			t.Fatalf("expected connection %d of the burst to be allowed", i+1)
+		}
+	}
+	if allowed, reason := guard.allow(client); allowed || !strings.Contains(reason, "10.0.0.1") {
+		t.Errorf("expected the connection over the burst to be refused, got %v %q", allowed, reason)
+	}
+	if allowed, _ := guard.allow(other); !allowed {
+		t.Error("expected other sources not to be limited")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if allowed, _ := guard.allow(client); !allowed {
+		t.Error("expected a connection to be allowed after the refill")
+	}
+	if allowed, _ := guard.allow(client); allowed {
+		t.Error("expected a single token to be refilled")
+	}
+
+	now = now.Add(2 * time.Minute)
+	guard.allow(other)
+	if _, ok := guard.sources[netip.MustParseAddr("10.0.0.1")]; ok {
+		t.Error("expected idle sources to be forgotten")
+	}
+}
+
+func TestConnGuardBan(t *testing.T) {
+	now := time.Now()
+	guard := newConnGuard()
+	guard.now = func() time.Time { return now }
+	guard.banAfter, guard.banWindow, guard.banFor = 3, time.Minute, 10*time.Minute
+
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+
+	guard.protocolError(client)
+	guard.protocolError(client)
+	now = now.Add(2 * time.Minute)
+	if banned, _ := guard.protocolError(client); banned {
+		t.Fatal("expected errors outside of the window not to count")
+	}
+	guard.protocolError(client)
+	banned, reason := guard.protocolError(client)
+	if !banned || !strings.Contains(reason, "10.0.0.1") {
+		t.Fatalf("expected the third error within the window to ban the client, got %v %q", banned, reason)
+	}
+	if banned, _ := guard.protocolError(client); banned {
+		t.Error("expected a ban to be reported only once")
+	}
+	if allowed, reason := guard.allow(client); allowed || reason != "" {
+		t.Errorf("expected the banned client to be refused silently, got %v %q", allowed, reason)
+	}
+
+	now = now.Add(11 * time.Minute)
+	if allowed, _ := guard.allow(client); !allowed {
+		t.Error("expected the ban to expire")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	upstream := startMockUpstream(t, "user", "pass")
+	errs := make(chan SocksError, 1)
+	_, proxyAddr := startTestServer(t, upstream.Addr, "user", "pass", WithHandshakeTimeout(100*time.Millisecond),
+		WithOnError(func(id int64, conn net.Conn, err SocksError) { errs <- err }))
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// send only half of the greeting
+	conn.Write([]byte{_SOCKS_VERSION})
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the server to close the connection, got %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrEstablishClientConn) {
+			t.Errorf("expected a client connection error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an error")
+	}
+}
+
+func TestProtocolErrorBanThroughServer(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+	bans := make(chan SocksError, 1)
+	_, proxyAddr := startTestServer(t, upstream.Addr, "user", "pass", WithProtocolErrorBan(2, time.Minute, time.Minute),
+		WithOnError(func(id int64, conn net.Conn, err SocksError) {
+			if errors.Is(err, ErrClientBanned) {
+				bans <- err
+			}
+		}))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{0x04, 0x01})
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		io.ReadAll(conn)
+		conn.Close()
+	}
+
+	select {
+	case err := <-bans:
+		if !errors.Is(err, ErrConnectionNotAllowed) || !strings.Contains(err.Error(), "127.0.0.1") {
+			t.Errorf("expected the ban to name the client, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the client to be banned")
+	}
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); err == nil {
+		t.Error("expected the banned client to be refused")
+	}
+}
+
+func TestOpenConnLimitReleasesSlots(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+	_, proxyAddr := startTestServer(t, upstream.Addr, "user", "pass", WithOpenConnLimit(1))
+
+	for i := 0; i < 3; i++ {
+		conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+		if err != nil {
+			t.Fatalf("connection %d: %v", i+1, err)
+		}
+		assertEcho(t, conn)
+		conn.Close()
+	}
+}
@@ -0,0 +1,191 @@
+package socksauth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Credentials is an account used to authenticate with upstreams
+type Credentials struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// CredentialStrategy decides which account of a CredentialPool is used for a new connection
+type CredentialStrategy string
+
+const (
+	// CredentialsRoundRobin uses the accounts in turn
+	CredentialsRoundRobin CredentialStrategy = "round-robin"
+	// CredentialsLeastUsed uses the account with the fewest open connections
+	CredentialsLeastUsed CredentialStrategy = "least-used"
+)
+
+// CredentialPool spreads connections over several upstream accounts.
+// An account rejected by upstreams repeatedly is set aside for a cooldown, e.g. because the vendor throttles it.
+type CredentialPool struct {
+	strategy    CredentialStrategy
+	maxFailures int
+	cooldown    time.Duration
+
+	mu       sync.Mutex
+	accounts []*credentialAccount
+	next     int
+}
+
+type credentialAccount struct {
+	Credentials
+	open         int
+	failures     int
+	coolingUntil time.Time
+}
+
+// CredentialStatus is the state of an account of a CredentialPool
+type CredentialStatus struct {
+	Username        string    `json:"username"`
+	OpenConnections int       `json:"openConnections"`
+	Failures        int       `json:"failures"`
+	CoolingUntil    time.Time `json:"coolingUntil,omitempty"`
+}
+
+type CredentialPoolOption func(*CredentialPool)
+
+// WithCredentialStrategy sets how accounts are chosen, default is CredentialsRoundRobin
+func WithCredentialStrategy(strategy CredentialStrategy) CredentialPoolOption {
+	return func(p *CredentialPool) { p.strategy = strategy }
+}
+
+// WithAuthFailureCooldown sets an account aside for cooldown after failures consecutive rejections
+// Default is 3 failures and 5 minutes
+func WithAuthFailureCooldown(failures int, cooldown time.Duration) CredentialPoolOption {
+	return func(p *CredentialPool) {
+		p.maxFailures = failures
+		p.cooldown = cooldown
+	}
+}
+
+// NewCredentialPool creates a pool of upstream accounts, there has to be at least one
+func NewCredentialPool(accounts []Credentials, opts ...CredentialPoolOption) (*CredentialPool, error) {
+	p := &CredentialPool{
+		strategy:    CredentialsRoundRobin,
+		maxFailures: 3,
+		cooldown:    5 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("a credential pool needs at least one account")
+	}
+	if p.strategy != CredentialsRoundRobin && p.strategy != CredentialsLeastUsed {
+		return nil, fmt.Errorf("unknown credential strategy %q", p.strategy)
+	}
+	for _, account := range accounts {
+		p.accounts = append(p.accounts, &credentialAccount{Credentials: account})
+	}
+	return p, nil
+}
+
+// Status returns the state of all accounts
+func (p *CredentialPool) Status() []CredentialStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := make([]CredentialStatus, 0, len(p.accounts))
+	for _, account := range p.accounts {
+		status = append(status, CredentialStatus{
+			Username:        account.Username,
+			OpenConnections: account.open,
+			Failures:        account.failures,
+			CoolingUntil:    account.coolingUntil,
+		})
+	}
+	return status
+}
+
+// acquire chooses an account which was not tried yet, accounts cooling down are only used if there is no other choice.
+// It returns false if every account was tried. The account has to be released when the connection is closed.
+func (p *CredentialPool) acquire(tried []string) (Credentials, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var chosen, cooling *credentialAccount
+	for i := range p.accounts {
+		// round-robin starts with the account after the last one used
+		idx := (p.next + i) % len(p.accounts)
+		account := p.accounts[idx]
+		if contains(tried, account.Username) {
+			continue
+		}
+		if now.Before(account.coolingUntil) {
+			if cooling == nil || account.coolingUntil.Before(cooling.coolingUntil) {
+				cooling = account
+			}
+			continue
+		}
+
+		if p.strategy == CredentialsRoundRobin {
+			chosen = account
+			p.next = idx + 1
+			break
+		}
+		if chosen == nil || account.open < chosen.open {
+			chosen = account
+		}
+	}
+
+	if chosen == nil {
+		chosen = cooling
+	}
+	if chosen == nil {
+		return Credentials{}, false
+	}
+	chosen.open++
+	return chosen.Credentials, true
+}
+
+// release marks a connection using the account as closed
+func (p *CredentialPool) release(credentials Credentials) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if account := p.account(credentials.Username); account != nil {
+		account.open = max(account.open-1, 0)
+	}
+}
+
+// reportSuccess resets the consecutive failures of an account
+func (p *CredentialPool) reportSuccess(credentials Credentials) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if account := p.account(credentials.Username); account != nil {
+		account.failures = 0
+		account.coolingUntil = time.Time{}
+	}
+}
+
+// reportRejected counts a rejection of the account and sets it aside once it reached the maximum failures
+func (p *CredentialPool) reportRejected(credentials Credentials) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	account := p.account(credentials.Username)
+	if account == nil {
+		return
+	}
+	account.failures++
+	if account.failures >= p.maxFailures {
+		account.coolingUntil = time.Now().Add(p.cooldown)
+	}
+}
+
+// account returns the account with the username, the caller has to hold the lock
+func (p *CredentialPool) account(username string) *credentialAccount {
+	for _, account := range p.accounts {
+		if account.Username == username {
+			return account
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package socksauth
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func acquireUser(t *testing.T, pool *CredentialPool, tried ...string) string {
+	t.Helper()
+	credentials, ok := pool.acquire(tried)
+	if !ok {
+		t.Fatal("expected an account")
+	}
+	return credentials.Username
+}
+
+func TestCredentialPoolStrategies(t *testing.T) {
+	accounts := []Credentials{{Username: "a"}, {Username: "b"}, {Username: "c"}}
+
+	roundRobin, err := NewCredentialPool(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"a", "b", "c", "a"} {
+		if user := acquireUser(t, roundRobin); user != expected {
+			t.Errorf("expected %s, got %s", expected, user)
+		}
+	}
+
+	leastUsed, err := NewCredentialPool(accounts, WithCredentialStrategy(CredentialsLeastUsed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquireUser(t, leastUsed) // a
+	acquireUser(t, leastUsed) // b
+	leastUsed.release(Credentials{Username: "a"})
+	if user := acquireUser(t, leastUsed); user != "a" {
+		t.Errorf("expected the released account a, got %s", user)
+	}
+	if user := acquireUser(t, leastUsed); user != "c" {
+		t.Errorf("expected the unused account c, got %s", user)
+	}
+
+	if _, err := NewCredentialPool(nil); err == nil {
+		t.Error("expected an error without accounts")
+	}
+	if _, err := NewCredentialPool(accounts, WithCredentialStrategy("random")); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
+
+func TestCredentialPoolCooldown(t *testing.T) {
+	pool, err := NewCredentialPool([]Credentials{{Username: "a"}, {Username: "b"}}, WithAuthFailureCooldown(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.reportRejected(Credentials{Username: "a"})
+	if user := acquireUser(t, pool); user != "a" {
+		t.Fatalf("expected a single failure not to cool the account down, got %s", user)
+	}
+	pool.reportRejected(Credentials{Username: "a"})
+	for i := 0; i < 3; i++ {
+		if user := acquireUser(t, pool); user != "b" {
+			t.Fatalf("expected the cooling account to be skipped, got %s", user)
+		}
+	}
+	if user := acquireUser(t, pool, "b"); user != "a" {
+		t.Errorf("expected the cooling account if there is no other choice, got %s", user)
+	}
+	if _, ok := pool.acquire([]string{"a", "b"}); ok {
+		t.Error("expected no account if all were tried")
+	}
+
+	pool.reportSuccess(Credentials{Username: "a"})
+	if status := pool.Status(); status[0].Failures != 0 || !status[0].CoolingUntil.IsZero() {
+		t.Errorf("expected a success to reset the account, got %+v", status[0])
+	}
+}
+
+func TestCredentialPoolRetriesUpstream(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "alice", "secret")
+
+	pool, err := NewCredentialPool([]Credentials{
+		{Username: "throttled", Password: "secret"},
+		{Username: "alice", Password: "secret"},
+	}, WithAuthFailureCooldown(1, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, proxyAddr := startTestServer(t, upstream.Addr, "", "", WithCredentialPool(pool))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if upstream.FailedAuths.Load() != 1 || upstream.Auths.Load() != 2 {
+		t.Errorf("expected a retry with the next account, got %d auths and %d failures", upstream.Auths.Load(), upstream.FailedAuths.Load())
+	}
+	if status := pool.Status(); status[1].OpenConnections != 1 {
+		t.Errorf("expected the open connection to count for alice, got %+v", status)
+	}
+	conn.Close()
+	waitFor(t, func() bool { return pool.Status()[1].OpenConnections == 0 })
+
+	// the rejected account is cooling down, so the next connection uses alice right away
+	conn, err = dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+	if upstream.FailedAuths.Load() != 1 {
+		t.Errorf("expected the cooling account to be skipped, got %d failures", upstream.FailedAuths.Load())
+	}
+}
+
+func TestCredentialPoolAllRejected(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "alice", "secret")
+
+	pool, err := NewCredentialPool([]Credentials{{Username: "bob", Password: "x"}, {Username: "carol", Password: "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan SocksError, 1)
+	_, proxyAddr := startTestServer(t, upstream.Addr, "", "", WithCredentialPool(pool),
+		WithOnError(func(id int64, conn net.Conn, err SocksError) { errs <- err }))
+
+	var replyErr socksReplyError
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); !errors.As(err, &replyErr) || replyErr != _GENERAL_SOCKS_FAILURE {
+		t.Fatalf("expected a general failure, got %v", err)
+	}
+	if upstream.FailedAuths.Load() != 2 {
+		t.Errorf("expected both accounts to be tried, got %d failures", upstream.FailedAuths.Load())
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrAuthentication) || !errors.Is(err, errCredentialsRejected) {
+			t.Errorf("expected a rejected authentication, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an error")
+	}
+	for _, status := range pool.Status() {
+		if status.OpenConnections != 0 {
+			t.Errorf("expected no open connections, got %+v", status)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package socksauth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// CredentialProvider supplies the credentials to authenticate with upstreams.
+// They are requested for every upstream connection, so they may change while the server is running.
+// Implementations have to be safe for concurrent use.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// CredentialProviderFunc is an adapter to use a function as CredentialProvider
+type CredentialProviderFunc func(ctx context.Context) (Credentials, error)
+
+func (f CredentialProviderFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// StaticCredentials always provides the same credentials
+func StaticCredentials(credentials Credentials) CredentialProvider {
+	return CredentialProviderFunc(func(ctx context.Context) (Credentials, error) { return credentials, nil })
+}
+
+// EnvCredentials reads the credentials from the environment variables userVar and passVar whenever they are needed
+func EnvCredentials(userVar, passVar string) CredentialProvider {
+	return CredentialProviderFunc(func(ctx context.Context) (Credentials, error) {
+		credentials := Credentials{Username: os.Getenv(userVar), Password: os.Getenv(passVar)}
+		if credentials.Username == "" || credentials.Password == "" {
+			return Credentials{}, fmt.Errorf("environment variables %s and %s have to be set", userVar, passVar)
+		}
+		return credentials, nil
+	})
+}
+
+// FileCredentials reads the credentials from a file, which is read again when it changes
+type FileCredentials struct {
+	path string
+
+	mu          sync.Mutex
+	modTime     time.Time
+	credentials Credentials
+}
+
+var _ CredentialProvider = (*FileCredentials)(nil)
+
+// NewFileCredentials reads the credentials from a JSON or YAML file with username and password,
+// any other file has the username in the first and the password in the second line (like an OpenVPN auth-user-pass file)
+func NewFileCredentials(path string) (*FileCredentials, error) {
+	f := &FileCredentials{path: path}
+	if _, err := f.Credentials(context.Background()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Credentials returns the credentials of the file, if the changed file can not be read the previous credentials are kept
+func (f *FileCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil || info.ModTime().Equal(f.modTime) {
+		if f.modTime.IsZero() {
+			return Credentials{}, err
+		}
+		return f.credentials, nil
+	}
+
+	credentials, err := readCredentialsFile(f.path)
+	if err != nil {
+		if f.modTime.IsZero() {
+			return Credentials{}, err
+		}
+		return f.credentials, nil
+	}
+	f.credentials = credentials
+	f.modTime = info.ModTime()
+	return credentials, nil
+}
+
+func readCredentialsFile(path string) (Credentials, error) {
+	var credentials Credentials
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yaml", ".yml":
+		if err := decodeFile(path, &credentials); err != nil {
+			return Credentials{}, err
+		}
+	default:
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return Credentials{}, err
+		}
+		lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+		if len(lines) < 2 {
+			return Credentials{}, fmt.Errorf("error reading %s: expected the username and password in two lines", path)
+		}
+		credentials = Credentials{Username: strings.TrimSpace(lines[0]), Password: strings.TrimSpace(lines[1])}
+	}
+
+	if credentials.Username == "" || credentials.Password == "" {
+		return Credentials{}, fmt.Errorf("error reading %s: username and password are required", path)
+	}
+	return credentials, nil
+}
+
+// CommandCredentials runs a helper command which prints the credentials as JSON object with username and password, like a git credential helper
+type CommandCredentials struct {
+	command  string
+	args     []string
+	cacheFor time.Duration
+
+	mu          sync.Mutex
+	fetchedAt   time.Time
+	credentials Credentials
+}
+
+var _ CredentialProvider = (*CommandCredentials)(nil)
+
+// NewCommandCredentials creates a provider running command with args, its output is used for cacheFor before the command runs again
+func NewCommandCredentials(cacheFor time.Duration, command string, args ...string) *CommandCredentials {
+	return &CommandCredentials{command: command, args: args, cacheFor: cacheFor}
+}
+
+func (c *CommandCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < c.cacheFor {
+		return c.credentials, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.command, c.args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return Credentials{}, fmt.Errorf("error running credential helper %s: %w: %s", c.command, err, msg)
+		}
+		return Credentials{}, fmt.Errorf("error running credential helper %s: %w", c.command, err)
+	}
+
+	var credentials Credentials
+	if err := json.Unmarshal(stdout.Bytes(), &credentials); err != nil {
+		return Credentials{}, fmt.Errorf("error parsing the output of credential helper %s: %w", c.command, err)
+	}
+	if credentials.Username == "" || credentials.Password == "" {
+		return Credentials{}, fmt.Errorf("credential helper %s did not print a username and password", c.command)
+	}
+
+	c.credentials = credentials
+	c.fetchedAt = time.Now()
+	return credentials, nil
+}
+
+// PromptCredentials asks for the credentials on in and writes the prompts to out, the username is only asked for if it is empty.
+// If in is a terminal the password is not echoed. It is meant to be called once at startup.
+func PromptCredentials(in *os.File, out io.Writer, username string) (Credentials, error) {
+	reader := bufio.NewReader(in)
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	if username == "" {
+		fmt.Fprint(out, "Username: ")
+		var err error
+		if username, err = readLine(); err != nil {
+			return Credentials{}, fmt.Errorf("error reading the username: %w", err)
+		}
+	}
+
+	fmt.Fprint(out, "Password: ")
+	var password string
+	if term.IsTerminal(int(in.Fd())) {
+		raw, err := term.ReadPassword(int(in.Fd()))
+		fmt.Fprintln(out)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("error reading the password: %w", err)
+		}
+		password = string(raw)
+	} else {
+		var err error
+		if password, err = readLine(); err != nil {
+			return Credentials{}, fmt.Errorf("error reading the password: %w", err)
+		}
+	}
+
+	if username == "" || password == "" {
+		return Credentials{}, fmt.Errorf("username and password are required")
+	}
+	return Credentials{Username: username, Password: password}, nil
+}
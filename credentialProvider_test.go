@@ -0,0 +1,137 @@
+package socksauth
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileCredentials(t *testing.T) {
+	files := map[string]string{
+		"auth.txt":  "alice\nsecret\n",
+		"auth.json": `{"username": "alice", "password": "secret"}`,
+		"auth.yaml": "username: alice\npassword: secret\n",
+	}
+	for name, content := range files {
+		provider, err := NewFileCredentials(writeFile(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		credentials, err := provider.Credentials(context.Background())
+		if err != nil || credentials != (Credentials{Username: "alice", Password: "secret"}) {
+			t.Errorf("%s: unexpected credentials %+v: %v", name, credentials, err)
+		}
+	}
+
+	for name, content := range map[string]string{"short.txt": "alice", "nopass.json": `{"username": "alice"}`} {
+		if _, err := NewFileCredentials(writeFile(t, name, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestFileCredentialsReload(t *testing.T) {
+	path := writeFile(t, "auth.txt", "alice\nold\n")
+	provider, err := NewFileCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(path, []byte("alice\nnew\n"), 0600)
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	if credentials, _ := provider.Credentials(context.Background()); credentials.Password != "new" {
+		t.Errorf("expected the changed password, got %q", credentials.Password)
+	}
+
+	// a broken file keeps the previous credentials
+	os.WriteFile(path, []byte("alice"), 0600)
+	os.Chtimes(path, time.Now().Add(2*time.Second), time.Now().Add(2*time.Second))
+	if credentials, err := provider.Credentials(context.Background()); err != nil || credentials.Password != "new" {
+		t.Errorf("expected the previous password, got %q: %v", credentials.Password, err)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	provider := EnvCredentials("TEST_SOCKS_USER", "TEST_SOCKS_PASS")
+	t.Setenv("TEST_SOCKS_USER", "alice")
+	if _, err := provider.Credentials(context.Background()); err == nil {
+		t.Error("expected an error without a password")
+	}
+
+	t.Setenv("TEST_SOCKS_PASS", "secret")
+	credentials, err := provider.Credentials(context.Background())
+	if err != nil || credentials != (Credentials{Username: "alice", Password: "secret"}) {
+		t.Errorf("unexpected credentials %+v: %v", credentials, err)
+	}
+}
+
+func TestCommandCredentials(t *testing.T) {
+	counter := writeFile(t, "count", "")
+	script := `echo x >> ` + counter + `; echo '{"username": "alice", "password": "secret"}'`
+	provider := NewCommandCredentials(time.Minute, "sh", "-c", script)
+
+	for i := 0; i < 2; i++ {
+		credentials, err := provider.Credentials(context.Background())
+		if err != nil || credentials != (Credentials{Username: "alice", Password: "secret"}) {
+			t.Fatalf("unexpected credentials %+v: %v", credentials, err)
+		}
+	}
+	if content, _ := os.ReadFile(counter); string(content) != "x\n" {
+		t.Errorf("expected the output to be cached, the helper ran %d times", len(content)/2)
+	}
+
+	failing := NewCommandCredentials(0, "sh", "-c", "echo locked >&2; exit 1")
+	if _, err := failing.Credentials(context.Background()); err == nil {
+		t.Error("expected an error for a failing helper")
+	}
+	invalid := NewCommandCredentials(0, "sh", "-c", "echo alice")
+	if _, err := invalid.Credentials(context.Background()); err == nil {
+		t.Error("expected an error for output which is no JSON")
+	}
+}
+
+func TestPromptCredentials(t *testing.T) {
+	in, err := os.Open(writeFile(t, "input", "alice\nsecret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	var out bytes.Buffer
+	credentials, err := PromptCredentials(in, &out, "")
+	if err != nil || credentials != (Credentials{Username: "alice", Password: "secret"}) {
+		t.Errorf("unexpected credentials %+v: %v", credentials, err)
+	}
+	if out.String() != "Username: Password: " {
+		t.Errorf("unexpected prompt %q", out.String())
+	}
+}
+
+func TestCredentialProviderRotation(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "alice", "rotated")
+
+	path := writeFile(t, "auth.txt", "alice\nsecret\n")
+	provider, err := NewFileCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, proxyAddr := startTestServer(t, upstream.Addr, "", "", WithCredentialProvider(provider))
+
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); err == nil {
+		t.Fatal("expected the outdated password to be rejected")
+	}
+
+	// the server picks up the new password without a restart
+	os.WriteFile(path, []byte("alice\nrotated\n"), 0600)
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+}
@@ -0,0 +1,207 @@
+package socksauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// BlockedNetworks are the networks a DestinationPolicy blocks unless they are allowed explicitly
+var BlockedNetworks = []string{
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // RFC1918
+	"100.64.0.0/10",  // CGNAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata endpoints
+	"172.16.0.0/12",  // RFC1918
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // RFC1918
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"100::/64",       // discard
+	"fc00::/7",       // unique local addresses
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+}
+
+// errDestinationBlocked is returned by a DestinationPolicy for destinations in a blocked network
+var errDestinationBlocked = errors.New("destination is in a blocked network")
+
+// DestinationPolicy protects internal networks from requests, e.g. of a compromised client, by blocking destinations in private and special purpose networks.
+// Domains are resolved locally and blocked if any of their addresses is blocked. IP literals are checked in all the forms resolvers accept,
+// including the legacy IPv4 forms ("2130706433", "0x7f.1") and IPv4 addresses embedded in IPv6 ones ("::ffff:127.0.0.1").
+type DestinationPolicy struct {
+	// UpstreamResolves leaves domains routed through an upstream to the upstream to resolve, only their IP literals are checked.
+	// It is off by default, as an upstream in the internal network would make its internal names reachable
+	UpstreamResolves bool
+
+	blocked        []netip.Prefix
+	allowed        []netip.Prefix
+	allowedDomains []string
+	resolver       *net.Resolver
+}
+
+// NewDestinationPolicy creates a policy blocking BlockedNetworks, allow overrides the block for CIDRs, IPs and domain patterns (like the ones of a RouteRule)
+func NewDestinationPolicy(allow ...string) (*DestinationPolicy, error) {
+	blocked, err := parsePrefixes(BlockedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	p := &DestinationPolicy{blocked: blocked, resolver: net.DefaultResolver}
+
+	for _, entry := range allow {
+		prefixes, err := parsePrefixes([]string{entry})
+		if err == nil {
+			p.allowed = append(p.allowed, prefixes...)
+			continue
+		}
+		domain := normalizeDomain(entry)
+		if domain == "" || (domain != "*" && strings.Contains(strings.TrimPrefix(domain, "*."), "*")) {
+			return nil, fmt.Errorf("invalid allow entry %q", entry)
+		}
+		p.allowedDomains = append(p.allowedDomains, domain)
+	}
+	return p, nil
+}
+
+var defaultDestinationPolicy, _ = NewDestinationPolicy()
+
+// Check returns the addresses of the host which may be connected to, or an error if the host is blocked or can not be resolved.
+// No addresses are returned for an allowed domain, it is up to the dialer to resolve it.
+func (p *DestinationPolicy) Check(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, ok := parseIPLiteral(host); ok {
+		if p.isBlocked(ip) {
+			return nil, fmt.Errorf("%w: %s", errDestinationBlocked, ip)
+		}
+		return []netip.Addr{ip}, nil
+	}
+
+	domain := normalizeDomain(host)
+	for _, pattern := range p.allowedDomains {
+		if matchDomain(pattern, domain) {
+			return nil, nil
+		}
+	}
+
+	addrs, err := p.resolver.LookupNetIP(ctx, "ip", domain)
+	if err != nil {
+		return nil, err
+	}
+	for idx, addr := range addrs {
+		addrs[idx] = addr.Unmap()
+		if p.isBlocked(addrs[idx]) {
+			return nil, fmt.Errorf("%w: %s resolves to %s", errDestinationBlocked, host, addrs[idx])
+		}
+	}
+	return addrs, nil
+}
+
+func (p *DestinationPolicy) isBlocked(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	candidates := []netip.Addr{ip}
+	if embedded, ok := embeddedIPv4(ip); ok {
+		candidates = append(candidates, embedded)
+	}
+
+	for _, candidate := range candidates {
+		if containsAddr(p.allowed, candidate) {
+			continue
+		}
+		if containsAddr(p.blocked, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ipv4CompatiblePrefix = netip.MustParsePrefix("::/96")
+	nat64Prefix          = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFourPrefix      = netip.MustParsePrefix("2002::/16")
+)
+
+// embeddedIPv4 returns the IPv4 address of IPv4-compatible, NAT64 and 6to4 addresses, which may end up at the embedded address
+func embeddedIPv4(ip netip.Addr) (netip.Addr, bool) {
+	if !ip.Is6() {
+		return netip.Addr{}, false
+	}
+	b := ip.As16()
+	switch {
+	case ipv4CompatiblePrefix.Contains(ip), nat64Prefix.Contains(ip):
+		return netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]}), true
+	case sixToFourPrefix.Contains(ip):
+		return netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]}), true
+	}
+	return netip.Addr{}, false
+}
+
+// parseIPLiteral parses IP addresses including IPv6 zones and brackets and the legacy IPv4 forms of inet_aton
+func parseIPLiteral(host string) (netip.Addr, bool) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.WithZone("").Unmap(), true
+	}
+	return parseLegacyIPv4(host)
+}
+
+// parseLegacyIPv4 parses the forms inet_aton accepts: one to four parts, each decimal, octal (leading 0) or hex (leading 0x),
+// the last part fills the remaining bytes ("127.1" is 127.0.0.1, "2130706433" is 127.0.0.1)
+func parseLegacyIPv4(host string) (netip.Addr, bool) {
+	parts := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(parts) == 0 || len(parts) > 4 {
+		return netip.Addr{}, false
+	}
+
+	values := make([]uint64, len(parts))
+	for idx, part := range parts {
+		if part == "" {
+			return netip.Addr{}, false
+		}
+		base := 10
+		switch {
+		case strings.HasPrefix(strings.ToLower(part), "0x"):
+			base, part = 16, part[2:]
+			if part == "" {
+				part = "0"
+			}
+		case len(part) > 1 && part[0] == '0':
+			base, part = 8, part[1:]
+		}
+		value, err := strconv.ParseUint(part, base, 32)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		values[idx] = value
+	}
+
+	var ip uint64
+	for idx, value := range values[:len(values)-1] {
+		if value > 0xff {
+			return netip.Addr{}, false
+		}
+		ip |= value << (8 * (3 - idx))
+	}
+	last := values[len(values)-1]
+	if last >= 1<<(8*(5-len(values))) {
+		return netip.Addr{}, false
+	}
+	ip |= last
+
+	return netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}), true
+}
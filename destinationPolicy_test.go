@@ -0,0 +1,164 @@
+package socksauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDestinationPolicyEncodings(t *testing.T) {
+	policy, err := NewDestinationPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := []string{
+		"127.0.0.1",
+		"10.0.0.1",
+		"172.31.255.255",
+		"192.168.1.1",
+		"169.254.169.254",
+		"100.64.0.1",
+		"0.0.0.0",
+		"224.0.0.1",
+		"255.255.255.255",
+		"::1",
+		"[::1]",
+		"::",
+		"fd00::1",
+		"fe80::1%eth0",
+		"ff02::1",
+		"::ffff:127.0.0.1",     // IPv4-mapped
+		"::ffff:7f00:1",        // IPv4-mapped in hex
+		"::127.0.0.1",          // IPv4-compatible
+		"64:ff9b::a9fe:a9fe",   // NAT64 of 169.254.169.254
+		"2002:c0a8:101::1",     // 6to4 of 192.168.1.1
+		"2130706433",           // decimal 127.0.0.1
+		"0x7f000001",           // hex
+		"0x7f.1",               // hex with the last part filling three bytes
+		"0177.0.0.1",           // octal
+		"127.1",                // short form
+		"017700000001",         // octal without dots
+		"0xa9.0xfe.0xa9.0xfe.", // hex with a trailing dot
+		"localhost",
+	}
+	for _, host := range blocked {
+		if _, err := policy.Check(context.Background(), host); !errors.Is(err, errDestinationBlocked) {
+			t.Errorf("%s: expected to be blocked, got %v", host, err)
+		}
+	}
+
+	allowed := map[string]string{
+		"8.8.8.8":              "8.8.8.8",
+		"::ffff:8.8.8.8":       "8.8.8.8",
+		"134744072":            "8.8.8.8",
+		"2001:4860:4860::8888": "2001:4860:4860::8888",
+	}
+	for host, expected := range allowed {
+		addrs, err := policy.Check(context.Background(), host)
+		if err != nil || len(addrs) != 1 || addrs[0].String() != expected {
+			t.Errorf("%s: expected %s to be allowed, got %v: %v", host, expected, addrs, err)
+		}
+	}
+}
+
+func TestParseLegacyIPv4(t *testing.T) {
+	cases := map[string]string{
+		"1.2.3.4":    "1.2.3.4",
+		"1.2.3":      "1.2.0.3",
+		"1.65535":    "1.0.255.255",
+		"0x1.0x2":    "1.0.0.2",
+		"010.010":    "8.0.0.8",
+		"4294967295": "255.255.255.255",
+	}
+	for host, expected := range cases {
+		if ip, ok := parseLegacyIPv4(host); !ok || ip.String() != expected {
+			t.Errorf("%s: expected %s, got %s", host, expected, ip)
+		}
+	}
+
+	for _, host := range []string{"example.com", "1.2.3.4.5", "256.1.1.1", "1.16777216", "4294967296", "08.1", "1..2", "0xg"} {
+		if ip, ok := parseLegacyIPv4(host); ok {
+			t.Errorf("%s: expected no address, got %s", host, ip)
+		}
+	}
+}
+
+func TestDestinationPolicyAllowlist(t *testing.T) {
+	policy, err := NewDestinationPolicy("10.1.0.0/16", "*.corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"10.1.2.3", "::ffff:10.1.2.3"} {
+		if _, err := policy.Check(context.Background(), host); err != nil {
+			t.Errorf("%s: expected the allowlist to override the block, got %v", host, err)
+		}
+	}
+	if _, err := policy.Check(context.Background(), "10.2.0.1"); !errors.Is(err, errDestinationBlocked) {
+		t.Errorf("expected other private addresses to stay blocked, got %v", err)
+	}
+	if addrs, err := policy.Check(context.Background(), "db.corp.example"); err != nil || addrs != nil {
+		t.Errorf("expected an allowed domain not to be resolved, got %v: %v", addrs, err)
+	}
+
+	if _, err := NewDestinationPolicy("*.*.example"); err == nil {
+		t.Error("expected an error for an invalid allow entry")
+	}
+}
+
+func TestDestinationPolicyThroughServer(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	router, err := NewRouter(RouterConfig{Rules: []RouteRule{{Name: "local", Domains: []string{"localhost"}, Action: RouteDirect}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan SocksError, 2)
+	_, proxyAddr := startTestServer(t, upstream.Addr, "user", "pass", WithRouter(router), WithDestinationPolicy(defaultDestinationPolicy),
+		WithOnError(func(id int64, conn net.Conn, err SocksError) { errs <- err }))
+
+	_, port, _ := net.SplitHostPort(echoAddr)
+	for _, destination := range []string{echoAddr, net.JoinHostPort("localhost", port)} {
+		if _, err := dialSocks(proxyAddr, destination, "", ""); err != socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+			t.Errorf("%s: expected a ruleset reply, got %v", destination, err)
+		}
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrDestinationBlocked) || !errors.Is(err, ErrConnectionNotAllowed) {
+				t.Errorf("%s: expected a blocked destination error, got %v", destination, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected an error")
+		}
+	}
+	if len(upstream.Destinations()) != 0 {
+		t.Errorf("expected no request to reach the upstream, got %v", upstream.Destinations())
+	}
+
+	// a domain through an upstream is resolved and checked as well
+	_, proxyAddr = startTestServer(t, upstream.Addr, "user", "pass", WithDestinationPolicy(defaultDestinationPolicy))
+	if _, err := dialSocks(proxyAddr, net.JoinHostPort("localhost", port), "", ""); err != socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+		t.Errorf("expected localhost through the upstream to be blocked, got %v", err)
+	}
+
+	// unless the upstream is trusted to resolve it, IP literals are checked still
+	upstreamResolves, _ := NewDestinationPolicy()
+	upstreamResolves.UpstreamResolves = true
+	_, proxyAddr = startTestServer(t, upstream.Addr, "user", "pass", WithDestinationPolicy(upstreamResolves))
+	conn, err := dialSocks(proxyAddr, net.JoinHostPort("localhost", port), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); err != socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+		t.Errorf("expected the IP literal to be blocked, got %v", err)
+	}
+	if got := upstream.Destinations(); len(got) != 1 || got[0] != net.JoinHostPort("localhost", port) {
+		t.Errorf("expected only the domain to reach the upstream, got %v", got)
+	}
+}
@@ -27,10 +27,12 @@ type SocksError interface {
 var _ SocksError = (*socksError)(nil)
 
 type socksError struct {
-	code      string
-	err       error
-	Message   string
-	ErrOrigin string
+	code string
+	// parentCode is the code of a more general error this one is a case of
+	parentCode string
+	err        error
+	Message    string
+	ErrOrigin  string
 
 	destinationServer string
 	proxyServer       struct {
@@ -50,6 +52,18 @@ func newError(code, defaultMessage string) socksError {
 	}
 }
 
+// newSubError creates an error which is distinct, but also matches the more general parent with errors.Is
+func newSubError(parent socksError, code, defaultMessage string) socksError {
+	_, file, line, _ := runtime.Caller(1)
+
+	return socksError{
+		code:       code,
+		parentCode: parent.code,
+		Message:    defaultMessage,
+		ErrOrigin:  fmt.Sprintf("%s:%d", file, line),
+	}
+}
+
 func (e socksError) Error() string {
 	connInfos := make([]string, 0)
 	if e.connectionId != 0 {
@@ -79,7 +93,7 @@ func (e socksError) Is(target error) bool {
 	if !ok {
 		return false
 	}
-	return e.code == t.code
+	return e.code == t.code || (e.parentCode != "" && e.parentCode == t.code)
 }
 
 func (e socksError) Unwrap() error {
@@ -9,6 +9,8 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -111,43 +113,191 @@ type nordIPDetails struct {
 	Version int    `json:"version"`
 }
 
-var servers []nordServer
+const (
+	// NordVpnApiUrl is the base URL of the (undocumented) NordVPN API
+	NordVpnApiUrl = "https://api.nordvpn.com"
+
+	defaultUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:86.0) Gecko/20100101 Firefox/86.0" // they dont have to know
+)
+
+// NordVpnFinder finds SOCKS5 servers using the NordVPN server list API
+type NordVpnFinder struct {
+	baseUrl   string
+	client    *http.Client
+	userAgent string
+
+	mu sync.Mutex
+	// servers is replaced instead of changed, so a copy can be used without the lock
+	servers []nordServer
+	// fetching is closed once the running fetch of the list is done, it is nil if none runs
+	fetching chan struct{}
+}
+
+// nordVpnTimeout is the timeout of the default client of a NordVpnFinder
+const nordVpnTimeout = 30 * time.Second
+
+var (
+	_ ServerFinder = (*NordVpnFinder)(nil)
+	_ Warmer       = (*NordVpnFinder)(nil)
+
+	defaultNordVpnFinder = NewNordVpnFinder("", nil, "")
+)
+
+// NewNordVpnFinder creates a finder which queries the server list at baseUrl
+// If baseUrl is empty NordVpnApiUrl is used, if client is nil a client with a 30 second timeout is used and if userAgent is empty a browser user agent is sent
+func NewNordVpnFinder(baseUrl string, client *http.Client, userAgent string) *NordVpnFinder {
+	if baseUrl == "" {
+		baseUrl = NordVpnApiUrl
+	}
+	if client == nil {
+		client = &http.Client{Timeout: nordVpnTimeout}
+	}
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	return &NordVpnFinder{
+		baseUrl:   strings.TrimSuffix(baseUrl, "/"),
+		client:    client,
+		userAgent: userAgent,
+	}
+}
 
 // FindNordVpnServer finds a socks server from the (undocumented) NordVPN API
 func FindNordVpnServer(ctx context.Context) (host string, err error) {
-	// since this operation is kinda slow, we ant to use a very simple cache
-	if len(servers) == 0 {
-		servers, err = findNordVpnServers(ctx)
-		if err != nil {
-			return "", err
-		}
+	upstream, err := defaultNordVpnFinder.Find(ctx, Request{})
+	return upstream.Addr, err
+}
+
+// Warmup fetches the server list, so the first connection does not have to wait for it
+func (f *NordVpnFinder) Warmup(ctx context.Context) error {
+	_, err := f.loadServers(ctx)
+	return err
+}
+
+// Find returns a random reachable SOCKS5 server in the country and city of the request's routing hints
+func (f *NordVpnFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	servers, err := f.loadServers(ctx)
+	if err != nil {
+		return Upstream{}, err
 	}
 
-	for {
-		if len(servers) == 0 {
-			return "", fmt.Errorf("no socks server found")
+	candidates := make([]nordServer, 0, len(servers))
+	for _, server := range servers {
+		if server.matchesHints(req.Hints) {
+			candidates = append(candidates, server)
 		}
+	}
 
+	for len(candidates) > 0 {
 		// choose a random server
-		randIdx := rand.Intn(len(servers))
-		chosenAddr := servers[randIdx].Hostname + ":1080"
+		randIdx := rand.Intn(len(candidates))
+		chosen := candidates[randIdx]
+		chosenAddr := chosen.Hostname + ":1080"
 
-		// check if the server is reachable
+		// check if the server is reachable, without holding the lock
 		conn, err := net.DialTimeout("tcp", chosenAddr, time.Second)
 		if err == nil {
 			conn.Close()
-			return chosenAddr, nil
+			upstream := Upstream{Addr: chosenAddr}
+			if len(chosen.Locations) > 0 {
+				upstream.Country = strings.ToLower(chosen.Locations[0].Country.Code)
+				upstream.City = strings.ToLower(chosen.Locations[0].Country.City.Name)
+			}
+			return upstream, nil
 		}
 
 		// remove the server from the list
-		servers = removeAtIndexNoOrder(servers, randIdx)
-		continue
+		f.remove(chosenAddr)
+		candidates = removeAtIndexNoOrder(candidates, randIdx)
+	}
+	return Upstream{}, fmt.Errorf("no socks server found")
+}
+
+func (f *NordVpnFinder) ReportSuccess(upstream Upstream) {}
+
+// ReportFailure removes the server from the cached list, it will come back once the list is fetched again
+func (f *NordVpnFinder) ReportFailure(upstream Upstream, err SocksError) {
+	f.remove(upstream.Addr)
+}
+
+// remove drops the server with the address from the cached list
+func (f *NordVpnFinder) remove(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	servers := make([]nordServer, 0, len(f.servers))
+	for _, server := range f.servers {
+		if server.Hostname+":1080" != addr {
+			servers = append(servers, server)
+		}
+	}
+	f.servers = servers
+}
+
+// matchesHints checks if the server is in the country (by ISO code) and city (by name or dns name) of the hints
+func (server nordServer) matchesHints(hints RoutingHints) bool {
+	if hints.Country == "" && hints.City == "" {
+		return true
+	}
+
+	for _, location := range server.Locations {
+		if hints.Country != "" && !strings.EqualFold(location.Country.Code, hints.Country) {
+			continue
+		}
+		if hints.City != "" && !strings.EqualFold(location.Country.City.Name, hints.City) && !strings.EqualFold(location.Country.City.DnsName, hints.City) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// loadServers returns the cached servers and fetches them if the cache is empty.
+// The lock is not held while fetching, only one fetch runs at a time and the other callers wait for it
+func (f *NordVpnFinder) loadServers(ctx context.Context) ([]nordServer, error) {
+	for {
+		f.mu.Lock()
+		// since this operation is kinda slow, we want to use a very simple cache
+		if len(f.servers) > 0 {
+			servers := f.servers
+			f.mu.Unlock()
+			return servers, nil
+		}
+		if f.fetching == nil {
+			done := make(chan struct{})
+			f.fetching = done
+			f.mu.Unlock()
+
+			servers, err := f.findServers(ctx)
+			f.mu.Lock()
+			if err == nil {
+				f.servers = servers
+			}
+			f.fetching = nil
+			close(done)
+			f.mu.Unlock()
+			return servers, err
+		}
+		fetching := f.fetching
+		f.mu.Unlock()
+
+		// a failed fetch is tried again by the next caller
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 }
 
 func findNordVpnServers(ctx context.Context) ([]nordServer, error) {
-	url := "https://api.nordvpn.com/v1/servers?limit=0"
-	servers, err := fetchJson[[]nordServer](ctx, url)
+	return defaultNordVpnFinder.findServers(ctx)
+}
+
+func (f *NordVpnFinder) findServers(ctx context.Context) ([]nordServer, error) {
+	url := f.baseUrl + "/v1/servers?limit=0"
+	servers, err := fetchJson[[]nordServer](ctx, f.client, url, f.userAgent)
 	if err != nil {
 		return nil, err
 	}
@@ -173,8 +323,8 @@ func findNordVpnServers(ctx context.Context) ([]nordServer, error) {
 	return socks5Servers, nil
 }
 
-func fetchJson[T any](ctx context.Context, url string) (defaultVal T, err error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func fetchJson[T any](ctx context.Context, client *http.Client, url, userAgent string) (defaultVal T, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return defaultVal, err
 	}
@@ -182,17 +332,8 @@ func fetchJson[T any](ctx context.Context, url string) (defaultVal T, err error)
 	// Add headers
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Accept-Encoding", "gzip")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:86.0) Gecko/20100101 Firefox/86.0") // they dont have to know
+	req.Header.Set("User-Agent", userAgent)
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return defaultVal, err
-	}
-
-	req = req.WithContext(ctx)
-	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:86.0) Gecko/20100101 Firefox/86.0")
-
-	client := http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return defaultVal, err
@@ -204,15 +345,15 @@ func fetchJson[T any](ctx context.Context, url string) (defaultVal T, err error)
 	}
 
 	var reader io.ReadCloser
-	switch res.Header.Get("Content-Encoding") {
+	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
-		reader, err = gzip.NewReader(res.Body)
-		defer reader.Close()
+		reader, err = gzip.NewReader(resp.Body)
 		if err != nil {
 			return defaultVal, fmt.Errorf("could not decode gzip body: %w", err)
 		}
+		defer reader.Close()
 	default:
-		reader = res.Body
+		reader = resp.Body
 	}
 
 	var data T
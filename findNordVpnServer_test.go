@@ -1,12 +1,16 @@
 package socksauth
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -42,6 +46,117 @@ func TestFindNordVpnServers(t *testing.T) {
 	}
 }
 
+func TestNordVpnFinderWithStandInApi(t *testing.T) {
+	socksTech := nordTechnology{ID: 7, Pivot: nordPivot{Status: "online"}}
+	apiServers := []nordServer{
+		{Hostname: "good.example", Status: "online", Load: 10, Technologies: []nordTechnology{socksTech}},
+		{Hostname: "offline.example", Status: "offline", Load: 10, Technologies: []nordTechnology{socksTech}},
+		{Hostname: "busy.example", Status: "online", Load: 95, Technologies: []nordTechnology{socksTech}},
+		{Hostname: "nosocks.example", Status: "online", Load: 10, Technologies: []nordTechnology{{ID: 3, Pivot: nordPivot{Status: "online"}}}},
+	}
+
+	var requests atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/v1/servers" || r.URL.Query().Get("limit") != "0" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		if r.Header.Get("User-Agent") != "socksauth-test" {
+			t.Errorf("unexpected user agent: %s", r.Header.Get("User-Agent"))
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		json.NewEncoder(gz).Encode(apiServers)
+	}))
+	defer api.Close()
+
+	finder := NewNordVpnFinder(api.URL, api.Client(), "socksauth-test")
+	servers, err := finder.findServers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected 1 request to the api, got %d", requests.Load())
+	}
+	if len(servers) != 1 || servers[0].Hostname != "good.example" {
+		t.Errorf("expected only good.example, got %v", servers)
+	}
+}
+
+func TestNordServerMatchesHints(t *testing.T) {
+	server := nordServer{Locations: []nordLocation{{Country: nordCountry{Code: "DE", City: nordCity{Name: "Frankfurt", DnsName: "frankfurt"}}}}}
+
+	matching := []RoutingHints{{}, {Country: "de"}, {Country: "de", City: "frankfurt"}, {City: "Frankfurt"}}
+	for _, hints := range matching {
+		if !server.matchesHints(hints) {
+			t.Errorf("expected %+v to match", hints)
+		}
+	}
+	for _, hints := range []RoutingHints{{Country: "us"}, {Country: "de", City: "berlin"}} {
+		if server.matchesHints(hints) {
+			t.Errorf("expected %+v not to match", hints)
+		}
+	}
+}
+
+func TestNordVpnFinderUnexpectedStatus(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer api.Close()
+
+	finder := NewNordVpnFinder(api.URL, api.Client(), "")
+	if _, err := finder.Find(context.Background(), Request{}); err == nil {
+		t.Error("expected an error for a non 200 response")
+	}
+}
+
+func TestNordVpnFinderFetchesUnlocked(t *testing.T) {
+	socksTech := nordTechnology{ID: 7, Pivot: nordPivot{Status: "online"}}
+	release := make(chan struct{})
+	var requests atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		json.NewEncoder(w).Encode([]nordServer{{Hostname: "127.0.0.1", Status: "online", Technologies: []nordTechnology{socksTech}}})
+	}))
+	defer api.Close()
+
+	finder := NewNordVpnFinder(api.URL, api.Client(), "")
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := finder.loadServers(context.Background())
+			errs <- err
+		}()
+	}
+	waitFor(t, func() bool { return requests.Load() == 1 })
+
+	// the lock is free while the list is fetched
+	reported := make(chan struct{})
+	go func() {
+		finder.ReportFailure(Upstream{Addr: "127.0.0.1:1080"}, nil)
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("expected ReportFailure not to wait for the fetch")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected concurrent loads to share 1 request, got %d", requests.Load())
+	}
+}
+
 func startProxy(ctx context.Context, user, password string, opts ...ServerOption) string {
 	server := NewServer("", user, password, opts...)
 	go server.Start(ctx)
@@ -5,8 +5,12 @@ go 1.21.7
 toolchain go1.22.2
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/chromedp/chromedp v0.9.5
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/net v0.20.0
+	golang.org/x/term v0.16.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,291 @@
+package socksauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockUpstream is a minimal SOCKS5 server with username/password authentication, it connects directly to the requested destination
+type mockUpstream struct {
+	Addr string
+
+	user, pass string
+
+	Auths        atomic.Int32
+	FailedAuths  atomic.Int32
+	mu           sync.Mutex
+	destinations []string
+}
+
+func startMockUpstream(t *testing.T, user, pass string) *mockUpstream {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	m := &mockUpstream{Addr: l.Addr().String(), user: user, pass: pass}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *mockUpstream) Destinations() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.destinations...)
+}
+
+func (m *mockUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if !contains(methods, _USERNAME_PASSWORD_AUTH) {
+		conn.Write([]byte{_SOCKS_VERSION, _NO_ACCEPTABLE_METHODS})
+		return
+	}
+	conn.Write([]byte{_SOCKS_VERSION, _USERNAME_PASSWORD_AUTH})
+
+	user, pass, err := readUsernamePassword(conn)
+	if err != nil {
+		return
+	}
+	m.Auths.Add(1)
+	if user != m.user || pass != m.pass {
+		m.FailedAuths.Add(1)
+		conn.Write([]byte{0x01, 0x01})
+		return
+	}
+	conn.Write([]byte{0x01, _STATUS_OK})
+
+	_, host, port, err := readSocks5Request(conn)
+	if err != nil {
+		return
+	}
+	destination := net.JoinHostPort(host, fmt.Sprint(port))
+	m.mu.Lock()
+	m.destinations = append(m.destinations, destination)
+	m.mu.Unlock()
+
+	destConn, err := net.DialTimeout("tcp", destination, time.Second)
+	if err != nil {
+		conn.Write([]byte{_SOCKS_VERSION, _HOST_UNREACHABLE, 0x00, _IP_V4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer destConn.Close()
+	conn.Write([]byte{_SOCKS_VERSION, _STATUS_OK, 0x00, _IP_V4, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(destConn, conn)
+	io.Copy(conn, destConn)
+}
+
+// startEchoServer starts a TCP server which writes back everything it reads
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startTestServer starts a socksauth server on a random local port and returns its host:port, loopback destinations are allowed
+func startTestServer(t *testing.T, remoteHost, user, pass string, opts ...ServerOption) (*Server, string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// the test destinations are local, so they are allowed unless a test sets its own policy
+	loopback, err := NewDestinationPolicy("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]ServerOption{WithAddr("127.0.0.1:0"), WithDestinationPolicy(loopback)}, opts...)
+	server := NewServer(remoteHost, user, pass, opts...)
+	return server, startServer(t, ctx, server)
+}
+
+// startServer starts the server and returns its address once it listens
+func startServer(t *testing.T, ctx context.Context, server *Server) string {
+	t.Helper()
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- server.Start(ctx) }()
+	select {
+	case <-server.Ready():
+	case err := <-errChan:
+		t.Fatalf("server did not start: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("server did not start")
+	}
+
+	addr, ok := strings.CutPrefix(server.Addr, "socks5://")
+	if !ok {
+		t.Fatalf("expected a TCP address, got %s", server.Addr)
+	}
+	return addr
+}
+
+// dialSocks connects to destination through the SOCKS5 proxy at proxyAddr, credentials are only sent if user is not empty.
+// proxyAddr is a TCP address or a unix socket like "unix:///tmp/socksauth.sock"
+func dialSocks(proxyAddr, destination, user, pass string) (net.Conn, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(proxyAddr, unixScheme); ok {
+		network, proxyAddr = "unix", path
+	}
+	conn, err := net.DialTimeout(network, proxyAddr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return socksConnect(conn, destination, user, pass)
+}
+
+// socksConnect does the SOCKS5 handshake on a connection to a proxy, e.g. a TLS connection
+func socksConnect(conn net.Conn, destination, user, pass string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	method := byte(_NO_AUTHENTICATION)
+	if user != "" {
+		method = _USERNAME_PASSWORD_AUTH
+	}
+	if _, err := conn.Write([]byte{_SOCKS_VERSION, 0x01, method}); err != nil {
+		return fail(err)
+	}
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return fail(err)
+	}
+	if response[1] != method {
+		return fail(fmt.Errorf("proxy selected method %d", response[1]))
+	}
+
+	if user != "" {
+		auth := append([]byte{0x01, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return fail(err)
+		}
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return fail(err)
+		}
+		if response[1] != _STATUS_OK {
+			return fail(errAuthRejectedByProxy)
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return fail(err)
+	}
+	var port int
+	fmt.Sscanf(portStr, "%d", &port)
+
+	request := []byte{_SOCKS_VERSION, _CONNECT, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, _IP_V4), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, _IP_V6), ip.To16()...)
+	} else {
+		request = append(append(request, _DOMAIN_NAME, byte(len(host))), host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return fail(err)
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fail(err)
+	}
+	if reply[1] != _STATUS_OK {
+		return fail(socksReplyError(reply[1]))
+	}
+	addrLen := net.IPv4len
+	switch reply[3] {
+	case _IP_V6:
+		addrLen = net.IPv6len
+	case _DOMAIN_NAME:
+		lengthByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lengthByte); err != nil {
+			return fail(err)
+		}
+		addrLen = int(lengthByte[0])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return fail(err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+var errAuthRejectedByProxy = errors.New("proxy rejected the credentials")
+
+type socksReplyError byte
+
+func (e socksReplyError) Error() string { return fmt.Sprintf("proxy replied with %d", byte(e)) }
+
+// assertEcho sends a message over conn and checks that it comes back
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	message := []byte("hello through the proxy")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != string(message) {
+		t.Fatalf("expected %q, got %q", message, echo)
+	}
+}
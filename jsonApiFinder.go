@@ -0,0 +1,439 @@
+package socksauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JsonApiConfig describes how a vendor's JSON server list is mapped to upstreams, so a new vendor needs config rather than code.
+// Paths are dot separated object keys and array indexes, "*" stands for every element of an array (e.g. "locations.0.country.code").
+type JsonApiConfig struct {
+	Url string `json:"url" yaml:"url"`
+	// Items is the path to the list of servers in the response, empty if the response is the list
+	Items  string        `json:"items,omitempty" yaml:"items,omitempty"`
+	Fields JsonApiFields `json:"fields" yaml:"fields"`
+	// DefaultPort is used if there is no port field or a server has no port, default is 1080
+	DefaultPort int `json:"defaultPort,omitempty" yaml:"defaultPort,omitempty"`
+	// Filters a server has to match all of to be used
+	Filters []JsonApiFilter `json:"filters,omitempty" yaml:"filters,omitempty"`
+	// RefreshInterval is how often the list is fetched again, default is 1 hour. In JSON it is a duration string like "30m"
+	RefreshInterval time.Duration `json:"refreshInterval,omitempty" yaml:"refreshInterval,omitempty"`
+}
+
+// UnmarshalJSON reads the refresh interval as a duration string like "30m", a number is taken as nanoseconds
+func (c *JsonApiConfig) UnmarshalJSON(data []byte) error {
+	type plain JsonApiConfig
+	config := struct {
+		*plain
+		RefreshInterval any `json:"refreshInterval,omitempty"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	switch interval := config.RefreshInterval.(type) {
+	case nil:
+	case string:
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return fmt.Errorf("invalid refreshInterval: %w", err)
+		}
+		c.RefreshInterval = d
+	case float64:
+		c.RefreshInterval = time.Duration(interval)
+	default:
+		return fmt.Errorf("invalid refreshInterval %v", interval)
+	}
+	return nil
+}
+
+// JsonApiFields are the paths of the upstream's fields within a server object, only Host is required
+type JsonApiFields struct {
+	Host    string `json:"host" yaml:"host"`
+	Port    string `json:"port,omitempty" yaml:"port,omitempty"`
+	Country string `json:"country,omitempty" yaml:"country,omitempty"`
+	City    string `json:"city,omitempty" yaml:"city,omitempty"`
+	// Load in percent, less loaded servers are chosen more often
+	Load string `json:"load,omitempty" yaml:"load,omitempty"`
+	// Online is the path of the online status, servers whose status is not OnlineValue (default "online") or true are skipped
+	Online      string `json:"online,omitempty" yaml:"online,omitempty"`
+	OnlineValue string `json:"onlineValue,omitempty" yaml:"onlineValue,omitempty"`
+}
+
+// JsonApiFilter compares the values at a path with Value using Op (eq, ne, lt, lte, gt, gte), it matches if any value does.
+// With Any set the path has to point to a list instead and the filter matches if any element matches all of the Any filters,
+// whose paths are relative to the element.
+type JsonApiFilter struct {
+	Path  string          `json:"path" yaml:"path"`
+	Op    string          `json:"op,omitempty" yaml:"op,omitempty"`
+	Value any             `json:"value,omitempty" yaml:"value,omitempty"`
+	Any   []JsonApiFilter `json:"any,omitempty" yaml:"any,omitempty"`
+}
+
+// NordVpnJsonApiConfig maps the NordVPN server list the same way the NordVpnFinder filters it
+var NordVpnJsonApiConfig = JsonApiConfig{
+	Url: NordVpnApiUrl + "/v1/servers?limit=0",
+	Fields: JsonApiFields{
+		Host:    "hostname",
+		Country: "locations.0.country.code",
+		City:    "locations.0.country.city.name",
+		Load:    "load",
+		Online:  "status",
+	},
+	Filters: []JsonApiFilter{
+		{Path: "load", Op: "lte", Value: 80},
+		{Path: "technologies", Any: []JsonApiFilter{
+			{Path: "id", Op: "eq", Value: 7},
+			{Path: "pivot.status", Op: "eq", Value: "online"},
+		}},
+	},
+}
+
+// JsonApiFinder chooses upstreams from a server list fetched from a JSON API
+type JsonApiFinder struct {
+	config    JsonApiConfig
+	client    *http.Client
+	userAgent string
+
+	pool *upstreamPool
+
+	mu        sync.Mutex
+	fetchedAt time.Time
+	// retryAt delays the next fetch after a failed one
+	retryAt  time.Time
+	fetching chan struct{}
+	fetchErr error
+}
+
+const (
+	jsonApiTimeout       = 30 * time.Second
+	jsonApiRetryInterval = 30 * time.Second
+)
+
+var (
+	_ ServerFinder = (*JsonApiFinder)(nil)
+	_ Warmer       = (*JsonApiFinder)(nil)
+)
+
+// NewJsonApiFinder validates the config and creates the finder, the list is fetched with the first Find or Warmup
+// If client is nil a client with a 30 second timeout is used and if userAgent is empty a browser user agent is sent
+func NewJsonApiFinder(config JsonApiConfig, client *http.Client, userAgent string) (*JsonApiFinder, error) {
+	if config.Url == "" {
+		return nil, fmt.Errorf("json api finder needs an url")
+	}
+	if config.Fields.Host == "" {
+		return nil, fmt.Errorf("json api finder needs a host field")
+	}
+	if err := validateJsonApiFilters(config.Filters); err != nil {
+		return nil, err
+	}
+	if config.DefaultPort == 0 {
+		config.DefaultPort = 1080
+	}
+	if config.Fields.OnlineValue == "" {
+		config.Fields.OnlineValue = "online"
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = time.Hour
+	}
+	if client == nil {
+		client = &http.Client{Timeout: jsonApiTimeout}
+	}
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	return &JsonApiFinder{
+		config:    config,
+		client:    client,
+		userAgent: userAgent,
+		pool:      newUpstreamPool(10 * time.Minute),
+	}, nil
+}
+
+func validateJsonApiFilters(filters []JsonApiFilter) error {
+	for _, filter := range filters {
+		if filter.Path == "" {
+			return fmt.Errorf("json api filter needs a path")
+		}
+		if len(filter.Any) > 0 {
+			if filter.Op != "" {
+				return fmt.Errorf("json api filter on %s can not have an op and any", filter.Path)
+			}
+			if err := validateJsonApiFilters(filter.Any); err != nil {
+				return err
+			}
+			continue
+		}
+		if !contains([]string{"eq", "ne", "lt", "lte", "gt", "gte"}, filter.Op) {
+			return fmt.Errorf("json api filter on %s has unknown op %q", filter.Path, filter.Op)
+		}
+	}
+	return nil
+}
+
+// Warmup fetches the server list
+func (f *JsonApiFinder) Warmup(ctx context.Context) error {
+	return f.refresh(ctx)
+}
+
+// Find returns a random upstream in the country and city of the request's routing hints, less loaded servers are preferred
+func (f *JsonApiFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	if err := f.refresh(ctx); err != nil {
+		return Upstream{}, err
+	}
+	return f.pool.pick(req.Hints, nil)
+}
+
+func (f *JsonApiFinder) ReportSuccess(upstream Upstream) {
+	f.pool.recover(upstream)
+}
+
+// ReportFailure sets the upstream aside for ten minutes
+func (f *JsonApiFinder) ReportFailure(upstream Upstream, err SocksError) {
+	f.pool.demote(upstream)
+}
+
+// Upstreams returns the upstreams of the last fetched list
+func (f *JsonApiFinder) Upstreams() []Upstream {
+	return f.pool.all()
+}
+
+// refresh starts fetching the list if it is older than the refresh interval, only one fetch runs at a time.
+// A previously fetched list is used while a new one is fetched or if fetching fails, without a list refresh waits for the fetch.
+// After a failed fetch the next one is delayed by 30 seconds or the refresh interval if that is shorter.
+func (f *JsonApiFinder) refresh(ctx context.Context) error {
+	f.mu.Lock()
+	now := time.Now()
+	stale := f.fetchedAt.IsZero() || now.Sub(f.fetchedAt) >= f.config.RefreshInterval
+	if stale && f.fetching == nil && !now.Before(f.retryAt) {
+		f.fetching = make(chan struct{})
+		go f.fetchList(f.fetching)
+	}
+	fetching, fetched, err := f.fetching, !f.fetchedAt.IsZero(), f.fetchErr
+	f.mu.Unlock()
+
+	if fetched {
+		return nil
+	}
+	if fetching == nil {
+		return err
+	}
+	select {
+	case <-fetching:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fetchedAt.IsZero() {
+		return f.fetchErr
+	}
+	return nil
+}
+
+// fetchList fetches the list into the pool and closes done, it does not depend on a caller's context as callers share the fetch
+func (f *JsonApiFinder) fetchList(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), jsonApiTimeout)
+	defer cancel()
+	upstreams, err := f.fetch(ctx)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer close(done)
+	f.fetching = nil
+	f.fetchErr = err
+	if err != nil {
+		f.retryAt = time.Now().Add(min(jsonApiRetryInterval, f.config.RefreshInterval))
+		return
+	}
+	f.pool.set(upstreams)
+	f.fetchedAt = time.Now()
+}
+
+func (f *JsonApiFinder) fetch(ctx context.Context) ([]Upstream, error) {
+	response, err := fetchJson[any](ctx, f.client, f.config.Url, f.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	items := jsonPathValues(response, f.config.Items)
+	if len(items) != 1 {
+		return nil, fmt.Errorf("no server list at %q", f.config.Items)
+	}
+	servers, ok := items[0].([]any)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a list", f.config.Items)
+	}
+
+	upstreams := make([]Upstream, 0)
+	for _, server := range servers {
+		upstream, ok := f.toUpstream(server)
+		if ok {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	return upstreams, nil
+}
+
+// toUpstream maps a server object to an upstream, it returns false if the server is offline, does not match the filters or has no host
+func (f *JsonApiFinder) toUpstream(server any) (Upstream, bool) {
+	fields := f.config.Fields
+
+	if fields.Online != "" {
+		online, ok := jsonPathFirst(server, fields.Online)
+		if !ok || !(online == true || fmt.Sprint(online) == fields.OnlineValue) {
+			return Upstream{}, false
+		}
+	}
+	for _, filter := range f.config.Filters {
+		if !filter.matches(server) {
+			return Upstream{}, false
+		}
+	}
+
+	host, ok := jsonPathFirst(server, fields.Host)
+	if !ok || fmt.Sprint(host) == "" {
+		return Upstream{}, false
+	}
+	upstream := Upstream{Addr: fmt.Sprint(host)}
+	if _, _, err := net.SplitHostPort(upstream.Addr); err != nil {
+		port := strconv.Itoa(f.config.DefaultPort)
+		if value, ok := jsonPathFirst(server, fields.Port); ok && fields.Port != "" {
+			port = fmt.Sprint(value)
+		}
+		upstream.Addr = net.JoinHostPort(upstream.Addr, port)
+	}
+
+	if value, ok := jsonPathFirst(server, fields.Country); ok && fields.Country != "" {
+		upstream.Country = strings.ToLower(fmt.Sprint(value))
+	}
+	if value, ok := jsonPathFirst(server, fields.City); ok && fields.City != "" {
+		upstream.City = strings.ToLower(fmt.Sprint(value))
+	}
+	if value, ok := jsonPathFirst(server, fields.Load); ok && fields.Load != "" {
+		if load, ok := toFloat(value); ok {
+			upstream.Weight = max(100-int(load), 1)
+		}
+	}
+
+	return upstream, true
+}
+
+func (filter JsonApiFilter) matches(data any) bool {
+	values := jsonPathValues(data, filter.Path)
+
+	if len(filter.Any) > 0 {
+		for _, value := range values {
+			elements, ok := value.([]any)
+			if !ok {
+				elements = []any{value}
+			}
+			for _, element := range elements {
+				matchesAll := true
+				for _, sub := range filter.Any {
+					matchesAll = matchesAll && sub.matches(element)
+				}
+				if matchesAll {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, value := range values {
+		if compareJson(value, filter.Op, filter.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareJson(value any, op string, expected any) bool {
+	valueNum, valueIsNum := toFloat(value)
+	expectedNum, expectedIsNum := toFloat(expected)
+	numeric := valueIsNum && expectedIsNum
+
+	switch op {
+	case "eq":
+		if numeric {
+			return valueNum == expectedNum
+		}
+		return fmt.Sprint(value) == fmt.Sprint(expected)
+	case "ne":
+		if numeric {
+			return valueNum != expectedNum
+		}
+		return fmt.Sprint(value) != fmt.Sprint(expected)
+	case "lt":
+		return numeric && valueNum < expectedNum
+	case "lte":
+		return numeric && valueNum <= expectedNum
+	case "gt":
+		return numeric && valueNum > expectedNum
+	case "gte":
+		return numeric && valueNum >= expectedNum
+	}
+	return false
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// jsonPathValues returns all values at the path, an empty path is the data itself
+func jsonPathValues(data any, path string) []any {
+	values := []any{data}
+	if path == "" {
+		return values
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		next := make([]any, 0, len(values))
+		for _, value := range values {
+			switch v := value.(type) {
+			case map[string]any:
+				if child, ok := v[key]; ok {
+					next = append(next, child)
+				}
+			case []any:
+				if key == "*" {
+					next = append(next, v...)
+				} else if idx, err := strconv.Atoi(key); err == nil && idx >= 0 && idx < len(v) {
+					next = append(next, v[idx])
+				}
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func jsonPathFirst(data any, path string) (any, bool) {
+	values := jsonPathValues(data, path)
+	if len(values) == 0 || values[0] == nil {
+		return nil, false
+	}
+	return values[0], true
+}
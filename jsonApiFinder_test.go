@@ -0,0 +1,183 @@
+package socksauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const vendorServerList = `{
+	"data": {
+		"servers": [
+			{"ip": "10.0.0.1", "socks": {"port": 1081}, "usage": 10, "geo": {"cc": "DE", "town": "Berlin"}, "state": "up", "features": [{"name": "socks5", "enabled": true}]},
+			{"ip": "10.0.0.2", "socks": {"port": 1082}, "usage": 95, "geo": {"cc": "DE", "town": "Berlin"}, "state": "up", "features": [{"name": "socks5", "enabled": true}]},
+			{"ip": "10.0.0.3", "socks": {"port": 1083}, "usage": 20, "geo": {"cc": "US", "town": "Dallas"}, "state": "down", "features": [{"name": "socks5", "enabled": true}]},
+			{"ip": "10.0.0.4", "socks": {"port": 1084}, "usage": 30, "geo": {"cc": "US", "town": "Dallas"}, "state": "up", "features": [{"name": "socks5", "enabled": false}, {"name": "http", "enabled": true}]},
+			{"ip": "10.0.0.5", "usage": 40, "geo": {"cc": "US", "town": "Dallas"}, "state": "up", "features": [{"name": "socks5", "enabled": true}]}
+		]
+	}
+}`
+
+var vendorConfig = JsonApiConfig{
+	Items: "data.servers",
+	Fields: JsonApiFields{
+		Host:        "ip",
+		Port:        "socks.port",
+		Load:        "usage",
+		Country:     "geo.cc",
+		City:        "geo.town",
+		Online:      "state",
+		OnlineValue: "up",
+	},
+	DefaultPort: 9050,
+	Filters: []JsonApiFilter{
+		{Path: "usage", Op: "lt", Value: 90},
+		{Path: "features", Any: []JsonApiFilter{
+			{Path: "name", Op: "eq", Value: "socks5"},
+			{Path: "enabled", Op: "eq", Value: true},
+		}},
+	},
+}
+
+func startVendorApi(t *testing.T, body string) (string, *atomic.Int32) {
+	t.Helper()
+	requests := &atomic.Int32{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(api.Close)
+	return api.URL, requests
+}
+
+func TestJsonApiFinderMapping(t *testing.T) {
+	url, requests := startVendorApi(t, vendorServerList)
+	config := vendorConfig
+	config.Url = url
+	finder, err := NewJsonApiFinder(config, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := finder.Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams := finder.Upstreams()
+	if len(upstreams) != 2 {
+		t.Fatalf("expected 2 upstreams, got %+v", upstreams)
+	}
+	berlin, dallas := upstreams[0], upstreams[1]
+	if berlin.Addr != "10.0.0.1:1081" || berlin.Country != "de" || berlin.City != "berlin" || berlin.Weight != 90 {
+		t.Errorf("unexpected first upstream: %+v", berlin)
+	}
+	if dallas.Addr != "10.0.0.5:9050" || dallas.Country != "us" {
+		t.Errorf("expected the default port for a server without port, got %+v", dallas)
+	}
+
+	if addr := findAddr(t, finder, Request{Hints: RoutingHints{Country: "us"}}); addr != "10.0.0.5:9050" {
+		t.Errorf("expected the us upstream, got %s", addr)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected the list to be fetched once, got %d requests", requests.Load())
+	}
+}
+
+func TestJsonApiFinderNordVpnConfig(t *testing.T) {
+	url, _ := startVendorApi(t, `[
+		{"hostname": "de1.nordvpn.com", "load": 10, "status": "online", "locations": [{"country": {"code": "DE", "city": {"name": "Berlin"}}}], "technologies": [{"id": 7, "pivot": {"status": "online"}}]},
+		{"hostname": "de2.nordvpn.com", "load": 10, "status": "online", "locations": [{"country": {"code": "DE", "city": {"name": "Berlin"}}}], "technologies": [{"id": 7, "pivot": {"status": "offline"}}, {"id": 3, "pivot": {"status": "online"}}]}
+	]`)
+	config := NordVpnJsonApiConfig
+	config.Url = url
+	finder, err := NewJsonApiFinder(config, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if addr := findAddr(t, finder, Request{Hints: RoutingHints{City: "berlin"}}); addr != "de1.nordvpn.com:1080" {
+			t.Fatalf("expected only the server with an online socks technology, got %s", addr)
+		}
+	}
+}
+
+func TestJsonApiFinderInvalid(t *testing.T) {
+	configs := map[string]JsonApiConfig{
+		"no url":     {Fields: JsonApiFields{Host: "ip"}},
+		"no host":    {Url: "http://localhost"},
+		"unknown op": {Url: "http://localhost", Fields: JsonApiFields{Host: "ip"}, Filters: []JsonApiFilter{{Path: "load", Op: "like"}}},
+		"op and any": {Url: "http://localhost", Fields: JsonApiFields{Host: "ip"}, Filters: []JsonApiFilter{{Path: "x", Op: "eq", Any: []JsonApiFilter{{Path: "y", Op: "eq"}}}}},
+	}
+	for name, config := range configs {
+		if _, err := NewJsonApiFinder(config, nil, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	url, _ := startVendorApi(t, `{"data": {"servers": {}}}`)
+	config := vendorConfig
+	config.Url = url
+	finder, err := NewJsonApiFinder(config, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := finder.Find(context.Background(), Request{}); err == nil {
+		t.Error("expected an error if the items path is not a list")
+	}
+}
+
+func TestJsonPathValues(t *testing.T) {
+	data := map[string]any{
+		"a": []any{
+			map[string]any{"b": 1.0},
+			map[string]any{"b": 2.0},
+			map[string]any{"c": 3.0},
+		},
+	}
+	if values := jsonPathValues(data, "a.*.b"); len(values) != 2 || values[1] != 2.0 {
+		t.Errorf("expected both b values, got %v", values)
+	}
+	if values := jsonPathValues(data, "a.2.c"); len(values) != 1 || values[0] != 3.0 {
+		t.Errorf("expected the indexed value, got %v", values)
+	}
+	if values := jsonPathValues(data, "a.5.b"); len(values) != 0 {
+		t.Errorf("expected no value for an index out of range, got %v", values)
+	}
+}
+
+func TestJsonApiFinderRetryBackoff(t *testing.T) {
+	url, requests := startVendorApi(t, `{"data": `)
+	config := vendorConfig
+	config.Url = url
+	finder, err := NewJsonApiFinder(config, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := finder.Find(context.Background(), Request{}); err == nil {
+			t.Fatal("expected an error for a broken response")
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected the failed fetch to be retried later, got %d requests", got)
+	}
+}
+
+func TestJsonApiConfigRefreshInterval(t *testing.T) {
+	var config JsonApiConfig
+	if err := json.Unmarshal([]byte(`{"url": "http://localhost", "fields": {"host": "ip"}, "refreshInterval": "30m"}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.RefreshInterval != 30*time.Minute || config.Fields.Host != "ip" {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if err := json.Unmarshal([]byte(`{"refreshInterval": "often"}`), &config); err == nil {
+		t.Error("expected an invalid duration to fail")
+	}
+}
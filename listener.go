@@ -0,0 +1,103 @@
+package socksauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// listener is an address the server accepts connections on with its own settings, the first one is the server's Addr
+type listener struct {
+	addr string
+	// opts are applied on top of the server's options to get the settings of the listener
+	opts []ServerOption
+
+	openConnLimit uint32
+	unixSocket    UnixSocketConfig
+	tls           *TlsCertificates
+	guard         *connGuard
+	settings      atomic.Pointer[serverSettings]
+	// bound is the address the listener listens on once the server started, guarded by the server's reloadMu
+	bound string
+
+	// open is the number of open connections, lastActive the time in unix nanoseconds the last one was closed
+	open       atomic.Int32
+	lastActive atomic.Int64
+}
+
+// WithListener makes the server listen on addr as well, connections accepted there use the server's settings with opts applied on top,
+// e.g. another finder, credentials, client auth, ACL, destination policy, quotas, connection limits, unix socket permissions or TLS.
+// The callbacks, connection counters, bandwidth limits and the admin API are shared by all listeners, WithAddr and WithListener are ignored in opts.
+func WithListener(addr string, opts ...ServerOption) ServerOption {
+	return func(s *Server) { s.listeners = append(s.listeners, &listener{addr: addr, opts: opts}) }
+}
+
+// profile applies opts to a scratch server with a copy of the settings the options of s configured, the listener takes its settings from it
+func (s *Server) profile(opts []ServerOption) *Server {
+	scratch := &Server{configured: s.configured, openConnLimit: s.openConnLimit, unixSocket: s.unixSocket, tls: s.tls}
+	for _, opt := range opts {
+		opt(scratch)
+	}
+	return scratch
+}
+
+// ListenerAddrs returns the addresses of all listeners, the server's Addr first. Once the server started they are the bound ones, like "socks5://127.0.0.1:1080"
+func (s *Server) ListenerAddrs() []string {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	addrs := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		if l.bound != "" {
+			addrs = append(addrs, l.bound)
+		} else {
+			addrs = append(addrs, l.addr)
+		}
+	}
+	return addrs
+}
+
+// serve accepts the connections of the listener until the context is done
+func (s *Server) serve(ctx context.Context, l *listener, ln net.Listener) {
+	var semaphore chan struct{}
+	if l.openConnLimit > 0 {
+		semaphore = make(chan struct{}, l.openConnLimit)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if s.onError != nil {
+				err = fmt.Errorf("error accepting connection: %w", err)
+				go s.onError(0, conn, ErrEstablishClientConn.withError(err))
+			}
+			continue
+		}
+
+		// refuse sources opening connections too fast or banned ones before they take a slot
+		if allowed, reason := l.guard.allow(conn.RemoteAddr()); !allowed {
+			conn.Close()
+			if reason != "" && s.onError != nil {
+				go s.onError(0, conn, ErrRateLimited.withMessage(reason))
+			}
+			continue
+		}
+
+		// aquire semaphore
+		if semaphore != nil {
+			semaphore <- struct{}{}
+		}
+		go func() {
+			s.handleConnection(ctx, l, conn)
+			// release semaphore
+			if semaphore != nil {
+				<-semaphore
+			}
+		}()
+	}
+}
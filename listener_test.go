@@ -0,0 +1,261 @@
+package socksauth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerProfiles(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	de := startMockUpstream(t, "user", "pass")
+	us := startMockUpstream(t, "us-user", "us-pass")
+
+	direct, err := NewRouter(RouterConfig{Default: RouteRule{Action: RouteDirect}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := NewAcl(AclConfig{Destinations: []AclRule{{Action: AclDeny, Ports: []string{"22"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, proxyAddr := startTestServer(t, de.Addr, "user", "pass",
+		WithListener("127.0.0.1:0",
+			WithServerFinder(func(ctx context.Context) (string, error) { return us.Addr, nil }),
+			WithCredentialProvider(StaticCredentials(Credentials{Username: "us-user", Password: "us-pass"})),
+		),
+		WithListener("127.0.0.2:0",
+			WithRouter(direct),
+			WithAcl(acl),
+			WithClientAuth(func(username, password string) bool { return username == "alice" && password == "secret" }),
+		),
+	)
+	addrs := server.ListenerAddrs()
+	if len(addrs) != 3 || addrs[0] != server.Addr {
+		t.Fatalf("expected three listeners, the server's address first, got %v", addrs)
+	}
+	usAddr := strings.TrimPrefix(addrs[1], "socks5://")
+	directAddr := strings.TrimPrefix(addrs[2], "socks5://")
+
+	for _, addr := range []string{proxyAddr, usAddr} {
+		conn, err := dialSocks(addr, echoAddr, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+		conn.Close()
+	}
+	if len(de.Destinations()) != 1 || len(us.Destinations()) != 1 {
+		t.Errorf("expected each listener to use its own upstream, got %v and %v", de.Destinations(), us.Destinations())
+	}
+
+	if _, err := dialSocks(directAddr, echoAddr, "", ""); err == nil {
+		t.Error("expected the listener to require client auth")
+	}
+	conn, err := dialSocks(directAddr, echoAddr, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+	if len(de.Destinations())+len(us.Destinations()) != 2 {
+		t.Error("expected the listener to connect directly")
+	}
+	if _, err := dialSocks(directAddr, "127.0.0.1:22", "alice", "secret"); err != socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+		t.Errorf("expected the ACL of the listener to deny the request, got %v", err)
+	}
+	if _, err := dialSocks(proxyAddr, "127.0.0.1:22", "", ""); err == socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+		t.Error("expected the ACL of the listener not to apply to the server's address")
+	}
+
+	if count := server.ConnCount.Load(); count != 6 {
+		t.Errorf("expected the listeners to share the connection counter, got %d", count)
+	}
+
+	// a reload changes the profiles of the listeners by their address
+	loopback, _ := NewDestinationPolicy("127.0.0.1")
+	server.Reload(WithDestinationPolicy(loopback), WithListener("127.0.0.1:0", WithServerFinder(func(ctx context.Context) (string, error) { return de.Addr, nil })))
+	conn, err = dialSocks(usAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+	// the request to port 22 through the server's address went to the upstream as well
+	if len(de.Destinations()) != 3 {
+		t.Errorf("expected the reloaded listener to use the new upstream, got %v", de.Destinations())
+	}
+	if _, err := dialSocks(directAddr, echoAddr, "", ""); err != nil {
+		t.Errorf("expected a listener missing in the reload to get the server's settings, got %v", err)
+	}
+}
+
+func TestServerConfigListeners(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	de := startMockUpstream(t, "user", "pass")
+	us := startMockUpstream(t, "user", "pass")
+
+	config, err := LoadServerConfig(writeFile(t, "config.yaml", fmt.Sprintf(`
+listen: 127.0.0.1:0
+upstream:
+  host: %s
+  credentials:
+    username: user
+    password: pass
+destinations:
+  allow: [127.0.0.1]
+listeners:
+  - listen: 127.0.0.2:0
+    upstream:
+      host: %s
+`, de.Addr, us.Addr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	startServer(t, ctx, server)
+
+	conn, err := dialSocks(strings.TrimPrefix(server.ListenerAddrs()[1], "socks5://"), echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+	if len(de.Destinations()) != 0 || len(us.Destinations()) != 1 {
+		t.Errorf("expected the listener to use its upstream with the server's credentials, got %v and %v", de.Destinations(), us.Destinations())
+	}
+
+	files := map[string]string{
+		"twice.yaml":   "listen: :1080\nlisteners:\n  - listen: :1081\n  - listen: :1080\n",
+		"missing.yaml": "listeners:\n  - acl:\n      sources: []\n",
+		"acl.yaml":     "listeners:\n  - listen: :1081\n    acl:\n      destinations:\n        - action: maybe\n",
+	}
+	expected := map[string]string{
+		"twice.yaml":   "line 4: listeners[1].listen",
+		"missing.yaml": "line 2: listeners[0]",
+		"acl.yaml":     "line 3: listeners[0].acl",
+	}
+	for name, content := range files {
+		_, err := LoadServerConfig(writeFile(t, name, content))
+		if err == nil || !strings.Contains(err.Error(), expected[name]) {
+			t.Errorf("%s: expected an error naming %q, got %v", name, expected[name], err)
+		}
+	}
+}
+
+func TestServerConfigListenersSharePools(t *testing.T) {
+	static := writeFile(t, "upstreams.json", `[{"addr": "a:1080"}]`)
+	content := fmt.Sprintf(`
+listen: 127.0.0.1:0
+pools:
+  static:
+    type: static
+    file: %s
+routes:
+  rules:
+    - name: local
+      cidrs: [127.0.0.0/8]
+      pool: static
+listeners:
+  - listen: 127.0.0.2:0
+    routes:
+      rules:
+        - name: other
+          cidrs: [10.0.0.0/8]
+          pool: static
+`, static)
+	config, err := LoadServerConfig(writeFile(t, "config.yaml", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := server.listeners[0].settings.Load().router, server.listeners[1].settings.Load().router
+	if first.pools["static"] == nil || first.pools["static"] != second.pools["static"] {
+		t.Error("expected the listeners to share the pool")
+	}
+
+	os.Remove(static)
+	if _, err := config.Options(); err == nil || !strings.Contains(err.Error(), "pools.static") || strings.Contains(err.Error(), "listeners") {
+		t.Errorf("expected an error naming pools.static, got %v", err)
+	}
+}
+
+func TestServerConfigListenersInherit(t *testing.T) {
+	config, err := LoadServerConfig(writeFile(t, "config.yaml", `
+listen: 127.0.0.1:0
+upstream:
+  host: 127.0.0.1:1
+destinations:
+  allow: [127.0.0.1]
+  upstreamResolves: true
+limits:
+  connectionRate: 10
+  handshakeTimeout: 3s
+  banAfterErrors: 5
+  banWindow: 1m
+  banDuration: 10m
+listeners:
+  - listen: 127.0.0.2:0
+    limits:
+      connectionRate: 2
+  - listen: 127.0.0.3:0
+    destinations:
+      allow: [10.0.0.0/8]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, limited, restricted := server.listeners[0].settings.Load(), server.listeners[1].settings.Load(), server.listeners[2].settings.Load()
+
+	// limits are inherited by field
+	if limited.connLimits.rate != 2 || limited.connLimits.banAfter != 5 || limited.handshakeTimeout != 3*time.Second {
+		t.Errorf("expected the listener's rate with the server's other limits, got %+v and %v", limited.connLimits, limited.handshakeTimeout)
+	}
+	if limited.policy != base.policy {
+		t.Error("expected the listener without destinations to keep the server's policy")
+	}
+
+	// destinations replace the server's as a whole
+	if restricted.policy == base.policy || restricted.policy.UpstreamResolves {
+		t.Error("expected the listener's destinations to replace the server's")
+	}
+	if restricted.connLimits != base.connLimits || restricted.handshakeTimeout != base.handshakeTimeout {
+		t.Error("expected the listener without limits to keep the server's")
+	}
+}
+
+func TestStartTwice(t *testing.T) {
+	server, _ := startTestServer(t, "127.0.0.1:1", "", "")
+
+	// a second start must not close Ready again
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := server.Start(ctx); err != nil {
+		t.Errorf("expected the second start to stop with its context, got %v", err)
+	}
+
+	failing := NewServer("127.0.0.1:1", "", "", WithAddr("127.0.0.1:-1"))
+	if err := failing.Start(context.Background()); err == nil {
+		t.Fatal("expected an invalid address to fail")
+	}
+	select {
+	case <-failing.Ready():
+		t.Error("expected Ready not to be closed if Start fails")
+	default:
+	}
+}
@@ -0,0 +1,344 @@
+package socksauth
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// requestMatcher matches a request by its destination, port, source and TLS identity.
+// Within a criterion any entry has to match, across criteria all have to match, empty criteria match everything.
+type requestMatcher struct {
+	domains    []string
+	nets       []netip.Prefix
+	ports      []portRange
+	sources    []netip.Prefix
+	identities [][]dnPattern
+}
+
+type portRange struct {
+	from, to int
+}
+
+func newRequestMatcher(domains, cidrs, ports, sources, identities []string) (m requestMatcher, err error) {
+	for _, domain := range domains {
+		domain = normalizeDomain(domain)
+		if domain == "" || (domain != "*" && strings.Contains(strings.TrimPrefix(domain, "*."), "*")) {
+			return m, fmt.Errorf("invalid domain pattern %q", domain)
+		}
+		m.domains = append(m.domains, domain)
+	}
+
+	m.nets, err = parsePrefixes(cidrs)
+	if err != nil {
+		return m, err
+	}
+	m.sources, err = parsePrefixes(sources)
+	if err != nil {
+		return m, err
+	}
+
+	for _, port := range ports {
+		r, err := parsePortRange(port)
+		if err != nil {
+			return m, err
+		}
+		m.ports = append(m.ports, r)
+	}
+
+	for _, identity := range identities {
+		pattern, err := parseDnPattern(identity)
+		if err != nil {
+			return m, fmt.Errorf("invalid identity pattern %q: %w", identity, err)
+		}
+		m.identities = append(m.identities, pattern)
+	}
+
+	return m, nil
+}
+
+func (m requestMatcher) matches(req Request) bool {
+	if (len(m.domains) > 0 || len(m.nets) > 0) && !m.matchesDestination(req.DestHost) {
+		return false
+	}
+
+	if len(m.ports) > 0 && !slices.ContainsFunc(m.ports, func(r portRange) bool { return req.DestPort >= r.from && req.DestPort <= r.to }) {
+		return false
+	}
+
+	if len(m.sources) > 0 {
+		ip, ok := addrIP(req.ClientAddr)
+		if !ok || !slices.ContainsFunc(m.sources, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+			return false
+		}
+	}
+
+	if len(m.identities) > 0 && !m.matchesIdentity(req.Identity) {
+		return false
+	}
+
+	return true
+}
+
+// matchesIdentity matches the subject of a client certificate against patterns like "CN=alice,O=Example" or "CN=*,O=Example"
+func (m requestMatcher) matchesIdentity(identity string) bool {
+	if identity == "" {
+		return false
+	}
+	subject, err := parseDn(identity)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(m.identities, func(pattern []dnPattern) bool { return matchDn(pattern, subject) })
+}
+
+// dnAttribute is an attribute of a distinguished name like "CN=alice", parts is the value split at unescaped "*"
+type dnAttribute struct {
+	typ   string
+	value string
+	parts []string
+}
+
+// dnPattern matches a relative distinguished name, with any set it matches any number of them
+type dnPattern struct {
+	attributes []dnAttribute
+	any        bool
+}
+
+// parseDn parses a distinguished name in the RFC 2253 form of pkix.Name.String into its relative distinguished names
+func parseDn(dn string) ([][]dnAttribute, error) {
+	var rdns [][]dnAttribute
+	for _, rdn := range splitEscaped(dn, ',') {
+		var attributes []dnAttribute
+		for _, attribute := range splitEscaped(rdn, '+') {
+			typ, value, ok := strings.Cut(attribute, "=")
+			typ = strings.TrimSpace(typ)
+			if !ok || typ == "" {
+				return nil, fmt.Errorf("%q is no attribute like CN=name", attribute)
+			}
+			parts, err := unescapeDnValue(value)
+			if err != nil {
+				return nil, err
+			}
+			attributes = append(attributes, dnAttribute{typ: strings.ToUpper(typ), value: strings.Join(parts, "*"), parts: parts})
+		}
+		rdns = append(rdns, attributes)
+	}
+	return rdns, nil
+}
+
+// parseDnPattern parses a distinguished name whose values may contain "*" matching any characters within the value,
+// a "*" in place of a relative distinguished name matches any number of them. An escaped "\*" is a literal star
+func parseDnPattern(pattern string) ([]dnPattern, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	var patterns []dnPattern
+	var names []string
+	flush := func() error {
+		if len(names) == 0 {
+			return nil
+		}
+		rdns, err := parseDn(strings.Join(names, ","))
+		for _, rdn := range rdns {
+			patterns = append(patterns, dnPattern{attributes: rdn})
+		}
+		names = nil
+		return err
+	}
+	for _, rdn := range splitEscaped(pattern, ',') {
+		if strings.TrimSpace(rdn) != "*" {
+			names = append(names, rdn)
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, dnPattern{any: true})
+	}
+	return patterns, flush()
+}
+
+// matchDn matches the relative distinguished names of a subject in order
+func matchDn(patterns []dnPattern, subject [][]dnAttribute) bool {
+	if len(patterns) == 0 {
+		return len(subject) == 0
+	}
+	if patterns[0].any {
+		for skip := 0; skip <= len(subject); skip++ {
+			if matchDn(patterns[1:], subject[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(subject) == 0 || len(subject[0]) != len(patterns[0].attributes) {
+		return false
+	}
+	for idx, attribute := range patterns[0].attributes {
+		if subject[0][idx].typ != attribute.typ || !matchWildcard(attribute.parts, subject[0][idx].value) {
+			return false
+		}
+	}
+	return matchDn(patterns[1:], subject[1:])
+}
+
+// matchWildcard matches a value against the parts of a pattern which was split at its wildcards
+func matchWildcard(parts []string, value string) bool {
+	if len(parts) == 1 {
+		return value == parts[0]
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(value, part)
+		if idx < 0 {
+			return false
+		}
+		value = value[idx+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// splitEscaped splits s at the separators which are not escaped with a backslash
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for idx := 0; idx < len(s); idx++ {
+		switch s[idx] {
+		case '\\':
+			idx++
+		case sep:
+			parts = append(parts, s[start:idx])
+			start = idx + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeDnValue resolves the RFC 2253 escapes of a value ("\," and hex pairs like "\2C") and splits it at unescaped "*"
+func unescapeDnValue(value string) ([]string, error) {
+	parts := []string{""}
+	var current []byte
+	for idx := 0; idx < len(value); idx++ {
+		switch c := value[idx]; {
+		case c == '*':
+			parts[len(parts)-1] = string(current)
+			parts, current = append(parts, ""), nil
+		case c != '\\':
+			current = append(current, c)
+		case idx+2 < len(value) && isHex(value[idx+1]) && isHex(value[idx+2]):
+			b, _ := strconv.ParseUint(value[idx+1:idx+3], 16, 8)
+			current = append(current, byte(b))
+			idx += 2
+		case idx+1 < len(value):
+			current = append(current, value[idx+1])
+			idx++
+		default:
+			return nil, fmt.Errorf("%q ends with an escape", value)
+		}
+	}
+	parts[len(parts)-1] = string(current)
+	return parts, nil
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func (m requestMatcher) matchesDestination(host string) bool {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		return slices.ContainsFunc(m.nets, func(p netip.Prefix) bool { return p.Contains(ip) })
+	}
+
+	host = normalizeDomain(host)
+	return slices.ContainsFunc(m.domains, func(pattern string) bool { return matchDomain(pattern, host) })
+}
+
+// matchDomain matches a domain against a pattern.
+// "example.com" matches only example.com, "*.example.com" matches all subdomains, ".example.com" matches example.com and all subdomains and "*" matches every domain
+func matchDomain(pattern, domain string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(domain, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return domain == pattern[1:] || strings.HasSuffix(domain, pattern)
+	default:
+		return domain == pattern
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// parsePrefixes parses CIDRs, a plain IP is treated as a single address prefix
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		ip, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		ip = ip.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// parsePortRange parses a single port ("443") or an inclusive range ("8000-8999")
+func parsePortRange(port string) (portRange, error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(port), "-")
+	if !isRange {
+		to = from
+	}
+
+	fromPort, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil || fromPort < 0 || fromPort > 65535 {
+		return portRange{}, fmt.Errorf("invalid port %q", port)
+	}
+	toPort, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil || toPort < fromPort || toPort > 65535 {
+		return portRange{}, fmt.Errorf("invalid port range %q", port)
+	}
+	return portRange{from: fromPort, to: toPort}, nil
+}
+
+// addrIP extracts the IP of a TCP or UDP address
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case *net.UDPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case nil:
+		return netip.Addr{}, false
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
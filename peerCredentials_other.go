@@ -0,0 +1,9 @@
+//go:build !linux
+
+package socksauth
+
+import "net"
+
+func peerCredentials(conn *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, errPeerCredentialsUnsupported
+}
@@ -0,0 +1,346 @@
+package socksauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Quota limits the traffic of a user in bytes, both directions count, 0 means unlimited
+type Quota struct {
+	Daily   int64 `json:"daily,omitempty" yaml:"daily,omitempty"`
+	Monthly int64 `json:"monthly,omitempty" yaml:"monthly,omitempty"`
+}
+
+// QuotaAction decides what happens to the connections of a user over quota
+type QuotaAction string
+
+const (
+	// QuotaReject rejects new connections, open ones are not interrupted
+	QuotaReject QuotaAction = "reject"
+	// QuotaThrottle shapes all connections of the user to the throttle bandwidth
+	QuotaThrottle QuotaAction = "throttle"
+)
+
+var defaultThrottle = Bandwidth{Up: 16 * 1024, Down: 16 * 1024}
+
+// QuotaConfig configures traffic quotas, users are the ones of BandwidthLimits: the local user or the client's IP.
+// Days and months are the ones of the local time zone.
+type QuotaConfig struct {
+	// Default applies to all users without their own quota
+	Default Quota `json:"default" yaml:"default"`
+	// Users overrides Default for single users or IPs
+	Users map[string]Quota `json:"users,omitempty" yaml:"users,omitempty"`
+	// Action is the over-quota policy, default is QuotaReject
+	Action QuotaAction `json:"action,omitempty" yaml:"action,omitempty"`
+	// Throttle is the bandwidth of a user over quota with QuotaThrottle, default is 16 KiB/s in each direction
+	Throttle Bandwidth `json:"throttle,omitempty" yaml:"throttle,omitempty"`
+	// File persists the usage as JSON, so restarts do not reset it. Without a file the usage is only kept in memory.
+	// File and SaveInterval can not be changed by a reload
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// SaveInterval is how often the usage is written to File while the server runs, default is 1 minute
+	SaveInterval time.Duration `json:"saveInterval,omitempty" yaml:"saveInterval,omitempty"`
+}
+
+// Usage is the traffic of a user in the current day and month
+type Usage struct {
+	Key      string `json:"key"`
+	Day      string `json:"day"`
+	Daily    int64  `json:"daily"`
+	Month    string `json:"month"`
+	Monthly  int64  `json:"monthly"`
+	Quota    Quota  `json:"quota"`
+	Exceeded bool   `json:"exceeded"`
+}
+
+// usageCounter is the persisted usage of a user
+type usageCounter struct {
+	Day     string `json:"day"`
+	Daily   int64  `json:"daily"`
+	Month   string `json:"month"`
+	Monthly int64  `json:"monthly"`
+}
+
+// roll resets the counters of a past day or month
+func (c *usageCounter) roll(now time.Time) {
+	if day := now.Format(time.DateOnly); c.Day != day {
+		c.Day, c.Daily = day, 0
+	}
+	if month := now.Format("2006-01"); c.Month != month {
+		c.Month, c.Monthly = month, 0
+	}
+}
+
+func (c *usageCounter) exceeds(quota Quota) bool {
+	return (quota.Daily > 0 && c.Daily >= quota.Daily) || (quota.Monthly > 0 && c.Monthly >= quota.Monthly)
+}
+
+// Quotas accounts the traffic of users and enforces their quotas
+type Quotas struct {
+	mu        sync.Mutex
+	config    QuotaConfig
+	usage     map[string]*usageCounter
+	throttles map[string]*quotaThrottle
+	dirty     bool
+	// version counts the changes of the usage, so a save only clears dirty if nothing changed while writing
+	version uint64
+	saveMu  sync.Mutex
+	now     func() time.Time
+	onError func(err error)
+}
+
+type QuotaOption func(*Quotas)
+
+// WithQuotaOnError is called if saving the usage fails, default logs the error with slog
+func WithQuotaOnError(fn func(err error)) QuotaOption {
+	return func(q *Quotas) { q.onError = fn }
+}
+
+// NewQuotas creates the quotas and loads the usage from the config's file if it exists
+func NewQuotas(config QuotaConfig, opts ...QuotaOption) (*Quotas, error) {
+	if config.Action == "" {
+		config.Action = QuotaReject
+	}
+	if config.Action != QuotaReject && config.Action != QuotaThrottle {
+		return nil, fmt.Errorf("unknown quota action %q", config.Action)
+	}
+	if config.Throttle == (Bandwidth{}) {
+		config.Throttle = defaultThrottle
+	}
+	if config.SaveInterval <= 0 {
+		config.SaveInterval = time.Minute
+	}
+
+	q := &Quotas{
+		config:    config,
+		usage:     make(map[string]*usageCounter),
+		throttles: make(map[string]*quotaThrottle),
+		now:       time.Now,
+		onError: func(err error) {
+			slog.Error("Saving the quota usage failed", "file", config.File, "err", err)
+		},
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	if config.File != "" {
+		err := decodeFile(config.File, &q.usage)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("error loading usage: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// setConfig replaces the config of q with the already validated one, the usage is kept and throttles of open connections are updated.
+// The file and save interval are kept, as the saving is already running
+func (q *Quotas) setConfig(config QuotaConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	config.File, config.SaveInterval = q.config.File, q.config.SaveInterval
+	q.config = config
+	for key, throttle := range q.throttles {
+		exceeded := config.Action == QuotaThrottle && q.counter(key).exceeds(q.quota(key))
+		throttle.active = !exceeded
+		throttle.apply(exceeded, config.Throttle)
+	}
+}
+
+func (q *Quotas) quota(key string) Quota {
+	if quota, ok := q.config.Users[key]; ok {
+		return quota
+	}
+	return q.config.Default
+}
+
+// counter returns the rolled counter of the user, the caller has to hold the lock
+func (q *Quotas) counter(key string) *usageCounter {
+	counter, ok := q.usage[key]
+	if !ok {
+		counter = &usageCounter{}
+		q.usage[key] = counter
+	}
+	counter.roll(q.now())
+	return counter
+}
+
+// Usage returns the usage of all users which had traffic, sorted by key
+func (q *Quotas) Usage() []Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := make([]Usage, 0, len(q.usage))
+	for key := range q.usage {
+		usage = append(usage, q.userUsage(key))
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Key < usage[j].Key })
+	return usage
+}
+
+// UserUsage returns the usage of a single user
+func (q *Quotas) UserUsage(key string) Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.userUsage(key)
+}
+
+func (q *Quotas) userUsage(key string) Usage {
+	counter := usageCounter{}
+	if existing, ok := q.usage[key]; ok {
+		counter = *existing
+	}
+	counter.roll(q.now())
+	quota := q.quota(key)
+	return Usage{
+		Key:      key,
+		Day:      counter.Day,
+		Daily:    counter.Daily,
+		Month:    counter.Month,
+		Monthly:  counter.Monthly,
+		Quota:    quota,
+		Exceeded: counter.exceeds(quota),
+	}
+}
+
+// connection checks the quota for a new connection of the user
+// With QuotaReject allowed is false if the user is over quota, otherwise the returned buckets have to be added to the connection's
+// shaping and count has to be called with the relayed bytes. The returned function has to be called when the connection is closed
+func (q *Quotas) connection(key string) (allowed bool, up, down *tokenBucket, count func(n int), release func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	exceeded := q.counter(key).exceeds(q.quota(key))
+	if exceeded && q.config.Action == QuotaReject {
+		return false, nil, nil, nil, nil
+	}
+
+	throttle, ok := q.throttles[key]
+	if !ok {
+		throttle = &quotaThrottle{bucketPair: newBucketPair(Bandwidth{})}
+		q.throttles[key] = throttle
+	}
+	throttle.conns++
+	throttle.apply(exceeded, q.config.Throttle)
+
+	count = func(n int) { q.count(key, throttle, n) }
+	release = func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if throttle.conns--; throttle.conns == 0 {
+			delete(q.throttles, key)
+		}
+	}
+	return true, throttle.up, throttle.down, count, release
+}
+
+func (q *Quotas) count(key string, throttle *quotaThrottle, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	counter := q.counter(key)
+	counter.Daily += int64(n)
+	counter.Monthly += int64(n)
+	q.dirty = true
+	q.version++
+
+	if q.config.Action != QuotaThrottle {
+		return
+	}
+	// a new day or month lifts the throttle of open connections as well
+	throttle.apply(counter.exceeds(q.quota(key)), q.config.Throttle)
+}
+
+// quotaThrottle shapes the connections of a user while the user is over quota
+type quotaThrottle struct {
+	bucketPair
+	conns  int
+	active bool
+}
+
+func (t *quotaThrottle) apply(active bool, bandwidth Bandwidth) {
+	if t.active == active {
+		return
+	}
+	t.active = active
+	if active {
+		t.set(bandwidth)
+	} else {
+		t.set(Bandwidth{})
+	}
+}
+
+// Save writes the usage to the config's file, it is replaced atomically so a crash does not leave a broken file
+func (q *Quotas) Save() error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	q.mu.Lock()
+	file, version := q.config.File, q.version
+	if file == "" {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("error saving usage: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("error saving usage: %w", err)
+	}
+
+	// a failed save keeps the usage dirty, so it is written with the next try
+	q.mu.Lock()
+	if q.version == version {
+		q.dirty = false
+	}
+	q.mu.Unlock()
+	return nil
+}
+
+// run saves changed usage every SaveInterval and once more when the context is done
+func (q *Quotas) run(ctx context.Context) {
+	q.mu.Lock()
+	file, interval := q.config.File, q.config.SaveInterval
+	q.mu.Unlock()
+	if file == "" {
+		return
+	}
+
+	save := func() {
+		q.mu.Lock()
+		dirty := q.dirty
+		q.mu.Unlock()
+		if !dirty {
+			return
+		}
+		if err := q.Save(); err != nil && q.onError != nil {
+			q.onError(err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			save()
+			return
+		case <-ticker.C:
+			save()
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package socksauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotasAccounting(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	now := time.Date(2026, 1, 31, 23, 0, 0, 0, time.Local)
+
+	quotas, err := NewQuotas(QuotaConfig{
+		Default: Quota{Daily: 1000, Monthly: 1500},
+		Users:   map[string]Quota{"bob": {}},
+		File:    file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas.now = func() time.Time { return now }
+
+	allowed, _, _, count, release := quotas.connection("alice")
+	if !allowed {
+		t.Fatal("expected a new user to be allowed")
+	}
+	count(600)
+	count(600)
+	release()
+	if allowed, _, _, _, _ := quotas.connection("alice"); allowed {
+		t.Error("expected alice to be over her daily quota")
+	}
+	if allowed, _, _, count, release := quotas.connection("bob"); !allowed {
+		t.Error("expected bob without a quota to be allowed")
+	} else {
+		count(5000)
+		release()
+	}
+
+	if err := quotas.Save(); err != nil {
+		t.Fatal(err)
+	}
+	quotas, err = NewQuotas(QuotaConfig{Default: Quota{Daily: 1000, Monthly: 1500}, File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas.now = func() time.Time { return now }
+
+	usage := quotas.Usage()
+	if len(usage) != 2 || usage[0].Key != "alice" || usage[0].Daily != 1200 || !usage[0].Exceeded || usage[1].Monthly != 5000 {
+		t.Fatalf("expected the usage to be restored, got %+v", usage)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if usage := quotas.UserUsage("alice"); usage.Daily != 0 || usage.Monthly != 0 || usage.Month != "2026-02" || usage.Exceeded {
+		t.Errorf("expected a new month to reset the usage, got %+v", usage)
+	}
+
+	if _, err := NewQuotas(QuotaConfig{Action: "drop"}); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+}
+
+func TestQuotasThrottle(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+	quotas, err := NewQuotas(QuotaConfig{Default: Quota{Daily: 1000}, Action: QuotaThrottle, Throttle: Bandwidth{Up: 10240, Down: 20480}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas.now = func() time.Time { return now }
+
+	allowed, up, down, count, release := quotas.connection("alice")
+	defer release()
+	if !allowed || up.burstSize() != 0 || down.burstSize() != 0 {
+		t.Fatal("expected a user under quota not to be throttled")
+	}
+
+	count(1000)
+	if up.burstSize() != 1024 || down.burstSize() != 2048 {
+		t.Error("expected the open connection to be throttled once the quota is exceeded")
+	}
+	if allowed, up, _, _, release := quotas.connection("alice"); !allowed || up.burstSize() != 1024 {
+		t.Error("expected new connections to be allowed, but throttled")
+	} else {
+		release()
+	}
+
+	now = now.Add(24 * time.Hour)
+	count(1)
+	if up.burstSize() != 0 {
+		t.Error("expected the throttle to be lifted the next day")
+	}
+}
+
+func TestQuotasThroughServer(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	quotas, err := NewQuotas(QuotaConfig{Default: Quota{Daily: 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan SocksError, 1)
+	server, proxyAddr := startTestServer(t, upstream.Addr, "user", "pass", WithQuotas(quotas),
+		WithOnError(func(id int64, conn net.Conn, err SocksError) { errs <- err }))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an open connection is not interrupted by the quota
+	assertEcho(t, conn)
+	assertEcho(t, conn)
+	conn.Close()
+
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); err != socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+		t.Fatalf("expected a ruleset reply, got %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrQuotaExceeded) || !errors.Is(err, ErrConnectionNotAllowed) {
+			t.Errorf("expected a quota error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an error")
+	}
+
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "/usage?key=127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var usage Usage
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	// two echoes of 23 bytes in both directions
+	if !usage.Exceeded || usage.Daily != 92 || usage.Quota.Daily != 50 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestQuotasSavedOnShutdown(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	file := filepath.Join(t.TempDir(), "usage.json")
+	quotas, err := NewQuotas(QuotaConfig{File: file, SaveInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback, _ := NewDestinationPolicy("127.0.0.0/8")
+	server := NewServer(upstream.Addr, "user", "pass", WithAddr("127.0.0.1:0"), WithDestinationPolicy(loopback), WithQuotas(quotas))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errChan := make(chan error, 1)
+	go func() { errChan <- server.Start(ctx) }()
+	<-server.Ready()
+
+	conn, err := dialSocks(strings.TrimPrefix(server.Addr, "socks5://"), echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+	waitFor(t, func() bool { return quotas.UserUsage("127.0.0.1").Daily > 0 })
+
+	// the usage is saved before Start returns
+	cancel()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	saved, err := NewQuotas(QuotaConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := saved.UserUsage("127.0.0.1"); usage.Daily != 46 {
+		t.Errorf("expected the usage to be saved on shutdown, got %+v", usage)
+	}
+}
+
+func TestQuotasSaveError(t *testing.T) {
+	errs := make(chan error, 1)
+	quotas, err := NewQuotas(QuotaConfig{File: filepath.Join(t.TempDir(), "missing", "usage.json")}, WithQuotaOnError(func(err error) { errs <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, count, release := quotas.connection("alice")
+	count(10)
+	release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	quotas.run(ctx)
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expected an error")
+		}
+	default:
+		t.Error("expected the failed save to be reported")
+	}
+	if !quotas.dirty {
+		t.Error("expected the usage to be saved again after a failed save")
+	}
+
+	// a reload does not move the file of the running save
+	quotas.setConfig(QuotaConfig{File: "other.json", SaveInterval: time.Hour})
+	if quotas.config.File == "other.json" || quotas.config.SaveInterval == time.Hour {
+		t.Errorf("expected the file and save interval to be kept, got %+v", quotas.config)
+	}
+}
@@ -0,0 +1,194 @@
+package socksauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadKeepsOpenConnections(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	first := startMockUpstream(t, "user", "pass")
+	second := startMockUpstream(t, "other", "secret")
+
+	server, proxyAddr := startTestServer(t, first.Addr, "user", "pass", WithConnRateLimit(100, 0))
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	acl, err := NewAcl(AclConfig{Destinations: []AclRule{{Action: AclDeny, Ports: []string{"22"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, _ := NewDestinationPolicy("127.0.0.1")
+	server.Reload(
+		WithServerFinder(func(ctx context.Context) (string, error) { return second.Addr, nil }),
+		WithCredentialProvider(StaticCredentials(Credentials{Username: "other", Password: "secret"})),
+		WithAcl(acl),
+		WithDestinationPolicy(policy),
+	)
+
+	// the open connection keeps its upstream
+	assertEcho(t, conn)
+
+	newConn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newConn.Close()
+	assertEcho(t, newConn)
+	if len(first.Destinations()) != 1 || len(second.Destinations()) != 1 {
+		t.Errorf("expected the new connection to use the new upstream, got %v and %v", first.Destinations(), second.Destinations())
+	}
+	if _, err := dialSocks(proxyAddr, "127.0.0.1:22", "", ""); err != socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+		t.Errorf("expected the new ACL to deny the request, got %v", err)
+	}
+	if server.listeners[0].guard.rate != 0 {
+		t.Error("expected the connection rate limit to be reset by the reload")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	first := startMockUpstream(t, "user", "pass")
+	second := startMockUpstream(t, "user", "pass")
+
+	configFor := func(upstream string) string {
+		return fmt.Sprintf("upstream:\n  host: %s\n  credentials:\n    username: user\n    password: pass\ndestinations:\n  allow: [127.0.0.1]\n", upstream)
+	}
+	path := writeFile(t, "config.yaml", configFor(first.Addr))
+	writeConfig := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loader := func() ([]ServerOption, error) {
+		config, err := LoadServerConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		return config.Options()
+	}
+	opts, err := loader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer("", "", "", append(opts, WithConfigLoader(loader))...)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	proxyAddr := startServer(t, ctx, server)
+
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+	reload := func() int {
+		resp, err := http.Post(admin.URL+"/reload", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// an invalid config keeps the previous settings
+	writeConfig("upstream:\n  finder:\n    type: magic\n")
+	if err := server.ReloadConfig(); err == nil || !strings.Contains(err.Error(), "magic") {
+		t.Errorf("expected the invalid config to fail, got %v", err)
+	}
+	if status := reload(); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected the admin API to report the invalid config, got %d", status)
+	}
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	writeConfig(configFor(second.Addr))
+	if status := reload(); status != http.StatusOK {
+		t.Fatalf("expected the reload to succeed, got %d", status)
+	}
+	conn, err = dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	if len(first.Destinations()) != 1 || len(second.Destinations()) != 1 {
+		t.Errorf("expected the reloaded config to change the upstream, got %v and %v", first.Destinations(), second.Destinations())
+	}
+
+	noLoader := httptest.NewServer(NewServer("127.0.0.1:1", "", "").AdminHandler())
+	defer noLoader.Close()
+	resp, err := http.Post(noLoader.URL+"/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a server without config loader to answer 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestReloadConfigKeepsState(t *testing.T) {
+	upstreams := writeFile(t, "upstreams.json", `[{"addr": "a:1080"}, {"addr": "b:1080"}]`)
+	configFor := func(idleTTL string) string {
+		return "upstream:\n  finder:\n    type: static\n    file: " + upstreams + "\n    sticky:\n      idleTTL: " + idleTTL + "\n" +
+			"  pool:\n    - username: alice\n      password: secret\n"
+	}
+	path := writeFile(t, "config.yaml", configFor("1h"))
+
+	config, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := server.listeners[0].settings.Load()
+	pinned := findAddr(t, settings.finder, Request{Username: "alice"})
+
+	reload := func() *serverSettings {
+		t.Helper()
+		next, err := LoadServerConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next.Reuse(config)
+		opts, err := next.Options()
+		if err != nil {
+			t.Fatal(err)
+		}
+		config = next
+		server.Reload(opts...)
+		return server.listeners[0].settings.Load()
+	}
+
+	// unchanged settings keep the finder with its sticky sessions and the credential pool
+	reloaded := reload()
+	if reloaded.finder != settings.finder || reloaded.credentials != settings.credentials {
+		t.Fatal("expected the unchanged finder and credential pool to be kept")
+	}
+	if addr := findAddr(t, reloaded.finder, Request{Username: "alice"}); addr != pinned {
+		t.Errorf("expected alice to stay on %s, got %s", pinned, addr)
+	}
+
+	if err := os.WriteFile(path, []byte(configFor("2h")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if changed := reload(); changed.finder == settings.finder || changed.credentials != settings.credentials {
+		t.Error("expected only the changed finder to be created again")
+	}
+}
@@ -0,0 +1,142 @@
+package socksauth
+
+import (
+	"fmt"
+)
+
+// RouteAction decides what happens with a request
+type RouteAction string
+
+const (
+	// RouteUpstream connects through an upstream found by the server's finder or a named pool
+	RouteUpstream RouteAction = "upstream"
+	// RouteDirect connects to the destination without an upstream
+	RouteDirect RouteAction = "direct"
+	// RouteReject refuses the request with a "connection not allowed by ruleset" reply
+	RouteReject RouteAction = "reject"
+)
+
+// RouteRule maps matching requests to an action.
+// A request matches if its destination matches any of the Domains or CIDRs, its port is in any of the Ports and its source is in any of the Sources.
+// Criteria left empty match every request.
+type RouteRule struct {
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Domains are matched against domain destinations: "example.com" matches only example.com, "*.example.com" all subdomains and ".example.com" both
+	Domains []string `json:"domains,omitempty" yaml:"domains,omitempty"`
+	// CIDRs are matched against IP destinations, a plain IP is a single address
+	CIDRs []string `json:"cidrs,omitempty" yaml:"cidrs,omitempty"`
+	// Ports are single ports ("443") or inclusive ranges ("8000-8999")
+	Ports []string `json:"ports,omitempty" yaml:"ports,omitempty"`
+	// Sources are CIDRs matched against the client's address
+	Sources []string `json:"sources,omitempty" yaml:"sources,omitempty"`
+	// Identities are patterns matched against the subject of the client's TLS certificate, like "CN=*,O=Example"
+	Identities []string `json:"identities,omitempty" yaml:"identities,omitempty"`
+
+	Action RouteAction `json:"action" yaml:"action"`
+	// Pool names the upstream pool for the upstream action, empty means the server's finder
+	Pool string `json:"pool,omitempty" yaml:"pool,omitempty"`
+}
+
+// RouterConfig is the routing table, rules are evaluated in order and the first match wins
+type RouterConfig struct {
+	Rules []RouteRule `json:"rules" yaml:"rules"`
+	// Default is used if no rule matches, its criteria are ignored. The zero value routes through the server's finder.
+	Default RouteRule `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+// Route is the result of routing a request
+type Route struct {
+	Action RouteAction `json:"action"`
+	Pool   string      `json:"pool,omitempty"`
+	// Rule is the name of the matched rule, it is empty for the default route
+	Rule string `json:"rule,omitempty"`
+}
+
+// Router evaluates a routing table for every CONNECT request
+type Router struct {
+	rules        []routerRule
+	defaultRoute Route
+	pools        map[string]ServerFinder
+}
+
+type routerRule struct {
+	matcher requestMatcher
+	route   Route
+}
+
+// NewRouter compiles the routing table, every pool referenced by a rule has to be in pools
+func NewRouter(config RouterConfig, pools map[string]ServerFinder) (*Router, error) {
+	r := &Router{pools: pools}
+
+	var err error
+	r.defaultRoute, err = r.compileRoute(config.Default, "")
+	if err != nil {
+		return nil, fmt.Errorf("default route: %w", err)
+	}
+
+	for idx, rule := range config.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", idx+1)
+		}
+
+		route, err := r.compileRoute(rule, rule.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		matcher, err := newRequestMatcher(rule.Domains, rule.CIDRs, rule.Ports, rule.Sources, rule.Identities)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		r.rules = append(r.rules, routerRule{matcher: matcher, route: route})
+	}
+
+	return r, nil
+}
+
+// LoadRouter reads the routing table from a JSON or YAML file
+func LoadRouter(path string, pools map[string]ServerFinder) (*Router, error) {
+	var config RouterConfig
+	if err := decodeFile(path, &config); err != nil {
+		return nil, err
+	}
+
+	return NewRouter(config, pools)
+}
+
+func (r *Router) compileRoute(rule RouteRule, name string) (Route, error) {
+	route := Route{Action: rule.Action, Pool: rule.Pool, Rule: name}
+	switch route.Action {
+	case "":
+		route.Action = RouteUpstream
+	case RouteUpstream, RouteDirect, RouteReject:
+	default:
+		return route, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	if route.Pool != "" {
+		if route.Action != RouteUpstream {
+			return route, fmt.Errorf("a pool can only be used with the %s action", RouteUpstream)
+		}
+		if _, ok := r.pools[route.Pool]; !ok {
+			return route, fmt.Errorf("unknown pool %q", route.Pool)
+		}
+	}
+	return route, nil
+}
+
+// Route returns the route for a request without connecting anywhere, so it can be used to dry-run a routing table
+func (r *Router) Route(req Request) Route {
+	for _, rule := range r.rules {
+		if rule.matcher.matches(req) {
+			return rule.route
+		}
+	}
+	return r.defaultRoute
+}
+
+// Pool returns the finder of a named pool
+func (r *Router) Pool(name string) (ServerFinder, bool) {
+	finder, ok := r.pools[name]
+	return finder, ok
+}
@@ -0,0 +1,185 @@
+package socksauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRouterDryRun(t *testing.T) {
+	de := FinderFunc(nil)
+	router, err := NewRouter(RouterConfig{
+		Rules: []RouteRule{
+			{Name: "internal", CIDRs: []string{"10.0.0.0/8", "fd00::/8"}, Action: RouteDirect},
+			{Name: "blocked smtp", Ports: []string{"25", "465-587"}, Action: RouteReject},
+			{Name: "german", Domains: []string{"*.example.de"}, Action: RouteUpstream, Pool: "de"},
+			{Name: "cdn", Domains: []string{".cdn.example.com"}, Sources: []string{"192.168.0.0/16"}, Action: RouteDirect},
+		},
+	}, map[string]ServerFinder{"de": de})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	office := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+	remote := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+
+	tests := []struct {
+		name string
+		req  Request
+		want Route
+	}{
+		{"ipv4 in cidr", Request{DestHost: "10.1.2.3", DestPort: 443}, Route{Action: RouteDirect, Rule: "internal"}},
+		{"ipv4 mapped ipv6 in cidr", Request{DestHost: "::ffff:10.1.2.3", DestPort: 443}, Route{Action: RouteDirect, Rule: "internal"}},
+		{"ipv6 in cidr", Request{DestHost: "fd12::1", DestPort: 443}, Route{Action: RouteDirect, Rule: "internal"}},
+		{"port", Request{DestHost: "mail.example.com", DestPort: 25}, Route{Action: RouteReject, Rule: "blocked smtp"}},
+		{"port range", Request{DestHost: "mail.example.com", DestPort: 500}, Route{Action: RouteReject, Rule: "blocked smtp"}},
+		{"wildcard subdomain", Request{DestHost: "shop.Example.DE.", DestPort: 443}, Route{Action: RouteUpstream, Pool: "de", Rule: "german"}},
+		{"wildcard does not match apex", Request{DestHost: "example.de", DestPort: 443}, Route{Action: RouteUpstream}},
+		{"suffix matches apex with source", Request{ClientAddr: office, DestHost: "cdn.example.com", DestPort: 443}, Route{Action: RouteDirect, Rule: "cdn"}},
+		{"suffix matches subdomain with source", Request{ClientAddr: office, DestHost: "img.cdn.example.com", DestPort: 443}, Route{Action: RouteDirect, Rule: "cdn"}},
+		{"suffix with wrong source", Request{ClientAddr: remote, DestHost: "cdn.example.com", DestPort: 443}, Route{Action: RouteUpstream}},
+		{"suffix is not a substring match", Request{ClientAddr: office, DestHost: "evilcdn.example.com", DestPort: 443}, Route{Action: RouteUpstream}},
+		{"default", Request{DestHost: "example.org", DestPort: 80}, Route{Action: RouteUpstream}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := router.Route(test.req); got != test.want {
+				t.Errorf("expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRouterValidation(t *testing.T) {
+	configs := map[string]RouterConfig{
+		"unknown pool":     {Rules: []RouteRule{{Domains: []string{"example.com"}, Pool: "us"}}},
+		"unknown action":   {Rules: []RouteRule{{Action: "drop"}}},
+		"pool with direct": {Rules: []RouteRule{{Action: RouteDirect, Pool: "de"}}},
+		"invalid cidr":     {Rules: []RouteRule{{CIDRs: []string{"10.0.0.0/33"}, Action: RouteDirect}}},
+		"invalid port":     {Rules: []RouteRule{{Ports: []string{"90-80"}, Action: RouteDirect}}},
+		"invalid domain":   {Rules: []RouteRule{{Domains: []string{"ex*ample.com"}, Action: RouteDirect}}},
+	}
+	for name, config := range configs {
+		if _, err := NewRouter(config, map[string]ServerFinder{"de": FinderFunc(nil)}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadRouter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(path, []byte(`{
+		"default": {"action": "reject"},
+		"rules": [{"name": "local", "domains": ["localhost"], "action": "direct"}]
+	}`), 0644)
+
+	router, err := LoadRouter(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route := router.Route(Request{DestHost: "localhost", DestPort: 80}); route.Action != RouteDirect {
+		t.Errorf("expected direct route, got %+v", route)
+	}
+	if route := router.Route(Request{DestHost: "example.com", DestPort: 80}); route.Action != RouteReject {
+		t.Errorf("expected the default route to reject, got %+v", route)
+	}
+
+	os.WriteFile(path, []byte(`{"rules": [{"action": "direct", "domain": ["typo"]}]}`), 0644)
+	if _, err := LoadRouter(path, nil); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+
+	yamlPath := filepath.Join(t.TempDir(), "routes.yaml")
+	os.WriteFile(yamlPath, []byte("rules:\n  - domains: [.internal]\n    action: direct\n"), 0644)
+	router, err = LoadRouter(yamlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route := router.Route(Request{DestHost: "git.internal", DestPort: 22}); route.Action != RouteDirect {
+		t.Errorf("expected direct route from the yaml table, got %+v", route)
+	}
+}
+
+func TestRoutedConnections(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+	defaultUpstream := startMockUpstream(t, "user", "pass")
+	poolUpstream := startMockUpstream(t, "user", "pass")
+
+	router, err := NewRouter(RouterConfig{Rules: []RouteRule{
+		{Name: "direct", Domains: []string{"localhost"}, Action: RouteDirect},
+		{Name: "pool", CIDRs: []string{"127.0.0.2"}, Action: RouteUpstream, Pool: "other"},
+		{Name: "no ssh", Ports: []string{"22"}, Action: RouteReject},
+	}}, map[string]ServerFinder{"other": &reportingFinder{upstreams: []Upstream{{Addr: poolUpstream.Addr}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, proxyAddr := startTestServer(t, defaultUpstream.Addr, "user", "pass", WithRouter(router))
+
+	// direct
+	conn, err := dialSocks(proxyAddr, net.JoinHostPort("localhost", echoPort), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	// default upstream
+	conn, err = dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	// named pool, the mock upstream cannot reach 127.0.0.2 but the request has to arrive there
+	dialSocks(proxyAddr, net.JoinHostPort("127.0.0.2", echoPort), "", "")
+
+	// rejected
+	var replyErr socksReplyError
+	_, err = dialSocks(proxyAddr, "127.0.0.1:22", "", "")
+	if !errors.As(err, &replyErr) || byte(replyErr) != _CONN_NOT_ALLOWED_BY_RULESET {
+		t.Errorf("expected a ruleset reply, got %v", err)
+	}
+
+	if got := defaultUpstream.Destinations(); len(got) != 1 || got[0] != echoAddr {
+		t.Errorf("expected only %s through the default upstream, got %v", echoAddr, got)
+	}
+	if got := poolUpstream.Destinations(); len(got) != 1 || got[0] != net.JoinHostPort("127.0.0.2", echoPort) {
+		t.Errorf("expected only 127.0.0.2 through the pool upstream, got %v", got)
+	}
+}
+
+type warmupFinder struct {
+	sequenceFinder
+	warmups atomic.Int32
+}
+
+func (f *warmupFinder) Warmup(ctx context.Context) error {
+	f.warmups.Add(1)
+	return nil
+}
+
+func TestRouterSkipsDefaultFinderWarmup(t *testing.T) {
+	router, err := NewRouter(RouterConfig{Default: RouteRule{Action: RouteDirect}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultFinder, finder := &warmupFinder{}, &warmupFinder{}
+	s := &Server{defaultFinder: defaultFinder}
+
+	s.prepareSettings(&serverSettings{router: router})
+	if defaultFinder.warmups.Load() != 0 {
+		t.Error("expected the default finder not to be warmed up for a router")
+	}
+	s.prepareSettings(&serverSettings{router: router, finder: finder})
+	s.prepareSettings(&serverSettings{})
+	if finder.warmups.Load() != 1 || defaultFinder.warmups.Load() != 1 {
+		t.Errorf("expected the finders to be warmed up without a router or if set, got %d and %d", finder.warmups.Load(), defaultFinder.warmups.Load())
+	}
+}
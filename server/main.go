@@ -2,29 +2,104 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/FrauElster/socksauth"
 )
 
 func main() {
-	var remoteHost, remoteUser, remotePass string
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+
+	var configPath, remoteHost, remoteUser, remotePass, credentialsFile, credentialsHelper string
+	var prompt bool
 	var port int
+	var watchConfig time.Duration
+	flag.StringVar(&configPath, "config", "", "Configuration file (YAML, JSON or TOML), flags override its settings")
 	flag.StringVar(&remoteHost, "remoteHost", "", "Remote host address")
 	flag.StringVar(&remoteUser, "remoteUser", "", "Remote username")
-	flag.StringVar(&remotePass, "remotePass", "", "Remote password")
+	flag.StringVar(&remotePass, "remotePass", "", "Remote password (visible in the process list, prefer the other credential sources)")
+	flag.StringVar(&credentialsFile, "credentialsFile", "", "File with the remote credentials (JSON, YAML or username and password in two lines), re-read on change")
+	flag.StringVar(&credentialsHelper, "credentialsHelper", "", "Command printing the remote credentials as JSON object with username and password")
+	flag.BoolVar(&prompt, "prompt", false, "Ask for the remote password (and username if -remoteUser is not set) on stdin")
 	flag.IntVar(&port, "port", 1080, "Port to listen on")
+	flag.DurationVar(&watchConfig, "watchConfig", 0, "Interval to check the configuration file for changes and reload it, 0 disables the check")
 	flag.Parse()
 
+	// Read the configuration, flags which are set override it
+	credentialFlags := false
+	loadConfig := func() (*socksauth.ServerConfig, error) {
+		config, err := socksauth.LoadServerConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "remoteHost":
+				config.Upstream.Host = remoteHost
+			case "port":
+				config.Listen = fmt.Sprintf(":%d", port)
+			case "remoteUser", "remotePass", "credentialsFile", "credentialsHelper", "prompt":
+				credentialFlags = true
+			}
+		})
+		return config, nil
+	}
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logLevel := &slog.LevelVar{}
+	logLevel.Set(config.Log.SlogLevel())
+	slog.SetDefault(slog.New(config.Log.Handler(os.Stderr, logLevel)))
+
 	// Validate the input
-	if remoteUser == "" || remotePass == "" {
-		log.Fatal("user and password must be provided")
+	var credentialOpts []socksauth.ServerOption
+	if credentialFlags || !config.Upstream.HasCredentials() {
+		credentials, err := credentialProvider(remoteUser, remotePass, credentialsFile, credentialsHelper, prompt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		credentialOpts = append(credentialOpts, socksauth.WithCredentialProvider(credentials))
+	}
+
+	// a reload reads the configuration again, finders and credentials whose settings did not change keep their state.
+	// The credentials of the flags are kept, they are only used if given or if the configuration has none
+	current := config
+	reload := func() ([]socksauth.ServerOption, error) {
+		config, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		config.Reuse(current)
+		opts, err := config.Options()
+		if err != nil {
+			return nil, err
+		}
+		if credentialFlags || !config.Upstream.HasCredentials() {
+			if credentialOpts == nil {
+				credentials, err := credentialProvider(remoteUser, remotePass, credentialsFile, credentialsHelper, prompt)
+				if err != nil {
+					return nil, err
+				}
+				credentialOpts = []socksauth.ServerOption{socksauth.WithCredentialProvider(credentials)}
+			}
+			opts = append(opts, credentialOpts...)
+		}
+		current = config
+		logLevel.Set(config.Log.SlogLevel())
+		return opts, nil
 	}
 
 	// build the server
@@ -32,26 +107,189 @@ func main() {
 		slog.Error("Error", "connId", connId, "err", err)
 	}
 	onConnect := func(connId int64, conn net.Conn) {
+		if peer, err := socksauth.PeerCredentials(conn); err == nil {
+			slog.Debug("Connected", "connId", connId, "addr", conn.LocalAddr(), "uid", peer.Uid, "pid", peer.Pid)
+			return
+		}
 		slog.Debug("Connected", "connId", connId, "addr", conn.RemoteAddr())
 	}
 	onDisconnect := func(connId int64, conn net.Conn) {
 		slog.Debug("Disconnected", "connId", connId, "addr", conn.RemoteAddr())
 	}
-	server := socksauth.NewServer(remoteHost, remoteUser, remotePass,
-		socksauth.WithAddr(fmt.Sprintf(":%d", port)), socksauth.WithOnConnect(onConnect), socksauth.WithOnDisconnect(onDisconnect), socksauth.WithOnError(onError))
+	opts := append(credentialOpts, socksauth.WithOnConnect(onConnect), socksauth.WithOnDisconnect(onDisconnect), socksauth.WithOnError(onError))
+	if configPath != "" {
+		opts = append(opts, socksauth.WithConfigLoader(reload))
+	}
+	server, err := socksauth.NewServerFromConfig(config, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Admin != "" {
+		go func() { log.Fatal(http.ListenAndServe(config.Admin, server.AdminHandler())) }()
+	}
 
 	// Start the server
 	runCtx, cancel := context.WithCancel(context.Background())
-	err := server.Start(runCtx)
-	if err != nil {
+	errChan := make(chan error, 1)
+	go func() { errChan <- server.Start(runCtx) }()
+	select {
+	case <-server.Ready():
+		fmt.Println("SOCKS5 server is listening on", strings.Join(server.ListenerAddrs(), ", "))
+	case err := <-errChan:
 		log.Fatal(err)
 	}
-	fmt.Println("SOCKS5 server is listening on ", server.Addr)
 
-	// wait for ctrl+c
+	// wait for ctrl+c, SIGUSR1 rotates the sticky sessions, SIGHUP and changes of the configuration file reload it
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
-	<-sigChan
-	fmt.Println("Shutting down...")
-	cancel()
+	rotateChan := make(chan os.Signal, 1)
+	notifyRotate(rotateChan)
+	reloadChan := make(chan os.Signal, 1)
+	notifyReload(reloadChan)
+	var changed <-chan struct{}
+	if configPath != "" && watchConfig > 0 {
+		changed = watchFile(runCtx, configPath, watchConfig)
+	}
+	reloadConfig := func(trigger string) {
+		if configPath == "" {
+			slog.Warn("No configuration file to reload", "trigger", trigger)
+			return
+		}
+		if err := server.ReloadConfig(); err != nil {
+			slog.Error("Reloading the configuration failed, keeping the previous one", "trigger", trigger, "err", err)
+			return
+		}
+		slog.Info("Reloaded the configuration", "trigger", trigger)
+	}
+	for {
+		select {
+		case err := <-errChan:
+			log.Fatal(err)
+		case <-rotateChan:
+			slog.Info("Rotated sticky sessions", "count", server.RotateAll())
+		case <-reloadChan:
+			reloadConfig("signal")
+		case <-changed:
+			reloadConfig("file change")
+		case <-sigChan:
+			fmt.Println("Shutting down...")
+			cancel()
+			// Start returns once the connections are closed and the quota usage is saved
+			if err := <-errChan; err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+}
+
+// watchFile polls the modification time and size of the file and sends when they change
+func watchFile(ctx context.Context, path string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{})
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, 0
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	go func() {
+		modTime, size := stat()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// a missing file is not a change, editors may replace it
+			newModTime, newSize := stat()
+			if newModTime.IsZero() || (newModTime.Equal(modTime) && newSize == size) {
+				continue
+			}
+			modTime, size = newModTime, newSize
+			select {
+			case changed <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changed
+}
+
+// checkConfig validates a configuration file without starting the server and returns the exit code
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configPath := flags.String("config", "", "Configuration file (YAML, JSON or TOML)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: socksauth check-config [-config] <file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *configPath == "" {
+		*configPath = flags.Arg(0)
+	}
+	if *configPath == "" {
+		flags.Usage()
+		return 2
+	}
+
+	config, err := socksauth.LoadServerConfig(*configPath)
+	if err == nil {
+		_, err = config.Options()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s is valid\n", *configPath)
+	return 0
+}
+
+// credentialProvider chooses where the remote credentials come from, only one source may be given
+// Without any the environment variables SOCKSAUTH_REMOTE_USER and SOCKSAUTH_REMOTE_PASS are used
+func credentialProvider(user, pass, file, helper string, prompt bool) (socksauth.CredentialProvider, error) {
+	sources := 0
+	for _, given := range []bool{pass != "", file != "", helper != "", prompt} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, errors.New("only one of -remotePass, -credentialsFile, -credentialsHelper and -prompt can be used")
+	}
+
+	var provider socksauth.CredentialProvider
+	switch {
+	case pass != "":
+		if user == "" {
+			return nil, errors.New("user and password must be provided")
+		}
+		provider = socksauth.StaticCredentials(socksauth.Credentials{Username: user, Password: pass})
+	case file != "":
+		return socksauth.NewFileCredentials(file)
+	case helper != "":
+		command := strings.Fields(helper)
+		if len(command) == 0 {
+			return nil, errors.New("-credentialsHelper needs a command")
+		}
+		provider = socksauth.NewCommandCredentials(time.Minute, command[0], command[1:]...)
+	case prompt:
+		credentials, err := socksauth.PromptCredentials(os.Stdin, os.Stderr, user)
+		if err != nil {
+			return nil, err
+		}
+		provider = socksauth.StaticCredentials(credentials)
+	default:
+		provider = socksauth.EnvCredentials("SOCKSAUTH_REMOTE_USER", "SOCKSAUTH_REMOTE_PASS")
+	}
+
+	// fail at startup instead of with the first connection
+	if _, err := provider.Credentials(context.Background()); err != nil {
+		return nil, fmt.Errorf("no remote credentials: %w", err)
+	}
+	return provider, nil
 }
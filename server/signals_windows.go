@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+// notifyRotate does nothing, windows has no SIGUSR1
+func notifyRotate(c chan<- os.Signal) {}
+
+// notifyReload does nothing, windows has no SIGHUP
+func notifyReload(c chan<- os.Signal) {}
@@ -0,0 +1,892 @@
+package socksauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ServerConfig is the configuration of a server as read by LoadServerConfig, NewServerFromConfig creates the server
+type ServerConfig struct {
+	// Listen is the address of the SOCKS5 server, default is ":1080". A unix socket is like "unix:///run/socksauth.sock"
+	Listen string `json:"listen,omitempty" yaml:"listen,omitempty"`
+	// Socket are the permissions of a unix socket Listen
+	Socket *UnixSocketConfig `json:"socket,omitempty" yaml:"socket,omitempty"`
+	// Tls makes clients speak SOCKS5 over TLS
+	Tls *TlsConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// Admin is the address the admin API (see AdminHandler) is served on, it is not served if empty
+	Admin string `json:"admin,omitempty" yaml:"admin,omitempty"`
+
+	Upstream UpstreamConfig `json:"upstream" yaml:"upstream"`
+	// Pools are named finders routes can send requests to
+	Pools  map[string]FinderConfig `json:"pools,omitempty" yaml:"pools,omitempty"`
+	Routes *RouterConfig           `json:"routes,omitempty" yaml:"routes,omitempty"`
+
+	Acl          *AclConfig         `json:"acl,omitempty" yaml:"acl,omitempty"`
+	Destinations DestinationsConfig `json:"destinations" yaml:"destinations"`
+	Limits       LimitsConfig       `json:"limits" yaml:"limits"`
+	Bandwidth    BandwidthLimits    `json:"bandwidth" yaml:"bandwidth"`
+	Quotas       *QuotaConfig       `json:"quotas,omitempty" yaml:"quotas,omitempty"`
+
+	// Listeners are additional addresses with their own profile, see WithListener
+	Listeners []ListenerConfig `json:"listeners,omitempty" yaml:"listeners,omitempty"`
+	// Allocations configures the local ports the admin API allocates, see Server.Allocate
+	Allocations AllocationConfig `json:"allocations" yaml:"allocations"`
+
+	Log LogConfig `json:"log" yaml:"log"`
+
+	path string
+	// prefix is the path of the listener a config of listenerConfig is for
+	prefix string
+	// lines are the lines of the settings in the file by their path, like "upstream.finder.type"
+	lines map[string]int
+	// env are the environment variables which overrode settings by their path
+	env map[string]string
+	// built are the finders and credential sources Options created by their path, previous the ones of the config set by Reuse
+	built, previous map[string]configComponent
+}
+
+// configComponent is a finder or credential source and the settings it was created with
+type configComponent struct {
+	settings any
+	value    any
+}
+
+// ListenerConfig is an additional listener of the server, settings which are not set are the ones of the server.
+// The upstream's finder or host, its credentials and each limit are inherited on their own, e.g. a listener with only a connection rate
+// keeps the server's handshake timeout. Routes, ACL and quotas replace the server's as a whole, destinations once one of their fields is set.
+// The pools are shared.
+type ListenerConfig struct {
+	Listen string            `json:"listen" yaml:"listen"`
+	Socket *UnixSocketConfig `json:"socket,omitempty" yaml:"socket,omitempty"`
+	Tls    *TlsConfig        `json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	Upstream *UpstreamConfig `json:"upstream,omitempty" yaml:"upstream,omitempty"`
+	Routes   *RouterConfig   `json:"routes,omitempty" yaml:"routes,omitempty"`
+
+	Acl          *AclConfig          `json:"acl,omitempty" yaml:"acl,omitempty"`
+	Destinations *DestinationsConfig `json:"destinations,omitempty" yaml:"destinations,omitempty"`
+	Limits       *LimitsConfig       `json:"limits,omitempty" yaml:"limits,omitempty"`
+	Quotas       *QuotaConfig        `json:"quotas,omitempty" yaml:"quotas,omitempty"`
+}
+
+// listenerConfig returns a config with only the settings of the listener at idx, its errors name the settings of the listener
+func (c *ServerConfig) listenerConfig(idx int) *ServerConfig {
+	l := c.Listeners[idx]
+	config := &ServerConfig{
+		Pools:    c.Pools,
+		Routes:   l.Routes,
+		Acl:      l.Acl,
+		Quotas:   l.Quotas,
+		Socket:   l.Socket,
+		Tls:      l.Tls,
+		path:     c.path,
+		prefix:   fmt.Sprintf("listeners[%d]", idx),
+		lines:    c.lines,
+		env:      c.env,
+		built:    c.built,
+		previous: c.previous,
+	}
+	if l.Upstream != nil {
+		config.Upstream = *l.Upstream
+	}
+	if l.Destinations != nil {
+		config.Destinations = *l.Destinations
+	}
+	if l.Limits != nil {
+		config.Limits = *l.Limits
+	}
+	return config
+}
+
+// UpstreamConfig is the upstream of requests going through the server's finder, only one source of credentials can be given
+type UpstreamConfig struct {
+	// Host is a fixed upstream, without it the Finder is used
+	Host   string        `json:"host,omitempty" yaml:"host,omitempty"`
+	Finder *FinderConfig `json:"finder,omitempty" yaml:"finder,omitempty"`
+
+	Credentials *Credentials `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+	// CredentialsFile is read with NewFileCredentials
+	CredentialsFile string `json:"credentialsFile,omitempty" yaml:"credentialsFile,omitempty"`
+	// CredentialsHelper is a command and its arguments printing the credentials, see NewCommandCredentials
+	CredentialsHelper []string `json:"credentialsHelper,omitempty" yaml:"credentialsHelper,omitempty"`
+	// Pool are the accounts of a CredentialPool
+	Pool         []Credentials      `json:"pool,omitempty" yaml:"pool,omitempty"`
+	PoolStrategy CredentialStrategy `json:"poolStrategy,omitempty" yaml:"poolStrategy,omitempty"`
+}
+
+// HasCredentials returns whether any source of credentials is configured
+func (u UpstreamConfig) HasCredentials() bool {
+	return u.Credentials != nil || u.CredentialsFile != "" || len(u.CredentialsHelper) > 0 || len(u.Pool) > 0
+}
+
+// FinderConfig chooses the upstreams
+type FinderConfig struct {
+	// Type is "nordvpn" (default), "static", "srv" or "jsonApi"
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// File, Tags and ReloadInterval configure a static finder, see NewStaticFinder
+	File           string        `json:"file,omitempty" yaml:"file,omitempty"`
+	Tags           []string      `json:"tags,omitempty" yaml:"tags,omitempty"`
+	ReloadInterval time.Duration `json:"reloadInterval,omitempty" yaml:"reloadInterval,omitempty"`
+
+	// Name and Resolver configure an srv finder, see NewSrvFinder
+	Name     string `json:"name,omitempty" yaml:"name,omitempty"`
+	Resolver string `json:"resolver,omitempty" yaml:"resolver,omitempty"`
+
+	JsonApi *JsonApiConfig `json:"jsonApi,omitempty" yaml:"jsonApi,omitempty"`
+
+	// Timeout limits a fetch of the server list of a nordvpn or jsonApi finder, default is 30 seconds
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// Sticky pins users to the upstreams of the finder
+	Sticky *StickyConfig `json:"sticky,omitempty" yaml:"sticky,omitempty"`
+}
+
+// StickyConfig configures a StickyFinder
+type StickyConfig struct {
+	// Key is "username" (default), "client" or "session"
+	Key              string        `json:"key,omitempty" yaml:"key,omitempty"`
+	IdleTTL          time.Duration `json:"idleTTL,omitempty" yaml:"idleTTL,omitempty"`
+	RotationInterval time.Duration `json:"rotationInterval,omitempty" yaml:"rotationInterval,omitempty"`
+	RotationCount    int           `json:"rotationCount,omitempty" yaml:"rotationCount,omitempty"`
+}
+
+var stickyKeys = map[string]StickyKeyFunc{"username": StickyByUsername, "client": StickyByClientIP, "session": StickyBySessionId}
+
+// DestinationsConfig configures the DestinationPolicy
+type DestinationsConfig struct {
+	// Allow are exceptions from the blocked networks, see NewDestinationPolicy
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	// Unrestricted disables the policy, so clients can reach private networks
+	Unrestricted bool `json:"unrestricted,omitempty" yaml:"unrestricted,omitempty"`
+	// UpstreamResolves leaves domains routed through an upstream to the upstream, see DestinationPolicy
+	UpstreamResolves bool `json:"upstreamResolves,omitempty" yaml:"upstreamResolves,omitempty"`
+}
+
+// LimitsConfig protects the server from too many or misbehaving clients
+type LimitsConfig struct {
+	OpenConnections uint32  `json:"openConnections,omitempty" yaml:"openConnections,omitempty"`
+	ConnectionRate  float64 `json:"connectionRate,omitempty" yaml:"connectionRate,omitempty"`
+	ConnectionBurst int     `json:"connectionBurst,omitempty" yaml:"connectionBurst,omitempty"`
+	// HandshakeTimeout is 10 seconds if it is not set, 0 disables it
+	HandshakeTimeout *time.Duration `json:"handshakeTimeout,omitempty" yaml:"handshakeTimeout,omitempty"`
+	// BanAfterErrors protocol errors within BanWindow ban a client for BanDuration, see WithProtocolErrorBan
+	BanAfterErrors int           `json:"banAfterErrors,omitempty" yaml:"banAfterErrors,omitempty"`
+	BanWindow      time.Duration `json:"banWindow,omitempty" yaml:"banWindow,omitempty"`
+	BanDuration    time.Duration `json:"banDuration,omitempty" yaml:"banDuration,omitempty"`
+}
+
+// LogConfig configures the log output of the server command
+type LogConfig struct {
+	// Level is "debug", "info" (default), "warn" or "error"
+	Level string `json:"level,omitempty" yaml:"level,omitempty"`
+	// Format is "text" (default) or "json"
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+}
+
+func (l LogConfig) level() (slog.Level, error) {
+	var level slog.Level
+	if l.Level == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(l.Level))
+	return level, err
+}
+
+// SlogLevel returns the configured level, info if it is not set
+func (l LogConfig) SlogLevel() slog.Level {
+	level, _ := l.level()
+	return level
+}
+
+// Handler returns a slog handler writing to w in the configured format
+// With a nil level the configured one is used, a slog.LevelVar allows to change it on reload
+func (l LogConfig) Handler(w io.Writer, level slog.Leveler) slog.Handler {
+	if level == nil {
+		level = l.SlogLevel()
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if l.Format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// envPrefix is the prefix of the environment variables overriding settings
+const envPrefix = "SOCKSAUTH"
+
+// LoadServerConfig reads the configuration from a YAML, JSON or TOML file (by its extension, YAML is the default) and validates it.
+// Unknown fields and invalid values are errors naming their line.
+//
+// Every setting can be overridden by an environment variable named by its path in upper snake case,
+// like SOCKSAUTH_LIMITS_HANDSHAKE_TIMEOUT for limits.handshakeTimeout. Values which are not strings are YAML,
+// so SOCKSAUTH_DESTINATIONS_ALLOW="[10.1.0.0/16, db.internal]" sets a list. Without a path only the environment is read.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	config := &ServerConfig{path: path, lines: make(map[string]int), env: make(map[string]string)}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ToLower(filepath.Ext(path)) == ".toml" {
+			err = config.decodeToml(data)
+		} else {
+			err = config.decodeYaml(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	environment := make(map[string]string)
+	for _, entry := range os.Environ() {
+		if name, value, ok := strings.Cut(entry, "="); ok && strings.HasPrefix(name, envPrefix+"_") {
+			environment[name] = value
+		}
+	}
+	if err := config.applyEnv(reflect.ValueOf(config).Elem(), envPrefix, "", environment); err != nil {
+		return nil, err
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *ServerConfig) decodeYaml(data []byte) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	recordYamlLines(&root, "", c.lines)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(c)
+	var typeErr *yaml.TypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil
+	case errors.As(err, &typeErr):
+		return errors.New(strings.Join(typeErr.Errors, "; "))
+	}
+	return err
+}
+
+// recordYamlLines records the lines of all keys and list items below node
+func recordYamlLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			recordYamlLines(child, path, lines)
+		}
+	case yaml.MappingNode:
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			childPath := joinConfigPath(path, node.Content[idx].Value)
+			lines[childPath] = node.Content[idx].Line
+			recordYamlLines(node.Content[idx+1], childPath, lines)
+		}
+	case yaml.SequenceNode:
+		for idx, child := range node.Content {
+			childPath := fmt.Sprintf("%s[%d]", path, idx)
+			lines[childPath] = child.Line
+			recordYamlLines(child, childPath, lines)
+		}
+	}
+}
+
+func (c *ServerConfig) decodeToml(data []byte) error {
+	metadata, err := toml.NewDecoder(bytes.NewReader(data)).Decode(c)
+	if err != nil {
+		// the errors of the decoder name their line already
+		return errors.New(strings.TrimPrefix(err.Error(), "toml: "))
+	}
+
+	c.lines = tomlLines(data)
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		key := undecoded[0].String()
+		if line, ok := c.line(key); ok {
+			return fmt.Errorf("line %d: unknown field %s", line, key)
+		}
+		return fmt.Errorf("unknown field %s", key)
+	}
+	return nil
+}
+
+// tomlLines finds the lines of the tables and keys of a TOML file, multi-line values are not parsed
+func tomlLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	table := ""
+	tableCount := make(map[string]int)
+	for idx, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[["):
+			name := strings.TrimSpace(strings.Trim(line, "[] "))
+			table = fmt.Sprintf("%s[%d]", name, tableCount[name])
+			tableCount[name]++
+			lines[table] = idx + 1
+			if _, ok := lines[name]; !ok {
+				lines[name] = idx + 1
+			}
+		case strings.HasPrefix(line, "["):
+			table = strings.TrimSpace(strings.Trim(line, "[] "))
+			lines[table] = idx + 1
+		default:
+			key, _, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			path := joinConfigPath(table, strings.Trim(strings.TrimSpace(key), `"'`))
+			if _, ok := lines[path]; !ok {
+				lines[path] = idx + 1
+			}
+		}
+	}
+	return lines
+}
+
+func joinConfigPath(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
+
+// line returns the line of the setting or the closest setting containing it
+func (c *ServerConfig) line(path string) (int, bool) {
+	for path != "" {
+		if line, ok := c.lines[path]; ok {
+			return line, true
+		}
+		if idx := strings.LastIndexAny(path, ".["); idx >= 0 {
+			path = path[:idx]
+		} else {
+			path = ""
+		}
+	}
+	return 0, false
+}
+
+// errorf creates an error for the setting at path, naming where it was set
+func (c *ServerConfig) errorf(path string, format string, args ...any) error {
+	err := fmt.Errorf(format, args...)
+	path = joinConfigPath(c.prefix, path)
+	for candidate := path; candidate != ""; {
+		if name, ok := c.env[candidate]; ok {
+			return fmt.Errorf("%s: %s: %w", name, path, err)
+		}
+		if idx := strings.LastIndexAny(candidate, ".["); idx >= 0 {
+			candidate = candidate[:idx]
+		} else {
+			candidate = ""
+		}
+	}
+	if line, ok := c.line(path); ok {
+		return fmt.Errorf("%s: line %d: %s: %w", c.path, line, path, err)
+	}
+	if c.path != "" {
+		return fmt.Errorf("%s: %s: %w", c.path, path, err)
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+// applyEnv overrides the fields of the struct v with the environment variables named by prefix and their YAML names
+func (c *ServerConfig) applyEnv(v reflect.Value, prefix, path string, environment map[string]string) error {
+	t := v.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		envName := prefix + "_" + upperSnakeCase(name)
+		fieldPath := joinConfigPath(path, name)
+		value := v.Field(idx)
+
+		if raw, ok := environment[envName]; ok {
+			if value.Kind() == reflect.String {
+				value.SetString(raw)
+			} else if err := yaml.Unmarshal([]byte(raw), value.Addr().Interface()); err != nil {
+				return fmt.Errorf("%s: %s", envName, strings.TrimPrefix(err.Error(), "yaml: "))
+			}
+			c.env[fieldPath] = envName
+			continue
+		}
+
+		structType := field.Type
+		if structType.Kind() == reflect.Pointer {
+			structType = structType.Elem()
+		}
+		if structType.Kind() != reflect.Struct || !hasEnvPrefix(environment, envName+"_") {
+			continue
+		}
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				value.Set(reflect.New(structType))
+			}
+			value = value.Elem()
+		}
+		if err := c.applyEnv(value, envName, fieldPath, environment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasEnvPrefix(environment map[string]string, prefix string) bool {
+	for name := range environment {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// upperSnakeCase converts a camel case name like "handshakeTimeout" to "HANDSHAKE_TIMEOUT", acronyms stay together ("idleTTL" is "IDLE_TTL")
+func upperSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for idx, r := range runes {
+		if idx > 0 && unicode.IsUpper(r) {
+			previousLower := !unicode.IsUpper(runes[idx-1])
+			nextLower := idx+1 < len(runes) && unicode.IsLower(runes[idx+1])
+			if previousLower || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// validate checks the settings which can be checked without reading other files or starting anything
+func (c *ServerConfig) validate() error {
+	if _, err := c.Log.level(); err != nil {
+		return c.errorf("log.level", "unknown level %q", c.Log.Level)
+	}
+	if c.Log.Format != "" && c.Log.Format != "text" && c.Log.Format != "json" {
+		return c.errorf("log.format", "unknown format %q", c.Log.Format)
+	}
+
+	for name, pool := range c.Pools {
+		if err := c.validateFinder("pools."+name, pool); err != nil {
+			return err
+		}
+	}
+	if err := c.validateProfile(); err != nil {
+		return err
+	}
+	if err := c.Bandwidth.validate(); err != nil {
+		return c.errorf("bandwidth", "%w", err)
+	}
+	if c.Allocations.IdleTTL < 0 || c.Allocations.Max < 0 {
+		return c.errorf("allocations", "idleTTL and max can not be negative")
+	}
+
+	addrs := []string{c.Listen}
+	if c.Listen == "" {
+		addrs[0] = ":1080"
+	}
+	if c.Listen == unixScheme {
+		return c.errorf("listen", "a unix socket needs a path")
+	}
+	for idx, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", idx)
+		if l.Listen == "" {
+			return c.errorf(path, "listen is required")
+		}
+		if l.Listen == unixScheme {
+			return c.errorf(path+".listen", "a unix socket needs a path")
+		}
+		if contains(addrs, l.Listen) {
+			return c.errorf(path+".listen", "address %s is used twice", l.Listen)
+		}
+		addrs = append(addrs, l.Listen)
+		if err := c.listenerConfig(idx).validateProfile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateProfile checks the settings a listener can have
+func (c *ServerConfig) validateProfile() error {
+	if err := c.validateUpstream(); err != nil {
+		return err
+	}
+	if c.Routes != nil {
+		pools := make(map[string]ServerFinder, len(c.Pools))
+		for name := range c.Pools {
+			pools[name] = nil
+		}
+		if _, err := NewRouter(*c.Routes, pools); err != nil {
+			return c.errorf("routes", "%w", err)
+		}
+	}
+
+	if c.Acl != nil {
+		if _, err := NewAcl(*c.Acl); err != nil {
+			return c.errorf("acl", "%w", err)
+		}
+	}
+	if c.Destinations.Unrestricted && len(c.Destinations.Allow) > 0 {
+		return c.errorf("destinations.allow", "allow has no effect on unrestricted destinations")
+	}
+	if c.Destinations.Unrestricted && c.Destinations.UpstreamResolves {
+		return c.errorf("destinations.upstreamResolves", "upstreamResolves has no effect on unrestricted destinations")
+	}
+	if _, err := NewDestinationPolicy(c.Destinations.Allow...); err != nil {
+		return c.errorf("destinations.allow", "%w", err)
+	}
+
+	limits := c.Limits
+	if limits.ConnectionRate < 0 || limits.ConnectionBurst < 0 || limits.BanAfterErrors < 0 {
+		return c.errorf("limits", "limits can not be negative")
+	}
+	if limits.HandshakeTimeout != nil && *limits.HandshakeTimeout < 0 {
+		return c.errorf("limits.handshakeTimeout", "timeout can not be negative")
+	}
+	if limits.BanAfterErrors > 0 && (limits.BanWindow <= 0 || limits.BanDuration <= 0) {
+		return c.errorf("limits.banAfterErrors", "banWindow and banDuration are required")
+	}
+
+	if c.Quotas != nil && c.Quotas.Action != "" && c.Quotas.Action != QuotaReject && c.Quotas.Action != QuotaThrottle {
+		return c.errorf("quotas.action", "unknown action %q", c.Quotas.Action)
+	}
+
+	if c.Socket != nil {
+		if c.Socket.Mode&^os.ModePerm != 0 {
+			return c.errorf("socket.mode", "mode %o has more than permission bits", c.Socket.Mode)
+		}
+		if _, _, err := c.Socket.owner(); err != nil {
+			return c.errorf("socket", "%w", err)
+		}
+	}
+
+	if c.Tls != nil {
+		if c.Tls.CertFile == "" || c.Tls.KeyFile == "" {
+			return c.errorf("tls", "certFile and keyFile are required")
+		}
+		if c.Tls.OptionalClientCert && c.Tls.ClientCaFile == "" {
+			return c.errorf("tls.optionalClientCert", "an optional client certificate needs a clientCaFile")
+		}
+	}
+	return nil
+}
+
+func (c *ServerConfig) validateUpstream() error {
+	upstream := c.Upstream
+	sources := 0
+	for _, given := range []bool{upstream.Credentials != nil, upstream.CredentialsFile != "", len(upstream.CredentialsHelper) > 0, len(upstream.Pool) > 0} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return c.errorf("upstream", "only one of credentials, credentialsFile, credentialsHelper and pool can be given")
+	}
+	if upstream.Credentials != nil && upstream.Credentials.Username == "" {
+		return c.errorf("upstream.credentials", "username is required")
+	}
+	for idx, account := range upstream.Pool {
+		if account.Username == "" {
+			return c.errorf(fmt.Sprintf("upstream.pool[%d]", idx), "username is required")
+		}
+	}
+	if upstream.PoolStrategy != "" && upstream.PoolStrategy != CredentialsRoundRobin && upstream.PoolStrategy != CredentialsLeastUsed {
+		return c.errorf("upstream.poolStrategy", "unknown strategy %q", upstream.PoolStrategy)
+	}
+
+	if upstream.Finder == nil {
+		return nil
+	}
+	if upstream.Host != "" {
+		return c.errorf("upstream.finder", "a finder can not be used with a fixed host")
+	}
+	return c.validateFinder("upstream.finder", *upstream.Finder)
+}
+
+func (c *ServerConfig) validateFinder(path string, finder FinderConfig) error {
+	switch finder.Type {
+	case "", "nordvpn":
+	case "static":
+		if finder.File == "" {
+			return c.errorf(path, "a static finder needs a file")
+		}
+	case "srv":
+		if finder.Name == "" {
+			return c.errorf(path, "an srv finder needs a name")
+		}
+	case "jsonApi":
+		if finder.JsonApi == nil {
+			return c.errorf(path, "a jsonApi finder needs its jsonApi settings")
+		}
+	default:
+		return c.errorf(path+".type", "unknown finder type %q", finder.Type)
+	}
+
+	if finder.Timeout < 0 {
+		return c.errorf(path+".timeout", "timeout can not be negative")
+	}
+	if finder.Sticky != nil && finder.Sticky.Key != "" && stickyKeys[finder.Sticky.Key] == nil {
+		return c.errorf(path+".sticky.key", "unknown key %q", finder.Sticky.Key)
+	}
+	return nil
+}
+
+// Reuse makes Options keep the finders and credential sources previous created whose settings did not change,
+// so a reload keeps their state like sticky sessions, cooldowns and fetched server lists
+func (c *ServerConfig) Reuse(previous *ServerConfig) {
+	c.previous = previous.built
+}
+
+// reuse returns the component created for the settings at path by the previous config if the settings did not change, otherwise it builds a new one
+func reuse[T any](c *ServerConfig, path string, settings any, build func() (T, error)) (T, error) {
+	path = joinConfigPath(c.prefix, path)
+	if previous, ok := c.previous[path]; ok && reflect.DeepEqual(previous.settings, settings) {
+		c.built[path] = previous
+		return previous.value.(T), nil
+	}
+	value, err := build()
+	if err == nil {
+		c.built[path] = configComponent{settings: settings, value: value}
+	}
+	return value, err
+}
+
+// Options creates the server options of the configuration, files it references (like the upstreams of a static finder) are read now
+func (c *ServerConfig) Options() ([]ServerOption, error) {
+	c.built = make(map[string]configComponent)
+	var opts []ServerOption
+	if c.Listen != "" {
+		opts = append(opts, WithAddr(c.Listen))
+	}
+	pools, err := c.pools()
+	if err != nil {
+		return nil, err
+	}
+	profile, err := c.profileOptions(pools)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, profile...)
+	opts = append(opts, WithBandwidthLimits(c.Bandwidth), WithAllocations(c.Allocations))
+
+	for idx, l := range c.Listeners {
+		listenerOpts, err := c.listenerConfig(idx).profileOptions(pools)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithListener(l.Listen, listenerOpts...))
+	}
+	return opts, nil
+}
+
+// pools creates the finders of the pools once, so the routes of all listeners share them and their state
+func (c *ServerConfig) pools() (map[string]ServerFinder, error) {
+	routed := c.Routes != nil
+	for _, l := range c.Listeners {
+		routed = routed || l.Routes != nil
+	}
+	if !routed {
+		return nil, nil
+	}
+
+	pools := make(map[string]ServerFinder, len(c.Pools))
+	for name, pool := range c.Pools {
+		finder, err := c.finder("pools."+name, pool)
+		if err != nil {
+			return nil, err
+		}
+		pools[name] = finder
+	}
+	return pools, nil
+}
+
+// profileOptions creates the options of the settings a listener can have, routes use the shared pools
+func (c *ServerConfig) profileOptions(pools map[string]ServerFinder) ([]ServerOption, error) {
+	var opts []ServerOption
+	if c.Upstream.Finder != nil {
+		finder, err := c.finder("upstream.finder", *c.Upstream.Finder)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithFinder(finder))
+	} else if host := c.Upstream.Host; host != "" {
+		// as an option instead of the remoteHost of NewServer, so a reload can change it
+		opts = append(opts, WithServerFinder(func(ctx context.Context) (string, error) { return host, nil }))
+	}
+	if c.Routes != nil {
+		router, err := NewRouter(*c.Routes, pools)
+		if err != nil {
+			return nil, c.errorf("routes", "%w", err)
+		}
+		opts = append(opts, WithRouter(router))
+	}
+
+	credentials, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, credentials...)
+
+	if c.Acl != nil {
+		acl, err := NewAcl(*c.Acl)
+		if err != nil {
+			return nil, c.errorf("acl", "%w", err)
+		}
+		opts = append(opts, WithAcl(acl))
+	}
+	if c.Destinations.Unrestricted {
+		opts = append(opts, WithDestinationPolicy(nil))
+	} else if len(c.Destinations.Allow) > 0 || c.Destinations.UpstreamResolves {
+		policy, err := NewDestinationPolicy(c.Destinations.Allow...)
+		if err != nil {
+			return nil, c.errorf("destinations.allow", "%w", err)
+		}
+		policy.UpstreamResolves = c.Destinations.UpstreamResolves
+		opts = append(opts, WithDestinationPolicy(policy))
+	}
+
+	limits := c.Limits
+	if limits.OpenConnections > 0 {
+		opts = append(opts, WithOpenConnLimit(limits.OpenConnections))
+	}
+	if limits.ConnectionRate > 0 {
+		opts = append(opts, WithConnRateLimit(limits.ConnectionRate, limits.ConnectionBurst))
+	}
+	if limits.HandshakeTimeout != nil {
+		opts = append(opts, WithHandshakeTimeout(*limits.HandshakeTimeout))
+	}
+	if limits.BanAfterErrors > 0 {
+		opts = append(opts, WithProtocolErrorBan(limits.BanAfterErrors, limits.BanWindow, limits.BanDuration))
+	}
+	if c.Socket != nil {
+		opts = append(opts, WithUnixSocket(*c.Socket))
+	}
+	if c.Tls != nil {
+		certificates, err := NewTlsCertificates(*c.Tls)
+		if err != nil {
+			return nil, c.errorf("tls", "%w", err)
+		}
+		opts = append(opts, WithTls(certificates))
+	}
+
+	if c.Quotas != nil {
+		quotas, err := NewQuotas(*c.Quotas)
+		if err != nil {
+			return nil, c.errorf("quotas", "%w", err)
+		}
+		opts = append(opts, WithQuotas(quotas))
+	}
+	return opts, nil
+}
+
+func (c *ServerConfig) finder(path string, config FinderConfig) (ServerFinder, error) {
+	return reuse(c, path, config, func() (ServerFinder, error) { return c.newFinder(path, config) })
+}
+
+func (c *ServerConfig) newFinder(path string, config FinderConfig) (ServerFinder, error) {
+	var client *http.Client
+	if config.Timeout > 0 {
+		client = &http.Client{Timeout: config.Timeout}
+	}
+
+	var finder ServerFinder
+	switch config.Type {
+	case "", "nordvpn":
+		finder = NewNordVpnFinder("", client, "")
+	case "static":
+		opts := []StaticOption{WithStaticTags(config.Tags...)}
+		if config.ReloadInterval > 0 {
+			opts = append(opts, WithReloadInterval(config.ReloadInterval))
+		}
+		static, err := NewStaticFinder(config.File, opts...)
+		if err != nil {
+			return nil, c.errorf(path+".file", "%w", err)
+		}
+		finder = static
+	case "srv":
+		var opts []SrvOption
+		if config.Resolver != "" {
+			opts = append(opts, WithResolver(config.Resolver))
+		}
+		finder = NewSrvFinder(config.Name, opts...)
+	case "jsonApi":
+		jsonApi, err := NewJsonApiFinder(*config.JsonApi, client, "")
+		if err != nil {
+			return nil, c.errorf(path+".jsonApi", "%w", err)
+		}
+		finder = jsonApi
+	}
+
+	if sticky := config.Sticky; sticky != nil {
+		key := StickyByUsername
+		if sticky.Key != "" {
+			key = stickyKeys[sticky.Key]
+		}
+		finder = NewStickyFinder(finder, key, sticky.IdleTTL, WithRotationInterval(sticky.RotationInterval), WithRotationCount(sticky.RotationCount))
+	}
+	return finder, nil
+}
+
+func (c *ServerConfig) credentials() ([]ServerOption, error) {
+	settings := c.Upstream
+	settings.Host, settings.Finder = "", nil
+	return reuse(c, "upstream.credentials", settings, c.newCredentials)
+}
+
+func (c *ServerConfig) newCredentials() ([]ServerOption, error) {
+	upstream := c.Upstream
+	switch {
+	case upstream.Credentials != nil:
+		return []ServerOption{WithCredentialProvider(StaticCredentials(*upstream.Credentials))}, nil
+	case upstream.CredentialsFile != "":
+		provider, err := NewFileCredentials(upstream.CredentialsFile)
+		if err != nil {
+			return nil, c.errorf("upstream.credentialsFile", "%w", err)
+		}
+		return []ServerOption{WithCredentialProvider(provider)}, nil
+	case len(upstream.CredentialsHelper) > 0:
+		provider := NewCommandCredentials(time.Minute, upstream.CredentialsHelper[0], upstream.CredentialsHelper[1:]...)
+		return []ServerOption{WithCredentialProvider(provider)}, nil
+	case len(upstream.Pool) > 0:
+		var opts []CredentialPoolOption
+		if upstream.PoolStrategy != "" {
+			opts = append(opts, WithCredentialStrategy(upstream.PoolStrategy))
+		}
+		pool, err := NewCredentialPool(upstream.Pool, opts...)
+		if err != nil {
+			return nil, c.errorf("upstream.pool", "%w", err)
+		}
+		return []ServerOption{WithCredentialPool(pool)}, nil
+	}
+	return nil, nil
+}
+
+// NewServerFromConfig creates a server from the configuration, opts are applied after the ones of the configuration
+func NewServerFromConfig(config *ServerConfig, opts ...ServerOption) (*Server, error) {
+	configOpts, err := config.Options()
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(config.Upstream.Host, "", "", append(configOpts, opts...)...), nil
+}
@@ -0,0 +1,180 @@
+package socksauth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfigThroughServer(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+	static := writeFile(t, "upstreams.yaml", fmt.Sprintf("- addr: %s\n  username: user\n  password: pass\n", upstream.Addr))
+
+	config, err := LoadServerConfig(writeFile(t, "config.yaml", fmt.Sprintf(`
+listen: 127.0.0.1:0
+upstream:
+  host: %s
+  credentials:
+    username: user
+    password: pass
+pools:
+  static:
+    type: static
+    file: %s
+routes:
+  rules:
+    - name: local
+      cidrs: [127.0.0.0/8]
+      action: upstream
+      pool: static
+destinations:
+  allow: [127.0.0.0/8]
+limits:
+  handshakeTimeout: 2s
+  banAfterErrors: 3
+  banWindow: 1m
+  banDuration: 10m
+acl:
+  destinations:
+    - action: deny
+      ports: ["22"]
+`, upstream.Addr, static)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Limits.HandshakeTimeout == nil || *config.Limits.HandshakeTimeout != 2*time.Second {
+		t.Errorf("expected the handshake timeout to be read, got %v", config.Limits.HandshakeTimeout)
+	}
+
+	server, err := NewServerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	proxyAddr := startServer(t, ctx, server)
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	if _, err := dialSocks(proxyAddr, "127.0.0.1:22", "", ""); err != socksReplyError(_CONN_NOT_ALLOWED_BY_RULESET) {
+		t.Errorf("expected the ACL of the config to deny the request, got %v", err)
+	}
+}
+
+func TestServerConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": "listen: :1081\nlimits:\n  connectionRate: 5\nlog:\n  level: debug\n",
+		"config.json": "{\n\t\"listen\": \":1081\",\n\t\"limits\": {\"connectionRate\": 5},\n\t\"log\": {\"level\": \"debug\"}\n}",
+		"config.toml": "listen = \":1081\"\n\n[limits]\nconnectionRate = 5\n\n[log]\nlevel = \"debug\"\n",
+	}
+	for name, content := range files {
+		config, err := LoadServerConfig(writeFile(t, name, content))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if config.Listen != ":1081" || config.Limits.ConnectionRate != 5 || config.Log.Level != "debug" {
+			t.Errorf("%s: unexpected config %+v", name, config)
+		}
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	files := map[string]string{
+		"unknown.yaml":  "listen: :1080\nlimits:\n  handshakeTimout: 5s\n",
+		"type.json":     "{\n  \"limits\": {\n    \"connectionRate\": \"fast\"\n  }\n}",
+		"syntax.yaml":   "listen: :1080\n  upstream: [\n",
+		"finder.yaml":   "upstream:\n  finder:\n    type: magic\n",
+		"acl.yaml":      "listen: :1080\n\nacl:\n  destinations:\n    - action: maybe\n",
+		"unknown.toml":  "listen = \":1080\"\n\n[limits]\nhandshakeTimout = \"5s\"\n",
+		"finder.toml":   "[upstream.finder]\ntype = \"magic\"\n",
+		"syntax.toml":   "listen = :1080\n",
+		"type.toml":     "[limits]\nconnectionRate = \"fast\"\n",
+		"sources.yaml":  "upstream:\n  credentials:\n    username: user\n  credentialsFile: creds.json\n",
+		"duration.yaml": "limits:\n  handshakeTimeout: 5\n",
+		"socket.yaml":   "listen: unix:///run/socksauth.sock\nsocket:\n  mode: 04755\n",
+		"timeout.yaml":  "upstream:\n  finder:\n    timeout: -5s\n",
+	}
+	lines := map[string]int{
+		"unknown.yaml":  3,
+		"type.json":     3,
+		"syntax.yaml":   2,
+		"finder.yaml":   3,
+		"acl.yaml":      3,
+		"unknown.toml":  4,
+		"finder.toml":   2,
+		"syntax.toml":   1,
+		"type.toml":     2,
+		"sources.yaml":  1,
+		"duration.yaml": 2,
+		"socket.yaml":   3,
+		"timeout.yaml":  3,
+	}
+	for name, content := range files {
+		_, err := LoadServerConfig(writeFile(t, name, content))
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+			continue
+		}
+		if expected := fmt.Sprintf("line %d", lines[name]); !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected the error to name %s, got %v", name, expected, err)
+		}
+	}
+
+	config, err := LoadServerConfig(writeFile(t, "missing.yaml", "upstream:\n  credentialsFile: /does/not/exist\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Options(); err == nil || !strings.Contains(err.Error(), "upstream.credentialsFile") {
+		t.Errorf("expected building the options to fail for the missing file, got %v", err)
+	}
+}
+
+func TestServerConfigEnvOverrides(t *testing.T) {
+	t.Setenv("SOCKSAUTH_LISTEN", ":2000")
+	t.Setenv("SOCKSAUTH_LIMITS_HANDSHAKE_TIMEOUT", "3s")
+	t.Setenv("SOCKSAUTH_DESTINATIONS_ALLOW", "[10.1.0.0/16, db.internal]")
+	t.Setenv("SOCKSAUTH_UPSTREAM_CREDENTIALS_USERNAME", "alice")
+	t.Setenv("SOCKSAUTH_QUOTAS_DEFAULT_DAILY", "1000")
+
+	config, err := LoadServerConfig(writeFile(t, "config.yaml", "listen: :1080\nlimits:\n  connectionRate: 5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":2000" || config.Limits.ConnectionRate != 5 || *config.Limits.HandshakeTimeout != 3*time.Second {
+		t.Errorf("expected the environment to override the file, got %+v", config)
+	}
+	if len(config.Destinations.Allow) != 2 || config.Destinations.Allow[1] != "db.internal" {
+		t.Errorf("expected a list from the environment, got %v", config.Destinations.Allow)
+	}
+	if config.Upstream.Credentials == nil || config.Upstream.Credentials.Username != "alice" || config.Quotas == nil || config.Quotas.Default.Daily != 1000 {
+		t.Errorf("expected nested settings to be created, got %+v and %+v", config.Upstream.Credentials, config.Quotas)
+	}
+
+	t.Setenv("SOCKSAUTH_LOG_LEVEL", "loud")
+	if _, err := LoadServerConfig(""); err == nil || !strings.Contains(err.Error(), "SOCKSAUTH_LOG_LEVEL") {
+		t.Errorf("expected the error to name the environment variable, got %v", err)
+	}
+	t.Setenv("SOCKSAUTH_LOG_LEVEL", "")
+	t.Setenv("SOCKSAUTH_LIMITS_CONNECTION_BURST", "many")
+	if _, err := LoadServerConfig(""); err == nil || !strings.Contains(err.Error(), "SOCKSAUTH_LIMITS_CONNECTION_BURST") {
+		t.Errorf("expected the error to name the environment variable, got %v", err)
+	}
+}
+
+func TestUpperSnakeCase(t *testing.T) {
+	cases := map[string]string{"listen": "LISTEN", "handshakeTimeout": "HANDSHAKE_TIMEOUT", "jsonApi": "JSON_API", "idleTTL": "IDLE_TTL", "httpProxyURL": "HTTP_PROXY_URL"}
+	for name, expected := range cases {
+		if actual := upperSnakeCase(name); actual != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, actual)
+		}
+	}
+}
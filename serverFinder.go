@@ -0,0 +1,87 @@
+package socksauth
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// Request describes a client's CONNECT request, it is read before the upstream is chosen so finders can take the destination into account
+type Request struct {
+	ClientAddr net.Addr
+	// Username the client authenticated with, it is empty if the client did not authenticate
+	Username string
+	// Identity is the subject of the client's TLS certificate, like "CN=alice,O=Example". It is empty without a verified certificate
+	Identity string
+	// Hints are the routing parameters encoded in the username, they are only set if the server has a UsernameGrammar
+	Hints RoutingHints
+
+	// DestHost and DestPort are empty if the upstream is connected before the client's request is read, see WithClientCredentials
+	DestHost string
+	DestPort int
+}
+
+// Destination returns the requested destination as host:port
+func (r Request) Destination() string {
+	return net.JoinHostPort(r.DestHost, strconv.Itoa(r.DestPort))
+}
+
+// Upstream is a remote SOCKS5 server returned by a ServerFinder
+type Upstream struct {
+	// Addr is the address of the SOCKS5 server, if no port is given 1080 is used
+	Addr string `json:"addr"`
+	// Username and Password are used to authenticate with this upstream instead of the server's remote credentials
+	Username string `json:"username,omitempty"`
+	Password string `json:"-"`
+
+	Country string   `json:"country,omitempty"`
+	City    string   `json:"city,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	// Weight is the relative chance of the upstream to be chosen, 0 counts as 1
+	Weight int `json:"weight,omitempty"`
+	// Priority orders upstreams like SRV records, the lowest priority with a usable upstream is chosen
+	Priority int `json:"priority,omitempty"`
+}
+
+// ServerFinder chooses the upstream SOCKS5 server for a new connection.
+// After the server tried to use the upstream it reports back whether it worked, so implementations can demote bad servers.
+// Implementations have to be safe for concurrent use.
+type ServerFinder interface {
+	Find(ctx context.Context, req Request) (Upstream, error)
+
+	// ReportSuccess is called once the upstream accepted the forwarded request
+	ReportSuccess(upstream Upstream)
+	// ReportFailure is called if the upstream could not be reached, rejected the authentication or broke the SOCKS protocol
+	ReportFailure(upstream Upstream, err SocksError)
+}
+
+// Warmer can be implemented by a ServerFinder to prepare itself (e.g. fill its cache) when the server is created
+type Warmer interface {
+	Warmup(ctx context.Context) error
+}
+
+// FinderFunc adapts a plain function to the ServerFinder interface, it ignores the request and all reports
+type FinderFunc func(ctx context.Context) (string, error)
+
+var (
+	_ ServerFinder = FinderFunc(nil)
+	_ Warmer       = FinderFunc(nil)
+)
+
+func (f FinderFunc) Find(ctx context.Context, req Request) (Upstream, error) {
+	addr, err := f(ctx)
+	if err != nil {
+		return Upstream{}, err
+	}
+	return Upstream{Addr: addr}, nil
+}
+
+func (f FinderFunc) ReportSuccess(upstream Upstream) {}
+
+func (f FinderFunc) ReportFailure(upstream Upstream, err SocksError) {}
+
+// Warmup calls the function once to give it the chance to cache
+func (f FinderFunc) Warmup(ctx context.Context) error {
+	_, err := f(ctx)
+	return err
+}
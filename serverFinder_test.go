@@ -0,0 +1,165 @@
+package socksauth
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type reportingFinder struct {
+	upstreams []Upstream
+
+	mu        sync.Mutex
+	next      int
+	successes []string
+	failures  []string
+}
+
+func (f *reportingFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upstream := f.upstreams[f.next%len(f.upstreams)]
+	f.next++
+	return upstream, nil
+}
+
+func (f *reportingFinder) ReportSuccess(upstream Upstream) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.successes = append(f.successes, upstream.Addr)
+}
+
+func (f *reportingFinder) ReportFailure(upstream Upstream, err SocksError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, upstream.Addr)
+}
+
+func (f *reportingFinder) reports() (successes, failures []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.successes...), append([]string(nil), f.failures...)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestFinderReports(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	good := startMockUpstream(t, "user", "pass")
+	bad := startMockUpstream(t, "other", "secret")
+
+	finder := &reportingFinder{upstreams: []Upstream{{Addr: good.Addr}, {Addr: bad.Addr}}}
+	_, proxyAddr := startTestServer(t, "", "user", "pass", WithFinder(finder))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); err == nil {
+		t.Fatal("expected the connection through the bad upstream to fail")
+	}
+
+	waitFor(t, func() bool {
+		successes, failures := finder.reports()
+		return len(successes) == 1 && len(failures) == 1
+	})
+	successes, failures := finder.reports()
+	if successes[0] != good.Addr {
+		t.Errorf("expected success for %s, got %s", good.Addr, successes[0])
+	}
+	if failures[0] != bad.Addr {
+		t.Errorf("expected failure for %s, got %s", bad.Addr, failures[0])
+	}
+}
+
+func TestFinderFuncAdapter(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	var calls atomic.Int32
+	_, proxyAddr := startTestServer(t, "", "user", "pass", WithServerFinder(func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		return "socks5://" + upstream.Addr, nil
+	}))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	// one call to warm up and one for the connection
+	if calls := calls.Load(); calls != 2 {
+		t.Errorf("expected the finder to be called twice, got %d", calls)
+	}
+}
+
+type destinationFinder struct {
+	local, other Upstream
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+func (f *destinationFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	if req.DestHost == "localhost" {
+		return f.local, nil
+	}
+	return f.other, nil
+}
+
+func (f *destinationFinder) ReportSuccess(upstream Upstream) {}
+
+func (f *destinationFinder) ReportFailure(upstream Upstream, err SocksError) {}
+
+func TestFinderGetsDestination(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+	local := startMockUpstream(t, "user", "pass")
+	other := startMockUpstream(t, "user", "pass")
+
+	finder := &destinationFinder{local: Upstream{Addr: local.Addr}, other: Upstream{Addr: other.Addr}}
+	_, proxyAddr := startTestServer(t, "", "user", "pass", WithFinder(finder))
+
+	for _, destination := range []string{net.JoinHostPort("localhost", echoPort), echoAddr} {
+		conn, err := dialSocks(proxyAddr, destination, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+		conn.Close()
+	}
+
+	if got := local.Destinations(); len(got) != 1 || got[0] != net.JoinHostPort("localhost", echoPort) {
+		t.Errorf("expected localhost to be routed through the local upstream, got %v", got)
+	}
+	if got := other.Destinations(); len(got) != 1 || got[0] != echoAddr {
+		t.Errorf("expected %s to be routed through the other upstream, got %v", echoAddr, got)
+	}
+
+	finder.mu.Lock()
+	defer finder.mu.Unlock()
+	req := finder.requests[0]
+	if req.DestPort == 0 || req.ClientAddr == nil {
+		t.Errorf("expected destination port and client address, got %+v", req)
+	}
+}
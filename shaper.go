@@ -0,0 +1,225 @@
+package socksauth
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Bandwidth is a limit in bytes per second for each direction, 0 means unlimited
+type Bandwidth struct {
+	// Up is the direction from the client to the destination
+	Up int64 `json:"up,omitempty" yaml:"up,omitempty"`
+	// Down is the direction from the destination to the client
+	Down int64 `json:"down,omitempty" yaml:"down,omitempty"`
+}
+
+// BandwidthLimits shape the relayed traffic with token buckets, every connection is limited by all of them.
+// A bucket holds at most a tenth of a second of its rate (at least 1 KiB), so bursts stay short.
+type BandwidthLimits struct {
+	// Global is shared by all connections of the server
+	Global Bandwidth `json:"global" yaml:"global"`
+	// PerUser is shared by the connections of a local user, clients without a username are told apart by their IP
+	PerUser Bandwidth `json:"perUser" yaml:"perUser"`
+	// Users overrides PerUser for single users or IPs
+	Users map[string]Bandwidth `json:"users,omitempty" yaml:"users,omitempty"`
+	// PerConnection limits every connection on its own
+	PerConnection Bandwidth `json:"perConnection" yaml:"perConnection"`
+}
+
+func (l BandwidthLimits) validate() error {
+	bandwidths := map[string]Bandwidth{"global": l.Global, "per user": l.PerUser, "per connection": l.PerConnection}
+	for user, bandwidth := range l.Users {
+		bandwidths["user "+user] = bandwidth
+	}
+	for name, bandwidth := range bandwidths {
+		if bandwidth.Up < 0 || bandwidth.Down < 0 {
+			return fmt.Errorf("%s bandwidth can not be negative", name)
+		}
+	}
+	return nil
+}
+
+func (l BandwidthLimits) user(key string) Bandwidth {
+	if bandwidth, ok := l.Users[key]; ok {
+		return bandwidth
+	}
+	return l.PerUser
+}
+
+// Shaper applies BandwidthLimits to connections, the limits can be changed while connections are open
+type Shaper struct {
+	mu     sync.Mutex
+	limits BandwidthLimits
+	global bucketPair
+	users  map[string]*userBuckets
+	conns  map[*bucketPair]struct{}
+}
+
+type bucketPair struct {
+	up, down *tokenBucket
+}
+
+type userBuckets struct {
+	bucketPair
+	conns int
+}
+
+func newBucketPair(bandwidth Bandwidth) bucketPair {
+	return bucketPair{up: newTokenBucket(bandwidth.Up), down: newTokenBucket(bandwidth.Down)}
+}
+
+func (p bucketPair) set(bandwidth Bandwidth) {
+	p.up.setRate(bandwidth.Up)
+	p.down.setRate(bandwidth.Down)
+}
+
+// NewShaper creates a shaper with the limits
+func NewShaper(limits BandwidthLimits) *Shaper {
+	return &Shaper{
+		limits: limits,
+		global: newBucketPair(limits.Global),
+		users:  make(map[string]*userBuckets),
+		conns:  make(map[*bucketPair]struct{}),
+	}
+}
+
+// Limits returns the current limits
+func (s *Shaper) Limits() BandwidthLimits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits
+}
+
+// SetLimits changes the limits, open connections are shaped with the new limits right away
+func (s *Shaper) SetLimits(limits BandwidthLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limits = limits
+	s.global.set(limits.Global)
+	for key, user := range s.users {
+		user.set(limits.user(key))
+	}
+	for conn := range s.conns {
+		conn.set(limits.PerConnection)
+	}
+}
+
+// connection returns the buckets for both directions of a new connection of the user
+// The returned function has to be called when the connection is closed
+func (s *Shaper) connection(user string) (up, down []*tokenBucket, release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userBucket, ok := s.users[user]
+	if !ok {
+		userBucket = &userBuckets{bucketPair: newBucketPair(s.limits.user(user))}
+		s.users[user] = userBucket
+	}
+	userBucket.conns++
+
+	conn := newBucketPair(s.limits.PerConnection)
+	s.conns[&conn] = struct{}{}
+
+	release = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.conns, &conn)
+		if userBucket.conns--; userBucket.conns == 0 {
+			delete(s.users, user)
+		}
+	}
+	return []*tokenBucket{conn.up, userBucket.up, s.global.up}, []*tokenBucket{conn.down, userBucket.down, s.global.down}, release
+}
+
+// shapedReader delays reads until all buckets have enough tokens for them and counts the read bytes
+type shapedReader struct {
+	reader  io.Reader
+	buckets []*tokenBucket
+	count   func(n int)
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	// a single read must not be larger than the smallest burst
+	for _, bucket := range r.buckets {
+		if burst := bucket.burstSize(); burst > 0 && len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if r.count != nil {
+			r.count(n)
+		}
+		for _, bucket := range r.buckets {
+			bucket.wait(n)
+		}
+	}
+	return n, err
+}
+
+// tokenBucket refills with rate bytes per second up to its burst size, a rate of 0 is unlimited
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	b := &tokenBucket{}
+	b.setRate(rate)
+	return b
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.rate = float64(max(rate, 0))
+	b.burst = max(b.rate/10, 1024)
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// refill adds the tokens since the last refill, the caller has to hold the lock
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	} else {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// burstSize returns the size of the bucket or 0 if it is unlimited
+func (b *tokenBucket) burstSize() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	return int(b.burst)
+}
+
+// wait takes n tokens, if there are not enough it sleeps until they would have been refilled
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	if b.rate == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	time.Sleep(delay)
+}
@@ -0,0 +1,135 @@
+package socksauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(10 * 1024)
+	if burst := bucket.burstSize(); burst != 1024 {
+		t.Fatalf("expected a burst of 1 KiB, got %d", burst)
+	}
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		bucket.wait(1024)
+	}
+	// the first KiB is the burst, the other 5 KiB take half a second
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 800*time.Millisecond {
+		t.Errorf("expected 6 KiB at 10 KiB/s to take about 500ms, took %s", elapsed)
+	}
+
+	bucket.setRate(0)
+	start = time.Now()
+	bucket.wait(1 << 20)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected an unlimited bucket not to wait, took %s", elapsed)
+	}
+}
+
+func TestShaperUserBuckets(t *testing.T) {
+	shaper := NewShaper(BandwidthLimits{
+		PerUser: Bandwidth{Down: 1024 * 1024},
+		Users:   map[string]Bandwidth{"bob": {Down: 100 * 1024}},
+	})
+
+	_, aliceDown, releaseAlice := shaper.connection("alice")
+	_, bobDown1, releaseBob1 := shaper.connection("bob")
+	_, bobDown2, releaseBob2 := shaper.connection("bob")
+
+	if bobDown1[1] != bobDown2[1] {
+		t.Error("expected the connections of a user to share the user bucket")
+	}
+	if bobDown1[0] == bobDown2[0] {
+		t.Error("expected every connection to have its own bucket")
+	}
+	if aliceDown[2] != bobDown1[2] {
+		t.Error("expected all connections to share the global bucket")
+	}
+	if aliceDown[1].burstSize() != 1024*1024/10 || bobDown1[1].burstSize() != 10*1024 {
+		t.Errorf("expected the user override to be used, got bursts %d and %d", aliceDown[1].burstSize(), bobDown1[1].burstSize())
+	}
+
+	shaper.SetLimits(BandwidthLimits{PerConnection: Bandwidth{Down: 20 * 1024}})
+	if bobDown1[1].burstSize() != 0 || bobDown1[0].burstSize() != 2048 {
+		t.Error("expected open connections to get the new limits")
+	}
+
+	releaseAlice()
+	releaseBob1()
+	if len(shaper.users) != 1 {
+		t.Errorf("expected only bob's bucket to be left, got %d", len(shaper.users))
+	}
+	releaseBob2()
+	if len(shaper.users) != 0 || len(shaper.conns) != 0 {
+		t.Errorf("expected all buckets to be released, got %d users and %d connections", len(shaper.users), len(shaper.conns))
+	}
+}
+
+func TestBandwidthLimitsThroughServer(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	server, proxyAddr := startTestServer(t, upstream.Addr, "user", "pass",
+		WithBandwidthLimits(BandwidthLimits{PerConnection: Bandwidth{Down: 32 * 1024}}))
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 3.2 KiB are the burst, the rest takes about 400ms
+	if elapsed := echoTime(t, conn, 16*1024); elapsed < 300*time.Millisecond {
+		t.Errorf("expected the download to be limited, took %s", elapsed)
+	}
+
+	body, _ := json.Marshal(BandwidthLimits{PerConnection: Bandwidth{Down: -1}})
+	if resp := putJson(t, admin.URL+"/limits", body); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected negative limits to be rejected, got status %d", resp.StatusCode)
+	}
+
+	body, _ = json.Marshal(BandwidthLimits{})
+	if resp := putJson(t, admin.URL+"/limits", body); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the limits to be updated, got status %d", resp.StatusCode)
+	}
+	if limits := server.BandwidthLimits(); limits.PerConnection.Down != 0 {
+		t.Errorf("expected the limits to be removed, got %+v", limits)
+	}
+	if elapsed := echoTime(t, conn, 16*1024); elapsed > 200*time.Millisecond {
+		t.Errorf("expected the open connection to be unlimited, took %s", elapsed)
+	}
+}
+
+// echoTime sends size bytes through an echo connection and returns how long it took to read them back
+func echoTime(t *testing.T, conn net.Conn, size int) time.Duration {
+	t.Helper()
+	data := bytes.Repeat([]byte{'x'}, size)
+	start := time.Now()
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func putJson(t *testing.T, url string, body []byte) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
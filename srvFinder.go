@@ -0,0 +1,269 @@
+package socksauth
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SrvFinder chooses upstreams published as DNS SRV records (e.g. "_socks5._tcp.egress.internal").
+// The lowest priority is used as long as it has usable upstreams, within a priority the records are chosen by their weight.
+// The records are resolved again when their TTL expires.
+type SrvFinder struct {
+	name     string
+	resolver string
+	timeout  time.Duration
+	minTTL   time.Duration
+
+	pool *upstreamPool
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+var (
+	_ ServerFinder = (*SrvFinder)(nil)
+	_ Warmer       = (*SrvFinder)(nil)
+)
+
+type SrvOption func(*SrvFinder)
+
+// WithResolver sets the address of the DNS server to query, default is the first nameserver of /etc/resolv.conf
+func WithResolver(addr string) SrvOption {
+	return func(f *SrvFinder) { f.resolver = addr }
+}
+
+// WithMinTTL sets the minimum time records are cached, even if their TTL is lower. Default is 5 seconds
+func WithMinTTL(ttl time.Duration) SrvOption {
+	return func(f *SrvFinder) { f.minTTL = ttl }
+}
+
+// NewSrvFinder creates a finder for the SRV records of name, they are resolved with the first Find or Warmup
+func NewSrvFinder(name string, opts ...SrvOption) *SrvFinder {
+	f := &SrvFinder{
+		name:    name,
+		timeout: 5 * time.Second,
+		minTTL:  5 * time.Second,
+		pool:    newUpstreamPool(time.Minute),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.resolver == "" {
+		f.resolver = systemNameserver()
+	}
+	if _, _, err := net.SplitHostPort(f.resolver); err != nil {
+		f.resolver = net.JoinHostPort(f.resolver, "53")
+	}
+	return f
+}
+
+// Warmup resolves the records
+func (f *SrvFinder) Warmup(ctx context.Context) error {
+	return f.refresh(ctx)
+}
+
+func (f *SrvFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	if err := f.refresh(ctx); err != nil {
+		return Upstream{}, err
+	}
+	return f.pool.pick(req.Hints, nil)
+}
+
+func (f *SrvFinder) ReportSuccess(upstream Upstream) {
+	f.pool.recover(upstream)
+}
+
+// ReportFailure sets the upstream aside for a minute, so the next priority is used if all upstreams of a priority failed
+func (f *SrvFinder) ReportFailure(upstream Upstream, err SocksError) {
+	f.pool.demote(upstream)
+}
+
+// Upstreams returns the upstreams of the last resolved records
+func (f *SrvFinder) Upstreams() []Upstream {
+	return f.pool.all()
+}
+
+// refresh resolves the records if their TTL expired, if that fails previously resolved records are kept
+func (f *SrvFinder) refresh(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Now().Before(f.expires) {
+		return nil
+	}
+
+	upstreams, ttl, err := f.resolve(ctx)
+	if err != nil {
+		if !f.expires.IsZero() {
+			return nil
+		}
+		return err
+	}
+
+	f.pool.set(upstreams)
+	f.expires = time.Now().Add(max(ttl, f.minTTL))
+	return nil
+}
+
+// resolve queries the SRV records and returns them as upstreams with the lowest TTL of the answer
+func (f *SrvFinder) resolve(ctx context.Context) ([]Upstream, time.Duration, error) {
+	name, err := dnsmessage.NewName(dnsName(f.name))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid SRV name %q: %w", f.name, err)
+	}
+
+	response, err := f.exchange(ctx, name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error resolving %s: %w", f.name, err)
+	}
+	if response.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("error resolving %s: %s", f.name, response.RCode)
+	}
+
+	// the additional section may already contain the targets' addresses, which the system resolver might not know
+	addrs := make(map[string]string)
+	for _, resource := range response.Additionals {
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs[resource.Header.Name.String()] = net.IP(body.A[:]).String()
+		case *dnsmessage.AAAAResource:
+			if _, ok := addrs[resource.Header.Name.String()]; !ok {
+				addrs[resource.Header.Name.String()] = net.IP(body.AAAA[:]).String()
+			}
+		}
+	}
+
+	upstreams := make([]Upstream, 0)
+	var ttl uint32
+	for _, resource := range response.Answers {
+		srv, ok := resource.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		if len(upstreams) == 0 || resource.Header.TTL < ttl {
+			ttl = resource.Header.TTL
+		}
+
+		host, ok := addrs[srv.Target.String()]
+		if !ok {
+			host = strings.TrimSuffix(srv.Target.String(), ".")
+		}
+		upstreams = append(upstreams, Upstream{
+			Addr:     net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+			Weight:   int(srv.Weight),
+			Priority: int(srv.Priority),
+		})
+	}
+	if len(upstreams) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records for %s", f.name)
+	}
+	return upstreams, time.Duration(ttl) * time.Second, nil
+}
+
+// exchange sends the query via UDP and repeats it via TCP if the response was truncated
+func (f *SrvFinder) exchange(ctx context.Context, name dnsmessage.Name) (*dnsmessage.Message, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	response, err := f.exchangeOver(ctx, "udp", query, id)
+	if err == nil && response.Truncated {
+		response, err = f.exchangeOver(ctx, "tcp", query, id)
+	}
+	return response, err
+}
+
+func (f *SrvFinder) exchangeOver(ctx context.Context, network string, query []byte, id uint16) (*dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, f.resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var buf []byte
+	if network == "tcp" {
+		// DNS over TCP prefixes messages with their length
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, length)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if response.ID != id {
+		return nil, fmt.Errorf("response id %d does not match query id %d", response.ID, id)
+	}
+	return &response, nil
+}
+
+func dnsName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf or localhost
+func systemNameserver() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
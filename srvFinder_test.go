@@ -0,0 +1,159 @@
+package socksauth
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type srvRecord struct {
+	target           string
+	port             uint16
+	priority, weight uint16
+	addr             [4]byte // put into the additional section if set
+}
+
+// mockDns answers SRV queries over UDP with its current records
+type mockDns struct {
+	Addr    string
+	Queries atomic.Int32
+
+	mu      sync.Mutex
+	records []srvRecord
+	ttl     uint32
+}
+
+func startMockDns(t *testing.T, ttl uint32, records ...srvRecord) *mockDns {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	dns := &mockDns{Addr: conn.LocalAddr().String(), records: records, ttl: ttl}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			dns.Queries.Add(1)
+			response, err := dns.answer(buf[:n])
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return dns
+}
+
+func (d *mockDns) setRecords(records ...srvRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records = records
+}
+
+func (d *mockDns) answer(query []byte) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	question := msg.Questions[0]
+
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true},
+		Questions: msg.Questions,
+	}
+	if len(d.records) == 0 {
+		response.RCode = dnsmessage.RCodeNameError
+	}
+	for _, record := range d.records {
+		target := dnsmessage.MustNewName(record.target)
+		response.Answers = append(response.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: d.ttl},
+			Body:   &dnsmessage.SRVResource{Priority: record.priority, Weight: record.weight, Port: record.port, Target: target},
+		})
+		if record.addr != [4]byte{} {
+			response.Additionals = append(response.Additionals, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: d.ttl},
+				Body:   &dnsmessage.AResource{A: record.addr},
+			})
+		}
+	}
+	return response.Pack()
+}
+
+func TestSrvFinderPriorityAndWeight(t *testing.T) {
+	dns := startMockDns(t, 300,
+		srvRecord{target: "light.egress.internal.", port: 1080, priority: 10, weight: 10},
+		srvRecord{target: "heavy.egress.internal.", port: 1080, priority: 10, weight: 90},
+		srvRecord{target: "backup.egress.internal.", port: 1081, priority: 20, weight: 100, addr: [4]byte{10, 0, 0, 9}},
+	)
+	finder := NewSrvFinder("_socks5._tcp.egress.internal", WithResolver(dns.Addr))
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[findAddr(t, finder, Request{})]++
+	}
+	if counts["10.0.0.9:1081"] != 0 {
+		t.Errorf("expected the higher priority to be unused, got %v", counts)
+	}
+	if counts["heavy.egress.internal:1080"] < 4*counts["light.egress.internal:1080"] {
+		t.Errorf("expected the weights to be honoured, got %v", counts)
+	}
+	if dns.Queries.Load() != 1 {
+		t.Errorf("expected the records to be cached for their TTL, got %d queries", dns.Queries.Load())
+	}
+
+	// the next priority is used once all upstreams of the lowest failed, its target address comes from the additional section
+	finder.ReportFailure(Upstream{Addr: "light.egress.internal:1080"}, ErrEstablishProxyConn)
+	finder.ReportFailure(Upstream{Addr: "heavy.egress.internal:1080"}, ErrEstablishProxyConn)
+	if addr := findAddr(t, finder, Request{}); addr != "10.0.0.9:1081" {
+		t.Errorf("expected the backup upstream, got %s", addr)
+	}
+}
+
+func TestSrvFinderTTL(t *testing.T) {
+	dns := startMockDns(t, 0, srvRecord{target: "old.egress.internal.", port: 1080})
+	finder := NewSrvFinder("_socks5._tcp.egress.internal", WithResolver(dns.Addr), WithMinTTL(10*time.Millisecond))
+
+	if addr := findAddr(t, finder, Request{}); addr != "old.egress.internal:1080" {
+		t.Fatalf("expected the old record, got %s", addr)
+	}
+	dns.setRecords(srvRecord{target: "new.egress.internal.", port: 1080})
+	if addr := findAddr(t, finder, Request{}); addr != "old.egress.internal:1080" {
+		t.Errorf("expected the cached record before the TTL expired, got %s", addr)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if addr := findAddr(t, finder, Request{}); addr != "new.egress.internal:1080" {
+		t.Errorf("expected the records to be resolved again, got %s", addr)
+	}
+
+	// records which can no longer be resolved are kept
+	dns.setRecords()
+	time.Sleep(20 * time.Millisecond)
+	if addr := findAddr(t, finder, Request{}); addr != "new.egress.internal:1080" {
+		t.Errorf("expected the previous records to be kept, got %s", addr)
+	}
+}
+
+func TestSrvFinderNoRecords(t *testing.T) {
+	dns := startMockDns(t, 300)
+	finder := NewSrvFinder("_socks5._tcp.egress.internal", WithResolver(dns.Addr))
+	if _, err := finder.Find(context.Background(), Request{}); err == nil {
+		t.Error("expected an error without records")
+	}
+}
@@ -0,0 +1,243 @@
+package socksauth
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StaticEntry is an upstream in a static upstream file
+type StaticEntry struct {
+	Addr     string   `json:"addr" yaml:"addr"`
+	Username string   `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string   `json:"password,omitempty" yaml:"password,omitempty"`
+	Weight   int      `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Tags     []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Country  string   `json:"country,omitempty" yaml:"country,omitempty"`
+	City     string   `json:"city,omitempty" yaml:"city,omitempty"`
+}
+
+// StaticFinder chooses upstreams from a file, each entry may have its own credentials.
+// Upstreams are chosen weighted random among the entries with all required tags and the country and city of the request's routing hints.
+// The file is reloaded when it changes.
+type StaticFinder struct {
+	path           string
+	tags           []string
+	reloadInterval time.Duration
+
+	pool    *upstreamPool
+	onError func(err error)
+
+	mu        sync.Mutex
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+var _ ServerFinder = (*StaticFinder)(nil)
+
+type StaticOption func(*StaticFinder)
+
+// WithStaticTags only uses entries which have all the tags
+func WithStaticTags(tags ...string) StaticOption {
+	return func(f *StaticFinder) { f.tags = tags }
+}
+
+// WithReloadInterval sets how often the file is checked for changes
+// Default is 5 seconds, 0 disables reloading
+func WithReloadInterval(interval time.Duration) StaticOption {
+	return func(f *StaticFinder) { f.reloadInterval = interval }
+}
+
+// WithStaticOnError sets the function the errors of reloading the changed file are reported to, the previous entries are kept then
+// Default logs them with slog
+func WithStaticOnError(fn func(err error)) StaticOption {
+	return func(f *StaticFinder) { f.onError = fn }
+}
+
+// NewStaticFinder reads the upstreams from a JSON, YAML or CSV file (by its extension).
+// JSON and YAML files contain a list of StaticEntry, CSV files need a header row with the columns addr, username, password, weight, tags, country and city.
+// Only addr is required, multiple tags in a CSV column are separated by ";".
+func NewStaticFinder(path string, opts ...StaticOption) (*StaticFinder, error) {
+	f := &StaticFinder{
+		path:           path,
+		reloadInterval: 5 * time.Second,
+		pool:           newUpstreamPool(time.Minute),
+		onError: func(err error) {
+			slog.Error("Reloading the upstream file failed, keeping the previous entries", "err", err)
+		},
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *StaticFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	f.reloadIfChanged()
+	return f.pool.pick(req.Hints, f.tags)
+}
+
+func (f *StaticFinder) ReportSuccess(upstream Upstream) {
+	f.pool.recover(upstream)
+}
+
+// ReportFailure sets the upstream aside for a minute
+func (f *StaticFinder) ReportFailure(upstream Upstream, err SocksError) {
+	f.pool.demote(upstream)
+}
+
+// Upstreams returns all entries of the file
+func (f *StaticFinder) Upstreams() []Upstream {
+	return f.pool.all()
+}
+
+// reloadIfChanged reloads the file if it changed since the last check, a broken file keeps the previous entries
+func (f *StaticFinder) reloadIfChanged() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.reloadInterval <= 0 || time.Since(f.lastCheck) < f.reloadInterval {
+		return
+	}
+	f.lastCheck = time.Now()
+
+	info, err := os.Stat(f.path)
+	if err != nil || info.ModTime().Equal(f.modTime) {
+		return
+	}
+	if err := f.load(); err != nil {
+		// the broken version is reported once, the next change of the file is loaded again
+		f.modTime = info.ModTime()
+		if f.onError != nil {
+			f.onError(err)
+		}
+	}
+}
+
+func (f *StaticFinder) reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastCheck = time.Now()
+	return f.load()
+}
+
+// load reads the file into the pool, the caller has to hold the lock
+func (f *StaticFinder) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	entries, err := readStaticEntries(f.path)
+	if err != nil {
+		return err
+	}
+
+	upstreams := make([]Upstream, 0, len(entries))
+	for idx, entry := range entries {
+		if entry.Addr == "" {
+			return fmt.Errorf("error reading %s: entry %d has no addr", f.path, idx+1)
+		}
+		if entry.Weight < 0 {
+			return fmt.Errorf("error reading %s: entry %d has a negative weight", f.path, idx+1)
+		}
+		upstreams = append(upstreams, Upstream{
+			Addr:     entry.Addr,
+			Username: entry.Username,
+			Password: entry.Password,
+			Weight:   entry.Weight,
+			Tags:     entry.Tags,
+			Country:  strings.ToLower(entry.Country),
+			City:     strings.ToLower(entry.City),
+		})
+	}
+
+	f.pool.set(upstreams)
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func readStaticEntries(path string) ([]StaticEntry, error) {
+	if strings.ToLower(filepath.Ext(path)) != ".csv" {
+		var entries []StaticEntry
+		err := decodeFile(path, &entries)
+		return entries, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	columns := make(map[string]int)
+	for idx, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !contains([]string{"addr", "username", "password", "weight", "tags", "country", "city"}, column) {
+			return nil, fmt.Errorf("error reading %s: unknown column %q", path, column)
+		}
+		columns[column] = idx
+	}
+	if _, ok := columns["addr"]; !ok {
+		return nil, fmt.Errorf("error reading %s: missing addr column", path)
+	}
+
+	entries := make([]StaticEntry, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", path, err)
+		}
+
+		column := func(name string) string {
+			idx, ok := columns[name]
+			if !ok {
+				return ""
+			}
+			return strings.TrimSpace(record[idx])
+		}
+
+		entry := StaticEntry{
+			Addr:     column("addr"),
+			Username: column("username"),
+			Password: column("password"),
+			Country:  column("country"),
+			City:     column("city"),
+		}
+		if weight := column("weight"); weight != "" {
+			entry.Weight, err = strconv.Atoi(weight)
+			if err != nil {
+				line, _ := reader.FieldPos(columns["weight"])
+				return nil, fmt.Errorf("error reading %s: invalid weight %q in line %d", path, weight, line)
+			}
+		}
+		for _, tag := range strings.Split(column("tags"), ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				entry.Tags = append(entry.Tags, tag)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,199 @@
+package socksauth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStaticFinderFormats(t *testing.T) {
+	files := map[string]string{
+		"upstreams.json": `[
+			{"addr": "a.example:1080", "username": "ua", "password": "pa", "tags": ["fast"], "country": "DE"},
+			{"addr": "b.example:1080", "weight": 3, "tags": ["fast", "residential"], "country": "us"}
+		]`,
+		"upstreams.yaml": `
+- addr: a.example:1080
+  username: ua
+  password: pa
+  tags: [fast]
+  country: DE
+- addr: b.example:1080
+  weight: 3
+  tags: [fast, residential]
+  country: us
+`,
+		"upstreams.csv": "addr,username,password,weight,tags,country\n" +
+			"a.example:1080,ua,pa,,fast,DE\n" +
+			"b.example:1080,,,3,fast;residential,us\n",
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			finder, err := NewStaticFinder(writeFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			upstreams := finder.Upstreams()
+			if len(upstreams) != 2 {
+				t.Fatalf("expected 2 upstreams, got %d", len(upstreams))
+			}
+			a, b := upstreams[0], upstreams[1]
+			if a.Addr != "a.example:1080" || a.Username != "ua" || a.Password != "pa" || a.Country != "de" || len(a.Tags) != 1 {
+				t.Errorf("unexpected first upstream: %+v", a)
+			}
+			if b.Weight != 3 || len(b.Tags) != 2 || b.Tags[1] != "residential" {
+				t.Errorf("unexpected second upstream: %+v", b)
+			}
+		})
+	}
+}
+
+func TestStaticFinderInvalidFiles(t *testing.T) {
+	files := map[string]string{
+		"unknown.json":  `[{"addr": "a:1080", "pasword": "typo"}]`,
+		"noaddr.yaml":   `- username: u`,
+		"negative.json": `[{"addr": "a:1080", "weight": -1}]`,
+		"column.csv":    "addr,secret\na:1080,x\n",
+		"weight.csv":    "addr,weight\na:1080,heavy\n",
+	}
+	for name, content := range files {
+		if _, err := NewStaticFinder(writeFile(t, name, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestStaticFinderSelection(t *testing.T) {
+	path := writeFile(t, "upstreams.json", `[
+		{"addr": "light:1080", "weight": 1, "country": "de"},
+		{"addr": "heavy:1080", "weight": 9, "country": "de", "tags": ["residential"]},
+		{"addr": "us:1080", "country": "us"}
+	]`)
+	finder, err := NewStaticFinder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[findAddr(t, finder, Request{Hints: RoutingHints{Country: "de"}})]++
+	}
+	if counts["us:1080"] != 0 {
+		t.Errorf("expected no us upstream for a de hint, got %d", counts["us:1080"])
+	}
+	if counts["heavy:1080"] < 4*counts["light:1080"] {
+		t.Errorf("expected the weights to be honoured, got %v", counts)
+	}
+
+	tagged, err := NewStaticFinder(path, WithStaticTags("residential"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if addr := findAddr(t, tagged, Request{}); addr != "heavy:1080" {
+			t.Fatalf("expected only the tagged upstream, got %s", addr)
+		}
+	}
+	if _, err := tagged.Find(context.Background(), Request{Hints: RoutingHints{Country: "us"}}); err == nil {
+		t.Error("expected an error if no upstream matches")
+	}
+
+	// a failed upstream is avoided while others are available
+	finder.ReportFailure(Upstream{Addr: "heavy:1080"}, ErrEstablishProxyConn)
+	for i := 0; i < 20; i++ {
+		if addr := findAddr(t, finder, Request{Hints: RoutingHints{Country: "de"}}); addr != "light:1080" {
+			t.Fatalf("expected the failed upstream to be avoided, got %s", addr)
+		}
+	}
+	finder.ReportFailure(Upstream{Addr: "light:1080"}, ErrEstablishProxyConn)
+	if _, err := finder.Find(context.Background(), Request{Hints: RoutingHints{Country: "de"}}); err != nil {
+		t.Errorf("expected failed upstreams to be used if there is no other choice: %v", err)
+	}
+}
+
+func TestStaticFinderReload(t *testing.T) {
+	path := writeFile(t, "upstreams.json", `[{"addr": "old:1080"}]`)
+	var errs []error
+	finder, err := NewStaticFinder(path, WithReloadInterval(time.Millisecond), WithStaticOnError(func(err error) { errs = append(errs, err) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := findAddr(t, finder, Request{}); addr != "old:1080" {
+		t.Fatalf("expected old:1080, got %s", addr)
+	}
+
+	os.WriteFile(path, []byte(`[{"addr": "new:1080"}]`), 0600)
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	time.Sleep(5 * time.Millisecond)
+	if addr := findAddr(t, finder, Request{}); addr != "new:1080" {
+		t.Errorf("expected the reloaded new:1080, got %s", addr)
+	}
+
+	// a broken file keeps the previous entries
+	os.WriteFile(path, []byte(`[{"addr": `), 0600)
+	os.Chtimes(path, time.Now().Add(2*time.Second), time.Now().Add(2*time.Second))
+	time.Sleep(5 * time.Millisecond)
+	if addr := findAddr(t, finder, Request{}); addr != "new:1080" {
+		t.Errorf("expected new:1080 to be kept, got %s", addr)
+	}
+	time.Sleep(5 * time.Millisecond)
+	findAddr(t, finder, Request{})
+	if len(errs) != 1 {
+		t.Errorf("expected the broken file to be reported once, got %v", errs)
+	}
+}
+
+func TestUpstreamPoolCooldownByAccount(t *testing.T) {
+	alice := Upstream{Addr: "shared:1080", Username: "alice"}
+	bob := Upstream{Addr: "shared:1080", Username: "bob"}
+	pool := newUpstreamPool(time.Minute)
+	pool.set([]Upstream{alice, bob})
+
+	// a rejected account does not set the other accounts of the same server aside
+	pool.demote(alice)
+	for i := 0; i < 20; i++ {
+		if upstream, err := pool.pick(RoutingHints{}, nil); err != nil || upstream.Username != "bob" {
+			t.Fatalf("expected bob, got %+v %v", upstream, err)
+		}
+	}
+
+	pool.set([]Upstream{bob})
+	if len(pool.failed) != 0 {
+		t.Errorf("expected the cooldown of the removed upstream to be dropped, got %v", pool.failed)
+	}
+}
+
+func TestStaticFinderCredentials(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	vendorA := startMockUpstream(t, "alice", "secret-a")
+
+	path := writeFile(t, "upstreams.json", `[{"addr": "`+vendorA.Addr+`", "username": "alice", "password": "secret-a"}]`)
+	finder, err := NewStaticFinder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, proxyAddr := startTestServer(t, "", "server-user", "server-pass", WithFinder(finder))
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+	if vendorA.FailedAuths.Load() != 0 {
+		t.Error("expected the entry's credentials to be used")
+	}
+}
@@ -0,0 +1,266 @@
+package socksauth
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StickyKeyFunc derives the key a request is pinned by, requests with an empty key are not pinned
+type StickyKeyFunc func(req Request) string
+
+// StickyByClientIP pins all connections of a client IP to the same upstream
+func StickyByClientIP(req Request) string {
+	ip, ok := addrIP(req.ClientAddr)
+	if !ok {
+		return ""
+	}
+	return ip.String()
+}
+
+// StickyByUsername pins all connections of a local SOCKS user to the same upstream
+func StickyByUsername(req Request) string {
+	return req.Username
+}
+
+// StickyGlobal pins all connections to the same upstream, combined with a rotation policy every client moves at the same time
+func StickyGlobal(req Request) string {
+	return "*"
+}
+
+// StickyBySessionId pins all connections with the same session id in the username (e.g. "user-session-abc123") to the same upstream
+// The session id is taken from the routing hints, if the server has no UsernameGrammar the DefaultUsernameGrammar is used
+func StickyBySessionId(req Request) string {
+	if req.Hints.Session != "" {
+		return req.Hints.Session
+	}
+	hints, err := DefaultUsernameGrammar.Parse(req.Username)
+	if err != nil {
+		return ""
+	}
+	return hints.Session
+}
+
+// StickySession is the pin of a key to an upstream
+type StickySession struct {
+	Key         string    `json:"key"`
+	Upstream    Upstream  `json:"upstream"`
+	PinnedAt    time.Time `json:"pinnedAt"`
+	LastUsed    time.Time `json:"lastUsed"`
+	Connections int       `json:"connections"`
+
+	rotate bool
+}
+
+// StickyFinder wraps a ServerFinder and keeps returning the same upstream for the same key.
+// A pin is dropped once it was idle for longer than the idle TTL or its upstream is reported to fail, the next connection is pinned to a new upstream then.
+// With a rotation policy a pin is moved to another upstream after a time, a number of connections or on demand.
+// Rotation only affects new connections, already established ones keep their upstream.
+type StickyFinder struct {
+	finder  ServerFinder
+	key     StickyKeyFunc
+	idleTTL time.Duration
+
+	rotateInterval time.Duration
+	rotateCount    int
+
+	mu       sync.Mutex
+	sessions map[string]*StickySession
+	// lastSweep is when idle sessions were dropped last, keys which are not used again would pile up otherwise
+	lastSweep time.Time
+}
+
+type StickyOption func(*StickyFinder)
+
+// WithRotationInterval moves a pin to another upstream once it is older than interval
+func WithRotationInterval(interval time.Duration) StickyOption {
+	return func(f *StickyFinder) { f.rotateInterval = interval }
+}
+
+// WithRotationCount moves a pin to another upstream after it served count connections
+// A RotateEvery routing hint of the request takes precedence
+func WithRotationCount(count int) StickyOption {
+	return func(f *StickyFinder) { f.rotateCount = count }
+}
+
+var (
+	_ ServerFinder = (*StickyFinder)(nil)
+	_ Warmer       = (*StickyFinder)(nil)
+)
+
+// NewStickyFinder creates a StickyFinder, an idleTTL of 0 keeps pins until their upstream fails or they are rotated
+func NewStickyFinder(finder ServerFinder, key StickyKeyFunc, idleTTL time.Duration, opts ...StickyOption) *StickyFinder {
+	f := &StickyFinder{
+		finder:   finder,
+		key:      key,
+		idleTTL:  idleTTL,
+		sessions: make(map[string]*StickySession),
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+func (f *StickyFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	key := f.key(req)
+	if key == "" {
+		return f.finder.Find(ctx, req)
+	}
+
+	rotateCount := f.rotateCount
+	if req.Hints.RotateEvery > 0 {
+		rotateCount = req.Hints.RotateEvery
+	}
+	upstream, ok, previous := f.use(key, rotateCount)
+	if ok {
+		return upstream, nil
+	}
+
+	// the lock is not held while finding, so a slow finder does not block other keys
+	upstream, err := f.finder.Find(ctx, req)
+	// a rotation should move to another upstream, so we give the finder a few chances to find one
+	for attempt := 0; err == nil && previous != "" && upstream.Addr == previous && attempt < 3; attempt++ {
+		upstream, err = f.finder.Find(ctx, req)
+	}
+	if err != nil {
+		return Upstream{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	session, ok := f.sessions[key]
+	if !ok {
+		// another connection of the same key might have pinned an upstream in the meantime
+		now := time.Now()
+		f.sweep(now)
+		session = &StickySession{Key: key, Upstream: upstream, PinnedAt: now, LastUsed: now}
+		f.sessions[key] = session
+	}
+	session.Connections++
+	return session.Upstream, nil
+}
+
+// use returns the pinned upstream of a key if there is one, it is not idle for too long and is not due for rotation
+// If the pin was dropped the address of its upstream is returned as previous
+func (f *StickyFinder) use(key string, rotateCount int) (upstream Upstream, ok bool, previous string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.sessions[key]
+	if !ok {
+		return Upstream{}, false, ""
+	}
+
+	now := time.Now()
+	rotate := session.rotate ||
+		(f.rotateInterval > 0 && now.Sub(session.PinnedAt) >= f.rotateInterval) ||
+		(rotateCount > 0 && session.Connections >= rotateCount)
+	if rotate || f.expired(session, now) {
+		delete(f.sessions, key)
+		return Upstream{}, false, session.Upstream.Addr
+	}
+
+	session.LastUsed = now
+	session.Connections++
+	return session.Upstream, true, ""
+}
+
+func (f *StickyFinder) expired(session *StickySession, now time.Time) bool {
+	return f.idleTTL > 0 && now.Sub(session.LastUsed) > f.idleTTL
+}
+
+// sweep drops the sessions which are idle for longer than the idle TTL, at most once per TTL or minute. The caller has to hold the lock
+func (f *StickyFinder) sweep(now time.Time) {
+	if f.idleTTL <= 0 || now.Sub(f.lastSweep) < min(f.idleTTL, time.Minute) {
+		return
+	}
+	f.lastSweep = now
+
+	for key, session := range f.sessions {
+		if f.expired(session, now) {
+			delete(f.sessions, key)
+		}
+	}
+}
+
+func (f *StickyFinder) ReportSuccess(upstream Upstream) {
+	f.finder.ReportSuccess(upstream)
+}
+
+// ReportFailure unpins every key of the failed upstream, so they get a new one with their next connection
+func (f *StickyFinder) ReportFailure(upstream Upstream, err SocksError) {
+	f.mu.Lock()
+	now := time.Now()
+	for key, session := range f.sessions {
+		if session.Upstream.Addr == upstream.Addr || f.expired(session, now) {
+			delete(f.sessions, key)
+		}
+	}
+	f.lastSweep = now
+	f.mu.Unlock()
+
+	f.finder.ReportFailure(upstream, err)
+}
+
+// Warmup warms up the wrapped finder if it supports it
+func (f *StickyFinder) Warmup(ctx context.Context) error {
+	if warmer, ok := f.finder.(Warmer); ok {
+		return warmer.Warmup(ctx)
+	}
+	return nil
+}
+
+// Sessions returns all active pins sorted by key
+func (f *StickyFinder) Sessions() []StickySession {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	sessions := make([]StickySession, 0, len(f.sessions))
+	for key, session := range f.sessions {
+		if f.expired(session, now) {
+			delete(f.sessions, key)
+			continue
+		}
+		sessions = append(sessions, *session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Key < sessions[j].Key })
+	return sessions
+}
+
+// Rotate moves the pin of a key to another upstream with its next connection, it returns false if the key is not pinned
+func (f *StickyFinder) Rotate(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.sessions[key]
+	if ok {
+		session.rotate = true
+	}
+	return ok
+}
+
+// RotateAll moves every pin to another upstream with its next connection and returns the number of rotated pins
+func (f *StickyFinder) RotateAll() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, session := range f.sessions {
+		session.rotate = true
+	}
+	return len(f.sessions)
+}
+
+// Unpin drops the pin of a key, it returns false if the key was not pinned
+func (f *StickyFinder) Unpin(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.sessions[key]
+	delete(f.sessions, key)
+	return ok
+}
@@ -0,0 +1,272 @@
+package socksauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sequenceFinder returns a new upstream for every call
+type sequenceFinder struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *sequenceFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return Upstream{Addr: fmt.Sprintf("upstream-%d:1080", f.calls)}, nil
+}
+
+func (f *sequenceFinder) ReportSuccess(upstream Upstream) {}
+
+func (f *sequenceFinder) ReportFailure(upstream Upstream, err SocksError) {}
+
+func findAddr(t *testing.T, finder ServerFinder, req Request) string {
+	t.Helper()
+	upstream, err := finder.Find(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upstream.Addr
+}
+
+func TestStickyFinderPinsByKey(t *testing.T) {
+	sticky := NewStickyFinder(&sequenceFinder{}, StickyByUsername, 0)
+
+	alice := Request{Username: "alice"}
+	bob := Request{Username: "bob"}
+	first := findAddr(t, sticky, alice)
+	if second := findAddr(t, sticky, alice); second != first {
+		t.Errorf("expected alice to stay on %s, got %s", first, second)
+	}
+	if other := findAddr(t, sticky, bob); other == first {
+		t.Errorf("expected bob to get another upstream than alice")
+	}
+	if anonymous := findAddr(t, sticky, Request{}); anonymous == first {
+		t.Errorf("expected a request without key not to be pinned")
+	}
+
+	sessions := sticky.Sessions()
+	if len(sessions) != 2 || sessions[0].Key != "alice" || sessions[0].Connections != 2 || sessions[1].Key != "bob" {
+		t.Errorf("unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestStickyFinderIdleTTL(t *testing.T) {
+	sticky := NewStickyFinder(&sequenceFinder{}, StickyByUsername, 20*time.Millisecond)
+
+	req := Request{Username: "alice"}
+	first := findAddr(t, sticky, req)
+	time.Sleep(10 * time.Millisecond)
+	if again := findAddr(t, sticky, req); again != first {
+		t.Fatalf("expected the pin to be refreshed by use")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if len(sticky.Sessions()) != 0 {
+		t.Errorf("expected the idle session to expire")
+	}
+	if repinned := findAddr(t, sticky, req); repinned == first {
+		t.Errorf("expected a new upstream after the idle TTL")
+	}
+}
+
+func TestStickyFinderSweepsIdleKeys(t *testing.T) {
+	sticky := NewStickyFinder(&sequenceFinder{}, StickyByUsername, 20*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		findAddr(t, sticky, Request{Username: fmt.Sprintf("client-%d", i)})
+	}
+	time.Sleep(40 * time.Millisecond)
+	// the idle keys are never used again, a new key drops them
+	findAddr(t, sticky, Request{Username: "new"})
+
+	sticky.mu.Lock()
+	pinned := len(sticky.sessions)
+	sticky.mu.Unlock()
+	if pinned != 1 {
+		t.Errorf("expected the idle sessions to be swept, got %d", pinned)
+	}
+}
+
+func TestStickyFinderRepinsOnFailure(t *testing.T) {
+	sticky := NewStickyFinder(&sequenceFinder{}, StickyByUsername, 0)
+
+	req := Request{Username: "alice"}
+	first := findAddr(t, sticky, req)
+	sticky.ReportFailure(Upstream{Addr: first}, ErrEstablishProxyConn)
+	if repinned := findAddr(t, sticky, req); repinned == first {
+		t.Errorf("expected a new upstream after a failure")
+	}
+}
+
+func TestStickyKeys(t *testing.T) {
+	req := Request{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 5000},
+		Username:   "alice-session-abc123",
+	}
+
+	if key := StickyByClientIP(req); key != "192.0.2.1" {
+		t.Errorf("unexpected client ip key: %s", key)
+	}
+	if key := StickyByUsername(req); key != "alice-session-abc123" {
+		t.Errorf("unexpected username key: %s", key)
+	}
+	if key := StickyBySessionId(req); key != "abc123" {
+		t.Errorf("unexpected session key: %s", key)
+	}
+	if key := StickyBySessionId(Request{Username: "alice"}); key != "" {
+		t.Errorf("expected no session key, got %s", key)
+	}
+}
+
+func TestStickySessionsThroughServer(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstreams := []Upstream{
+		{Addr: startMockUpstream(t, "user", "pass").Addr},
+		{Addr: startMockUpstream(t, "user", "pass").Addr},
+	}
+
+	sticky := NewStickyFinder(&reportingFinder{upstreams: upstreams}, StickyByUsername, time.Minute)
+	server, proxyAddr := startTestServer(t, "", "user", "pass",
+		WithFinder(sticky),
+		WithClientAuth(func(username, password string) bool { return password == "local" }),
+	)
+
+	if _, err := dialSocks(proxyAddr, echoAddr, "alice", "wrong"); !errors.Is(err, errAuthRejectedByProxy) {
+		t.Fatalf("expected the wrong local password to be rejected, got %v", err)
+	}
+	if _, err := dialSocks(proxyAddr, echoAddr, "", ""); err == nil {
+		t.Fatal("expected a client without credentials to be rejected")
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := dialSocks(proxyAddr, echoAddr, "alice", "local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+		conn.Close()
+	}
+
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var sessions []StickySession
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Key != "alice" || sessions[0].Connections != 3 {
+		t.Errorf("unexpected sessions: %+v", sessions)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, admin.URL+"/sessions?key=alice", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(sticky.Sessions()) != 0 {
+		t.Errorf("expected the session to be unpinned, got status %d", resp.StatusCode)
+	}
+}
+
+func TestStickyFinderRotateEveryHint(t *testing.T) {
+	sticky := NewStickyFinder(&sequenceFinder{}, StickyBySessionId, 0)
+
+	req := Request{Hints: RoutingHints{Session: "s1", RotateEvery: 2}}
+	first := findAddr(t, sticky, req)
+	if second := findAddr(t, sticky, req); second != first {
+		t.Fatalf("expected the second connection to stay on %s, got %s", first, second)
+	}
+	if third := findAddr(t, sticky, req); third == first {
+		t.Errorf("expected a new upstream after 2 connections")
+	}
+}
+
+// repeatingFinder returns its upstreams in order and repeats the last one
+type repeatingFinder struct {
+	sequenceFinder
+	addrs []string
+}
+
+func (f *repeatingFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	addr := f.addrs[min(f.calls, len(f.addrs)-1)]
+	f.calls++
+	return Upstream{Addr: addr}, nil
+}
+
+func TestStickyFinderRotation(t *testing.T) {
+	t.Run("interval", func(t *testing.T) {
+		sticky := NewStickyFinder(&sequenceFinder{}, StickyGlobal, 0, WithRotationInterval(20*time.Millisecond))
+		first := findAddr(t, sticky, Request{})
+		if again := findAddr(t, sticky, Request{Username: "other"}); again != first {
+			t.Fatalf("expected every client to share %s, got %s", first, again)
+		}
+		time.Sleep(30 * time.Millisecond)
+		if rotated := findAddr(t, sticky, Request{}); rotated == first {
+			t.Errorf("expected a new upstream after the rotation interval")
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		sticky := NewStickyFinder(&sequenceFinder{}, StickyByUsername, 0, WithRotationCount(3))
+		req := Request{Username: "alice"}
+		first := findAddr(t, sticky, req)
+		findAddr(t, sticky, req)
+		if third := findAddr(t, sticky, req); third != first {
+			t.Fatalf("expected 3 connections on %s", first)
+		}
+		if fourth := findAddr(t, sticky, req); fourth == first {
+			t.Errorf("expected a new upstream after 3 connections")
+		}
+	})
+
+	t.Run("on demand", func(t *testing.T) {
+		sticky := NewStickyFinder(&repeatingFinder{addrs: []string{"a:1080", "a:1080", "b:1080"}}, StickyByUsername, 0)
+		alice := Request{Username: "alice"}
+		if first := findAddr(t, sticky, alice); first != "a:1080" {
+			t.Fatalf("expected a:1080, got %s", first)
+		}
+		if sticky.Rotate("bob") {
+			t.Error("expected rotating an unknown key to fail")
+		}
+		if !sticky.Rotate("alice") {
+			t.Fatal("expected alice to be rotated")
+		}
+		if rotated := findAddr(t, sticky, alice); rotated != "b:1080" {
+			t.Errorf("expected the rotation to skip the previous upstream, got %s", rotated)
+		}
+		if again := findAddr(t, sticky, alice); again != "b:1080" {
+			t.Errorf("expected alice to stay on the new upstream, got %s", again)
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		sticky := NewStickyFinder(&sequenceFinder{}, StickyByUsername, 0)
+		alice := findAddr(t, sticky, Request{Username: "alice"})
+		bob := findAddr(t, sticky, Request{Username: "bob"})
+		if rotated := sticky.RotateAll(); rotated != 2 {
+			t.Fatalf("expected 2 rotated sessions, got %d", rotated)
+		}
+		if findAddr(t, sticky, Request{Username: "alice"}) == alice || findAddr(t, sticky, Request{Username: "bob"}) == bob {
+			t.Error("expected every session to move")
+		}
+	})
+}
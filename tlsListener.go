@@ -0,0 +1,139 @@
+package socksauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TlsConfig configures a listener which speaks SOCKS5 over TLS
+type TlsConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate chain and key of the server, they are reloaded when they change
+	CertFile string `json:"certFile" yaml:"certFile"`
+	KeyFile  string `json:"keyFile" yaml:"keyFile"`
+	// ClientCaFile is a PEM bundle of the CAs client certificates have to be signed by, without it no client certificate is requested.
+	// The subject of a client certificate is the Identity of its requests
+	ClientCaFile string `json:"clientCaFile,omitempty" yaml:"clientCaFile,omitempty"`
+	// OptionalClientCert accepts clients without a certificate as well, a certificate which is given still has to be valid
+	OptionalClientCert bool `json:"optionalClientCert,omitempty" yaml:"optionalClientCert,omitempty"`
+}
+
+// TlsCertificates are the certificate of a TLS listener and the CAs of its clients, the files are read again when they change
+type TlsCertificates struct {
+	config TlsConfig
+
+	mu       sync.Mutex
+	current  *tls.Config
+	modTimes []time.Time
+}
+
+// NewTlsCertificates reads the files of the config
+func NewTlsCertificates(config TlsConfig) (*TlsCertificates, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("a certificate and a key are required")
+	}
+	if config.OptionalClientCert && config.ClientCaFile == "" {
+		return nil, errors.New("an optional client certificate needs a client CA")
+	}
+
+	c := &TlsCertificates{config: config}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WithTls makes the server speak SOCKS5 over TLS, e.g. on a WithListener. It can not be changed with Reload, the files are reloaded when they change
+func WithTls(certificates *TlsCertificates) ServerOption {
+	return func(s *Server) { s.tls = certificates }
+}
+
+// Config returns a tls.Config for a server, every handshake uses the current files
+func (c *TlsCertificates) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.load()
+		},
+	}
+}
+
+// load returns the config of the files, if they changed they are read again. If the changed files can not be read the previous config is kept
+func (c *TlsCertificates) load() (*tls.Config, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files := []string{c.config.CertFile, c.config.KeyFile}
+	if c.config.ClientCaFile != "" {
+		files = append(files, c.config.ClientCaFile)
+	}
+	modTimes := make([]time.Time, 0, len(files))
+	changed := c.current == nil
+	for idx, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			if c.current != nil {
+				return c.current, nil
+			}
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+		changed = changed || !info.ModTime().Equal(c.modTimes[idx])
+	}
+	if !changed {
+		return c.current, nil
+	}
+
+	config, err := c.read()
+	if err != nil {
+		if c.current != nil {
+			return c.current, nil
+		}
+		return nil, err
+	}
+	c.current, c.modTimes = config, modTimes
+	return config, nil
+}
+
+func (c *TlsCertificates) read() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the certificate: %w", err)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if c.config.ClientCaFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(c.config.ClientCaFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the client CAs: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("error reading the client CAs: %s has no certificate", c.config.ClientCaFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if c.config.OptionalClientCert {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// tlsIdentity returns the subject of the verified client certificate of a TLS connection
+func tlsIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.String()
+}
@@ -0,0 +1,207 @@
+package socksauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate issues a certificate for subject signed by the parent, without a parent it is a self-signed CA
+func testCertificate(t *testing.T, subject pkix.Name, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCertificate writes the certificate and its key as PEM files to dir
+func writeCertificate(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTlsListener(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	dir := t.TempDir()
+	ca := testCertificate(t, pkix.Name{CommonName: "test ca"}, nil)
+	caFile, _ := writeCertificate(t, dir, "ca", ca)
+	certFile, keyFile := writeCertificate(t, dir, "server", testCertificate(t, pkix.Name{CommonName: "server"}, &ca))
+	alice := testCertificate(t, pkix.Name{CommonName: "alice", Organization: []string{"Example"}}, &ca)
+	bob := testCertificate(t, pkix.Name{CommonName: "bob", Organization: []string{"Example"}}, &ca)
+
+	certificates, err := NewTlsCertificates(TlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCaFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(RouterConfig{Rules: []RouteRule{{Identities: []string{"CN=alice,O=Example"}, Action: RouteDirect}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := NewAcl(AclConfig{Destinations: []AclRule{{Name: "no bob", Action: AclDeny, Identities: []string{"CN=bob,*"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := startTestServer(t, upstream.Addr, "user", "pass",
+		WithListener("127.0.0.1:0", WithTls(certificates), WithRouter(router), WithAcl(acl)))
+	addr, ok := strings.CutPrefix(server.ListenerAddrs()[1], "socks5+tls://")
+	if !ok {
+		t.Fatalf("expected a TLS address, got %s", server.ListenerAddrs()[1])
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	dial := func(client *tls.Certificate) (*tls.Conn, net.Conn, error) {
+		config := &tls.Config{RootCAs: roots}
+		if client != nil {
+			config.Certificates = []tls.Certificate{*client}
+		}
+		tlsConn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := socksConnect(tlsConn, echoAddr, "", "")
+		return tlsConn, conn, err
+	}
+
+	_, conn, err := dial(&alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+	if destinations := upstream.Destinations(); len(destinations) != 0 {
+		t.Errorf("expected the identity to be routed directly, got %v", destinations)
+	}
+
+	if _, _, err := dial(&bob); err == nil {
+		t.Error("expected the identity to be denied by the ACL")
+	}
+	if _, _, err := dial(nil); err == nil {
+		t.Error("expected a client without certificate to be rejected")
+	}
+
+	// a renewed certificate is used by the next handshake
+	renewed := testCertificate(t, pkix.Name{CommonName: "renewed"}, &ca)
+	writeCertificate(t, dir, "server", renewed)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	tlsConn, conn, err := dial(&alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if name := tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "renewed" {
+		t.Errorf("expected the renewed certificate, got %s", name)
+	}
+}
+
+func TestTlsCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := testCertificate(t, pkix.Name{CommonName: "test ca"}, nil)
+	caFile, _ := writeCertificate(t, dir, "ca", ca)
+	certFile, keyFile := writeCertificate(t, dir, "server", testCertificate(t, pkix.Name{CommonName: "server"}, &ca))
+
+	if _, err := NewTlsCertificates(TlsConfig{CertFile: certFile, KeyFile: keyFile, OptionalClientCert: true}); err == nil {
+		t.Error("expected an optional client certificate without CA to be rejected")
+	}
+	if _, err := NewTlsCertificates(TlsConfig{CertFile: certFile, KeyFile: caFile}); err == nil {
+		t.Error("expected a key which does not match to be rejected")
+	}
+
+	conn := &socksConnection{identity: "CN=alice,O=Example", clientConn: &net.TCPConn{}}
+	if key := conn.userKey(); key != "CN=alice,O=Example" {
+		t.Errorf("expected the identity to be the user of a client without username, got %q", key)
+	}
+}
+
+func TestIdentityPatterns(t *testing.T) {
+	subject := func(name pkix.Name) string { return name.String() }
+	alice := subject(pkix.Name{CommonName: "alice", Organization: []string{"Example, Inc"}})
+	nested := subject(pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"ops"}, Organization: []string{"Example"}})
+
+	cases := []struct {
+		pattern  string
+		identity string
+		matches  bool
+	}{
+		{`CN=alice,O=Example\, Inc`, alice, true},
+		{`cn=alice, o=Example\2C Inc`, alice, true},
+		{`CN=*,O=Example\, Inc`, alice, true},
+		{`CN=al*,O=*Inc`, alice, true},
+		{`CN=alice,*`, alice, true},
+		{`CN=bob,*`, alice, false},
+		{`CN=alice,O=Example`, alice, false},
+		// a wildcard value does not span relative distinguished names
+		{`CN=*,O=Example`, nested, false},
+		{`CN=*,*,O=Example`, nested, true},
+		{`CN=\*,*`, alice, false},
+		{`CN=\*,*`, subject(pkix.Name{CommonName: "*"}), true},
+	}
+	for _, c := range cases {
+		matcher, err := newRequestMatcher(nil, nil, nil, nil, []string{c.pattern})
+		if err != nil {
+			t.Fatalf("%s: %v", c.pattern, err)
+		}
+		if matched := matcher.matchesIdentity(c.identity); matched != c.matches {
+			t.Errorf("%s on %s: expected %v, got %v", c.pattern, c.identity, c.matches, matched)
+		}
+	}
+
+	for _, pattern := range []string{"", "alice", `CN=alice\`} {
+		if _, err := newRequestMatcher(nil, nil, nil, nil, []string{pattern}); err == nil {
+			t.Errorf("%q: expected an invalid pattern", pattern)
+		}
+	}
+}
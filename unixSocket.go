@@ -0,0 +1,204 @@
+package socksauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unixScheme is the prefix of addresses which are unix sockets, like "unix:///run/socksauth.sock"
+const unixScheme = "unix://"
+
+// unixTlsScheme is the prefix ListenerAddrs gives a unix socket with TLS
+const unixTlsScheme = "unix+tls://"
+
+// errPeerCredentialsUnsupported is returned by PeerCredentials for connections which are no unix sockets or on systems without SO_PEERCRED
+var errPeerCredentialsUnsupported = errors.New("peer credentials are not supported")
+
+// UnixSocketConfig sets the permissions of unix sockets the server listens on, abstract sockets have none
+type UnixSocketConfig struct {
+	// Mode is the file mode of the socket, like 0660 (0o660 in TOML). Default is the one of the umask
+	Mode os.FileMode `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// User and Group own the socket, by name or numeric id. Changing the owner usually needs root
+	User  string `json:"user,omitempty" yaml:"user,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+}
+
+// WithUnixSocket sets the mode and owner of a unix socket address like "unix:///run/socksauth.sock", it can not be changed with Reload
+func WithUnixSocket(config UnixSocketConfig) ServerOption {
+	return func(s *Server) { s.unixSocket = config }
+}
+
+// PeerCred are the credentials of the process on the other end of a unix socket
+type PeerCred struct {
+	Pid int
+	Uid int
+	Gid int
+}
+
+// PeerCredentials returns the credentials of the client of a connection accepted on a unix socket, e.g. in the onConnect callback.
+// A connection with TLS is unwrapped to its unix socket. It is only supported on Linux
+func PeerCredentials(conn net.Conn) (PeerCred, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCred{}, fmt.Errorf("%w: %s is no unix socket", errPeerCredentialsUnsupported, conn.LocalAddr().Network())
+	}
+	return peerCredentials(unixConn)
+}
+
+// listen binds a TCP address like ":1080" or a unix socket like "unix:///run/socksauth.sock", "unix://@socksauth" is an abstract socket on Linux
+func listen(addr string, config UnixSocketConfig) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixScheme)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%s has no socket path", addr)
+	}
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if abstract {
+		return net.Listen("unix", path)
+	}
+	return listenUnix(path, config)
+}
+
+// listenUnix binds the socket in a private directory next to path and only moves it to path once its mode and owner are set,
+// so no client can connect before
+func listenUnix(path string, config UnixSocketConfig) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socksauth-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating the directory of the socket: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, filepath.Base(path))
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed from its final path instead
+	ln.SetUnlinkOnClose(false)
+	if err := chownSocket(private, config); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("error moving the socket to %s: %w", path, err)
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// unixListener is a socket moved to path after it was bound, it reports path as its address and removes it when it is closed
+type unixListener struct {
+	*net.UnixListener
+	path      string
+	closeOnce sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.closeOnce.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// boundAddr is the address of a listener like the ones of ListenerAddrs, a TLS listener is like "socks5+tls://127.0.0.1:1443"
+// and a unix socket with TLS like "unix+tls:///run/socksauth.sock"
+func boundAddr(ln net.Listener, tls bool) string {
+	switch {
+	case ln.Addr().Network() == "unix" && tls:
+		return unixTlsScheme + ln.Addr().String()
+	case ln.Addr().Network() == "unix":
+		return unixScheme + ln.Addr().String()
+	case tls:
+		return "socks5+tls://" + ln.Addr().String()
+	}
+	return "socks5://" + ln.Addr().String()
+}
+
+// removeStaleSocket removes the socket at path if no server listens on it anymore, e.g. after a crash
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is no socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+func chownSocket(path string, config UnixSocketConfig) error {
+	if config.Mode != 0 {
+		if err := os.Chmod(path, config.Mode.Perm()); err != nil {
+			return fmt.Errorf("error setting the mode of the socket: %w", err)
+		}
+	}
+	if config.User == "" && config.Group == "" {
+		return nil
+	}
+
+	uid, gid, err := config.owner()
+	if err != nil {
+		return err
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return fmt.Errorf("error setting the owner of the socket: %w", err)
+	}
+	return nil
+}
+
+// owner resolves the user and group, -1 keeps the current one
+func (c UnixSocketConfig) owner() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if c.User != "" {
+		if uid, err = strconv.Atoi(c.User); err != nil {
+			u, err := user.Lookup(c.User)
+			if err != nil {
+				return 0, 0, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if c.Group != "" {
+		if gid, err = strconv.Atoi(c.Group); err != nil {
+			g, err := user.LookupGroup(c.Group)
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,127 @@
+package socksauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestUnixSocketListener(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+	path := filepath.Join(t.TempDir(), "socksauth.sock")
+
+	// a socket left behind by a crashed server
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	peers := make(chan PeerCred, 1)
+	onConnect := func(id int64, conn net.Conn) {
+		if peer, err := PeerCredentials(conn); err == nil {
+			peers <- peer
+		}
+	}
+	server, _ := startTestServer(t, upstream.Addr, "user", "pass", WithOnConnect(onConnect),
+		WithListener(unixScheme+path, WithUnixSocket(UnixSocketConfig{Mode: 0600})))
+
+	if addrs := server.ListenerAddrs(); len(addrs) != 2 || addrs[1] != unixScheme+path {
+		t.Errorf("expected the socket to be listed, got %v", addrs)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %o", info.Mode().Perm())
+	}
+
+	conn, err := dialSocks(unixScheme+path, echoAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if peer := <-peers; peer.Uid != os.Getuid() || peer.Pid != os.Getpid() {
+		t.Errorf("expected the credentials of the test process, got %+v", peer)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "socksauth.sock")
+	ln, err := listen(unixScheme+path, UnixSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if addr := boundAddr(ln, true); addr != unixTlsScheme+path {
+		t.Errorf("expected a unix address with TLS, got %s", addr)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || entries[0].Name() != "socksauth.sock" {
+		t.Errorf("expected only the socket to be left in its directory, got %v", entries)
+	}
+
+	// a connection with TLS has the credentials of its socket
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = PeerCredentials(tls.Server(conn, &tls.Config{}))
+	conn.Close()
+
+	if runtime.GOOS == "linux" && err != nil {
+		t.Errorf("expected the credentials of a connection with TLS, got %v", err)
+	}
+	if _, err := listen(unixScheme+path, UnixSocketConfig{}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("expected a socket in use to be kept, got %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixScheme+file, UnixSocketConfig{}); err == nil {
+		t.Error("expected a file which is no socket to be kept")
+	}
+	if _, err := listen(unixScheme, UnixSocketConfig{}); err == nil {
+		t.Error("expected an address without path to be rejected")
+	}
+
+	ln.Close()
+	if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the socket to be removed when it is closed, got %v", err)
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	abstract, err := listen(fmt.Sprintf("%s@socksauth-test-%d", unixScheme, os.Getpid()), UnixSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer abstract.Close()
+	if addr := boundAddr(abstract, false); !strings.HasPrefix(addr, unixScheme+"@socksauth-test-") {
+		t.Errorf("expected an abstract address, got %s", addr)
+	}
+}
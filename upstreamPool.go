@@ -0,0 +1,157 @@
+package socksauth
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamPool chooses weighted random upstreams matching the request's routing hints.
+// Upstreams reported to fail are set aside for a cooldown, unless there is no other choice.
+type upstreamPool struct {
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	upstreams []Upstream
+	failed    map[string]time.Time // poolKey -> end of the cooldown
+}
+
+// poolKey identifies an upstream by its address and account, entries of the same server with other credentials cool down on their own
+func poolKey(upstream Upstream) string {
+	return upstream.Username + "@" + upstream.Addr
+}
+
+func newUpstreamPool(cooldown time.Duration) *upstreamPool {
+	return &upstreamPool{cooldown: cooldown, failed: make(map[string]time.Time)}
+}
+
+// set replaces the upstreams of the pool, the cooldowns of upstreams which are still there are kept
+func (p *upstreamPool) set(upstreams []Upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.upstreams = upstreams
+
+	keep := make(map[string]bool, len(upstreams))
+	for _, upstream := range upstreams {
+		keep[poolKey(upstream)] = true
+	}
+	for key := range p.failed {
+		if !keep[key] {
+			delete(p.failed, key)
+		}
+	}
+}
+
+func (p *upstreamPool) all() []Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Upstream(nil), p.upstreams...)
+}
+
+// pick chooses an upstream of the lowest priority which matches the hints and has all tags
+func (p *upstreamPool) pick(hints RoutingHints, tags []string) (Upstream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	healthy := make([]Upstream, 0, len(p.upstreams))
+	cooling := make([]Upstream, 0)
+	for _, upstream := range p.upstreams {
+		if !upstream.matches(hints, tags) {
+			continue
+		}
+		if until, ok := p.failed[poolKey(upstream)]; ok && now.Before(until) {
+			cooling = append(cooling, upstream)
+			continue
+		}
+		healthy = append(healthy, upstream)
+	}
+
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = cooling
+	}
+	if len(candidates) == 0 {
+		if filter := describeFilter(hints, tags); filter != "" {
+			return Upstream{}, fmt.Errorf("no upstream found for %s", filter)
+		}
+		return Upstream{}, fmt.Errorf("no upstream found")
+	}
+	return pickWeighted(lowestPriority(candidates)), nil
+}
+
+// demote sets an upstream aside for the cooldown
+func (p *upstreamPool) demote(upstream Upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failed[poolKey(upstream)] = time.Now().Add(p.cooldown)
+}
+
+// recover ends the cooldown of an upstream
+func (p *upstreamPool) recover(upstream Upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failed, poolKey(upstream))
+}
+
+func (u Upstream) matches(hints RoutingHints, tags []string) bool {
+	if hints.Country != "" && !strings.EqualFold(u.Country, hints.Country) {
+		return false
+	}
+	if hints.City != "" && !strings.EqualFold(u.City, hints.City) {
+		return false
+	}
+	for _, tag := range tags {
+		if !contains(u.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowestPriority(upstreams []Upstream) []Upstream {
+	lowest := upstreams[0].Priority
+	for _, upstream := range upstreams {
+		lowest = min(lowest, upstream.Priority)
+	}
+
+	result := make([]Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if upstream.Priority == lowest {
+			result = append(result, upstream)
+		}
+	}
+	return result
+}
+
+func pickWeighted(upstreams []Upstream) Upstream {
+	total := 0
+	for _, upstream := range upstreams {
+		total += max(upstream.Weight, 1)
+	}
+
+	n := rand.Intn(total)
+	for _, upstream := range upstreams {
+		n -= max(upstream.Weight, 1)
+		if n < 0 {
+			return upstream
+		}
+	}
+	return upstreams[len(upstreams)-1]
+}
+
+func describeFilter(hints RoutingHints, tags []string) string {
+	filters := make([]string, 0)
+	if hints.Country != "" {
+		filters = append(filters, "country "+hints.Country)
+	}
+	if hints.City != "" {
+		filters = append(filters, "city "+hints.City)
+	}
+	if len(tags) > 0 {
+		filters = append(filters, "tags "+strings.Join(tags, ", "))
+	}
+	return strings.Join(filters, " and ")
+}
@@ -0,0 +1,109 @@
+package socksauth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RoutingHints are routing parameters a client encoded in its SOCKS username, finders may use them to choose the upstream
+type RoutingHints struct {
+	// User is the username without the encoded parameters
+	User    string `json:"user,omitempty"`
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	Session string `json:"session,omitempty"`
+	// RotateEvery asks for a new upstream after this many connections of the session, 0 means never
+	RotateEvery int `json:"rotateEvery,omitempty"`
+}
+
+// UsernameGrammar describes how routing hints are encoded in a username.
+// The username is split by the separator, everything before the first key is the user and the rest are key value pairs,
+// e.g. "alice-country-de-city-berlin-session-abc123-rotate-10" with the DefaultUsernameGrammar.
+// A city runs until the next key, so it may contain the separator like "city-new-york". Keys left empty are not recognized.
+type UsernameGrammar struct {
+	Separator  string `json:"separator"`
+	CountryKey string `json:"countryKey"`
+	CityKey    string `json:"cityKey"`
+	SessionKey string `json:"sessionKey"`
+	RotateKey  string `json:"rotateKey"`
+}
+
+// DefaultUsernameGrammar is the grammar most commercial proxy providers use
+var DefaultUsernameGrammar = UsernameGrammar{
+	Separator:  "-",
+	CountryKey: "country",
+	CityKey:    "city",
+	SessionKey: "session",
+	RotateKey:  "rotate",
+}
+
+// Parse extracts the routing hints from a username, a username without any key is just the user
+func (g UsernameGrammar) Parse(username string) (RoutingHints, error) {
+	if g.Separator == "" {
+		return RoutingHints{User: username}, nil
+	}
+
+	parts := strings.Split(username, g.Separator)
+	start := len(parts)
+	for idx, part := range parts {
+		if g.isKey(part) {
+			start = idx
+			break
+		}
+	}
+
+	hints := RoutingHints{User: strings.Join(parts[:start], g.Separator)}
+	seen := make(map[string]bool)
+	for idx := start; idx < len(parts); idx += 2 {
+		key := parts[idx]
+		if key == g.CityKey {
+			parts = g.joinValue(parts, idx+1)
+		}
+		if !g.isKey(key) {
+			return hints, fmt.Errorf("unknown routing parameter %q in username", key)
+		}
+		if seen[key] {
+			return hints, fmt.Errorf("routing parameter %q is given twice in username", key)
+		}
+		seen[key] = true
+		if idx+1 >= len(parts) || parts[idx+1] == "" {
+			return hints, fmt.Errorf("routing parameter %q has no value in username", key)
+		}
+		value := parts[idx+1]
+
+		switch key {
+		case g.CountryKey:
+			hints.Country = strings.ToLower(value)
+		case g.CityKey:
+			hints.City = strings.ToLower(value)
+		case g.SessionKey:
+			hints.Session = value
+		case g.RotateKey:
+			rotateEvery, err := strconv.Atoi(value)
+			if err != nil || rotateEvery < 1 {
+				return hints, fmt.Errorf("routing parameter %q has to be a positive number, got %q", key, value)
+			}
+			hints.RotateEvery = rotateEvery
+		}
+	}
+
+	return hints, nil
+}
+
+// joinValue joins the parts from idx up to the next key into one value
+func (g UsernameGrammar) joinValue(parts []string, idx int) []string {
+	end := idx
+	for end < len(parts) && !g.isKey(parts[end]) {
+		end++
+	}
+	if end-idx < 2 {
+		return parts
+	}
+	joined := append(parts[:idx:idx], strings.Join(parts[idx:end], g.Separator))
+	return append(joined, parts[end:]...)
+}
+
+func (g UsernameGrammar) isKey(part string) bool {
+	return part != "" && (part == g.CountryKey || part == g.CityKey || part == g.SessionKey || part == g.RotateKey)
+}
@@ -0,0 +1,96 @@
+package socksauth
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestUsernameGrammarParse(t *testing.T) {
+	tests := []struct {
+		username string
+		want     RoutingHints
+	}{
+		{"alice", RoutingHints{User: "alice"}},
+		{"alice-country-DE", RoutingHints{User: "alice", Country: "de"}},
+		{"alice-country-de-city-berlin-session-abc123-rotate-10", RoutingHints{User: "alice", Country: "de", City: "berlin", Session: "abc123", RotateEvery: 10}},
+		{"team-alice-session-s1", RoutingHints{User: "team-alice", Session: "s1"}},
+		{"session-s1", RoutingHints{Session: "s1"}},
+		{"alice-city-new-york-session-s1", RoutingHints{User: "alice", City: "new-york", Session: "s1"}},
+		{"alice-country-us-city-los-angeles", RoutingHints{User: "alice", Country: "us", City: "los-angeles"}},
+	}
+	for _, test := range tests {
+		got, err := DefaultUsernameGrammar.Parse(test.username)
+		if err != nil {
+			t.Errorf("%s: %v", test.username, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: expected %+v, got %+v", test.username, test.want, got)
+		}
+	}
+
+	for _, invalid := range []string{"alice-country", "alice-country-de-foo-bar", "alice-rotate-0", "alice-rotate-x", "alice-session-a-session-b", "alice-country--city-x"} {
+		if _, err := DefaultUsernameGrammar.Parse(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+
+	custom := UsernameGrammar{Separator: "_", CountryKey: "cc", SessionKey: "sid"}
+	got, err := custom.Parse("bob_cc_us_sid_42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (RoutingHints{User: "bob", Country: "us", Session: "42"}); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+type hintsFinder struct {
+	reportingFinder
+	hints []RoutingHints
+	hmu   sync.Mutex
+}
+
+func (f *hintsFinder) Find(ctx context.Context, req Request) (Upstream, error) {
+	f.hmu.Lock()
+	f.hints = append(f.hints, req.Hints)
+	f.hmu.Unlock()
+	return f.reportingFinder.Find(ctx, req)
+}
+
+func TestUsernameGrammarThroughServer(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startMockUpstream(t, "user", "pass")
+
+	finder := &hintsFinder{reportingFinder: reportingFinder{upstreams: []Upstream{{Addr: upstream.Addr}}}}
+	var authUsers []string
+	_, proxyAddr := startTestServer(t, "", "user", "pass",
+		WithFinder(finder),
+		WithUsernameGrammar(DefaultUsernameGrammar),
+		WithClientAuth(func(username, password string) bool {
+			authUsers = append(authUsers, username)
+			return username == "alice" && password == "local"
+		}),
+	)
+
+	conn, err := dialSocks(proxyAddr, echoAddr, "alice-country-de-session-s1", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	if _, err := dialSocks(proxyAddr, echoAddr, "alice-country-de-planet-mars", "local"); err == nil {
+		t.Error("expected an invalid username to be rejected")
+	}
+
+	if len(authUsers) != 1 || authUsers[0] != "alice" {
+		t.Errorf("expected the auth function to get the plain user, got %v", authUsers)
+	}
+	finder.hmu.Lock()
+	defer finder.hmu.Unlock()
+	if want := (RoutingHints{User: "alice", Country: "de", Session: "s1"}); len(finder.hints) != 1 || finder.hints[0] != want {
+		t.Errorf("expected hints %+v, got %+v", want, finder.hints)
+	}
+}